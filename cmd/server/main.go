@@ -3,6 +3,9 @@ package main
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"sparkle-concept-sync/internal/config"
 	"sparkle-concept-sync/internal/database"
@@ -36,18 +39,122 @@ func main() {
 	// Initialize Redis service
 	redisService := services.NewRedisService(cfg.RedisURL)
 
+	// Circuit breakers shared by AI models and WhatsApp provider instances
+	breakers := services.NewCircuitBreakerRegistry(5, 30*time.Second)
+
 	// Initialize services
-	aiService := services.NewAIService(cfg.OpenRouterAPIKey, redisService)
+	rateLimiter := services.NewRateLimiter(redisService)
+	if spec := os.Getenv("RATE_LIMITS"); spec != "" {
+		limits, err := services.ParseRateLimits(spec)
+		if err != nil {
+			log.Printf("⚠️ Ignoring RATE_LIMITS: %v", err)
+		} else {
+			rateLimiter.SetLimits(limits)
+		}
+	}
+	if mode := os.Getenv("RATE_LIMIT_FAIL_MODE"); mode != "" {
+		if err := rateLimiter.SetFailureMode(services.RateLimitFailureMode(mode)); err != nil {
+			log.Printf("⚠️ Ignoring RATE_LIMIT_FAIL_MODE: %v", err)
+		}
+	}
+
+	aiService := services.NewAIService(cfg.OpenRouterAPIKey, redisService, breakers)
+	aiService.SetRateLimiter(rateLimiter)
+	if chain := os.Getenv("AI_FALLBACK_MODELS"); chain != "" {
+		aiService.SetFallbackChain(services.ParseModelChain(chain))
+	}
+	aiService.SetStructuredOutput(os.Getenv("AI_STRUCTURED_OUTPUT") == "true")
+	if backends := os.Getenv("AI_BACKENDS"); backends != "" {
+		clients, err := services.ParseLLMBackends(backends)
+		if err != nil {
+			log.Fatal("Invalid AI_BACKENDS:", err)
+		}
+		for name, client := range clients {
+			aiService.RegisterBackend(name, client)
+		}
+	}
+	if backend := os.Getenv("AI_DEFAULT_BACKEND"); backend != "" {
+		if err := aiService.SetDefaultBackend(backend); err != nil {
+			log.Fatal("Invalid AI_DEFAULT_BACKEND:", err)
+		}
+	}
+	if os.Getenv("AI_GUARDRAILS") == "off" {
+		aiService.SetGuardrails(nil)
+	} else {
+		blocklist := services.ParseBlocklist(os.Getenv("AI_GUARDRAIL_BLOCKLIST"))
+		aiService.SetGuardrails(services.NewGuardrails(blocklist, os.Getenv("AI_MODERATION_MODEL")))
+	}
 	deviceService := services.NewDeviceSettingsService(db)
-	flowService := services.NewFlowService(db, aiService)
-	providerService := services.NewProviderService()
-	websocketService := services.NewWebSocketService()
+	schedulerService := services.NewSchedulerService(redisService)
+	websocketService := services.NewWebSocketService(db, redisService)
+	providerService := services.NewProviderService(deviceService, breakers, schedulerService, websocketService)
+	usageService := services.NewUsageService(db)
+	if pricing := os.Getenv("AI_MODEL_PRICING"); pricing != "" {
+		table, err := services.ParseModelPricing(pricing)
+		if err != nil {
+			log.Printf("⚠️ Ignoring AI_MODEL_PRICING: %v", err)
+		} else {
+			usageService.SetPricing(table)
+		}
+	}
+	quotaService := services.NewQuotaService(db, redisService, websocketService)
+	if plans := os.Getenv("AI_PLAN_QUOTAS"); plans != "" {
+		table, err := services.ParsePlanQuotas(plans)
+		if err != nil {
+			log.Printf("⚠️ Ignoring AI_PLAN_QUOTAS: %v", err)
+		} else {
+			quotaService.SetPlans(table)
+		}
+	}
+	if ratio, err := strconv.ParseFloat(os.Getenv("AI_QUOTA_HARD_LIMIT"), 64); err == nil {
+		quotaService.SetHardLimitRatio(ratio)
+	}
+	if action := os.Getenv("AI_QUOTA_EXHAUSTED_ACTION"); action != "" {
+		if err := quotaService.SetExhaustedAction(services.QuotaAction(action), os.Getenv("AI_QUOTA_FALLBACK_MESSAGE")); err != nil {
+			log.Printf("⚠️ Ignoring AI_QUOTA_EXHAUSTED_ACTION: %v", err)
+		}
+	}
+	knowledgeService := services.NewKnowledgeService(db)
+	if model := os.Getenv("KNOWLEDGE_EMBEDDING_MODEL"); model != "" {
+		dimensions, _ := strconv.Atoi(os.Getenv("KNOWLEDGE_EMBEDDING_DIMENSIONS"))
+		if dimensions <= 0 {
+			dimensions = 1536
+		}
+		baseURL := os.Getenv("KNOWLEDGE_EMBEDDING_BASE_URL")
+		if baseURL == "" {
+			baseURL = "https://api.openai.com/v1"
+		}
+		embedder := services.NewOpenAIEmbedder(baseURL, os.Getenv("KNOWLEDGE_EMBEDDING_API_KEY"), model)
+		if err := knowledgeService.EnableVectorSearch(embedder, dimensions); err != nil {
+			log.Printf("⚠️ Knowledge base vector search disabled: %v", err)
+		}
+	}
+	toolService := services.NewToolService(db)
+	flowService := services.NewFlowService(db, redisService, aiService, providerService, deviceService, schedulerService, usageService, quotaService, knowledgeService, toolService, websocketService)
+
+	// Behind a load balancer the client IP, which per-IP rate limits count,
+	// comes from a header the balancer sets. It is only trusted from the
+	// balancer's own addresses.
+	proxyHeader := os.Getenv("PROXY_HEADER")
+	var trustedProxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
+	if proxyHeader != "" && len(trustedProxies) == 0 {
+		log.Printf("⚠️ PROXY_HEADER %s is trusted from any client, set TRUSTED_PROXIES to the load balancer addresses", proxyHeader)
+	}
 
 	// Initialize Fiber app
 	app := fiber.New(fiber.Config{
-		BodyLimit:    50 * 1024 * 1024, // 50MB limit for media uploads
-		ReadTimeout:  cfg.ReadTimeout,
-		WriteTimeout: cfg.WriteTimeout,
+		BodyLimit:               50 * 1024 * 1024, // 50MB limit for media uploads
+		ReadTimeout:             cfg.ReadTimeout,
+		WriteTimeout:            cfg.WriteTimeout,
+		ProxyHeader:             proxyHeader,
+		EnableTrustedProxyCheck: len(trustedProxies) > 0,
+		TrustedProxies:          trustedProxies,
+		EnableIPValidation:      true,
 	})
 
 	// Middleware
@@ -64,11 +171,33 @@ func main() {
 	app.Static("/", "./dist")
 
 	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(db, cfg.JWTSecret)
+	authHandler := handlers.NewAuthHandler(db, redisService, websocketService, cfg.JWTSecret)
+	var accessTTL, refreshTTL time.Duration
+	if v := os.Getenv("ACCESS_TOKEN_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			log.Printf("⚠️ Ignoring ACCESS_TOKEN_TTL: %q is not a positive duration", v)
+		} else {
+			accessTTL = d
+		}
+	}
+	if v := os.Getenv("REFRESH_TOKEN_TTL"); v != "" {
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			log.Printf("⚠️ Ignoring REFRESH_TOKEN_TTL: %q is not a positive duration", v)
+		} else {
+			refreshTTL = d
+		}
+	}
+	authHandler.SetTokenTTLs(accessTTL, refreshTTL)
+	authHandler.StartSessionCleanup(time.Hour)
 	profileHandler := handlers.NewProfileHandler(db)
-	deviceHandler := handlers.NewDeviceSettingsHandler(deviceService)
-	healthHandler := handlers.NewHealthHandler(db, redisService)
-	wahaHandler := handlers.NewWAHAHandler(flowService, providerService, websocketService)
+	deviceHandler := handlers.NewDeviceSettingsHandler(deviceService, aiService)
+	healthHandler := handlers.NewHealthHandler(db, redisService, breakers)
+	wahaHandler := handlers.NewWAHAHandler(flowService, providerService, deviceService, websocketService)
+	aiCacheHandler := handlers.NewAICacheHandler(aiService)
+	usageHandler := handlers.NewUsageHandler(usageService, quotaService)
+	knowledgeHandler := handlers.NewKnowledgeHandler(knowledgeService)
+	rateLimitHandler := handlers.NewRateLimitHandler(rateLimiter)
+	websocketService.SetAuthenticator(authHandler.WebSocketSession)
 
 	// WebSocket upgrade middleware
 	app.Use("/ws", func(c *fiber.Ctx) error {
@@ -91,12 +220,18 @@ func main() {
 
 	// Authentication routes
 	auth := api.Group("/auth")
-	auth.Post("/login", authHandler.Login)
-	auth.Post("/register", authHandler.Register)
+	// Login and registration are limited per IP against brute force
+	authLimit := rateLimitHandler.Limit(services.RateLimitAuth, handlers.ByIP)
+	auth.Post("/login", authLimit, authHandler.Login)
+	auth.Post("/register", authLimit, authHandler.Register)
+	auth.Post("/refresh", authLimit, authHandler.Refresh)
 	auth.Post("/logout", authHandler.Logout)
 
 	// Protected routes middleware
 	api.Use(authHandler.JWTMiddleware())
+	api.Use(rateLimitHandler.Limit(services.RateLimitUser, handlers.ByUser))
+
+	auth.Post("/logout-all", authHandler.LogoutAll)
 
 	// Profile routes
 	profile := api.Group("/profile")
@@ -111,14 +246,32 @@ func main() {
 	devices.Put("/:id", deviceHandler.UpdateDevice)
 	devices.Delete("/:id", deviceHandler.DeleteDevice)
 
+	// AI response cache routes
+	aiCache := api.Group("/ai-cache")
+	aiCache.Get("/stats", aiCacheHandler.GetCacheStats)
+	aiCache.Delete("/", aiCacheHandler.PurgeCache)
+
+	// AI usage routes
+	usage := api.Group("/usage")
+	usage.Get("/summary", usageHandler.GetUsageSummary)
+	usage.Get("/quota", usageHandler.GetQuota)
+
+	// Knowledge base routes
+	knowledge := api.Group("/knowledge")
+	knowledge.Get("/documents", knowledgeHandler.GetDocuments)
+	knowledge.Post("/documents", knowledgeHandler.AddDocument)
+	knowledge.Delete("/documents/:id", knowledgeHandler.DeleteDocument)
+	knowledge.Get("/search", knowledgeHandler.Search)
+
 	// Webhook info route
 	api.Get("/webhook-info", wahaHandler.GetWebhookInfo)
 
 	// Webhook routes (no auth required)
 	webhooks := app.Group("/webhooks")
-	webhooks.Post("/waha/:device_id", wahaHandler.HandleWAHAWebhook)
-	webhooks.Post("/wablas/:device_id", wahaHandler.HandleWablasWebhook)
-	webhooks.Post("/whacenter/:device_id", wahaHandler.HandleWhacenterWebhook)
+	deviceLimit := rateLimitHandler.Limit(services.RateLimitDevice, handlers.ByDevice)
+	webhooks.Post("/waha/:device_id", deviceLimit, wahaHandler.HandleWAHAWebhook)
+	webhooks.Post("/wablas/:device_id", deviceLimit, wahaHandler.HandleWablasWebhook)
+	webhooks.Post("/whacenter/:device_id", deviceLimit, wahaHandler.HandleWhacenterWebhook)
 
 	// TODO: Media upload routes to be implemented
 	// media := api.Group("/media")
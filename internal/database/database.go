@@ -43,6 +43,13 @@ func RunMigrations(db *sql.DB) error {
 		createConversationLogTable,
 		createOrdersTable,
 		createWasapBotTable,
+		createAIUsageTable,
+		createKnowledgeTables,
+		addDeviceGuardrailColumns,
+		addSessionRefreshColumns,
+		hashSessionTokens,
+		relaxDeviceModelCheck,
+		createProspectOrdersTable,
 		createIndexes,
 	}
 
@@ -196,6 +203,91 @@ CREATE TABLE IF NOT EXISTS wasapBot (
     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 );`
 
+const createAIUsageTable = `
+CREATE TABLE IF NOT EXISTS ai_usage (
+    id CHAR(36) PRIMARY KEY,
+    user_id CHAR(36) NOT NULL,
+    device_id VARCHAR(255),
+    flow_id VARCHAR(255),
+    execution_id VARCHAR(255),
+    model VARCHAR(255) NOT NULL,
+    prompt_tokens INTEGER NOT NULL DEFAULT 0,
+    completion_tokens INTEGER NOT NULL DEFAULT 0,
+    total_tokens INTEGER NOT NULL DEFAULT 0,
+    cost DECIMAL(12,6) NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`
+
+const createKnowledgeTables = `
+CREATE TABLE IF NOT EXISTS knowledge_documents (
+    id CHAR(36) PRIMARY KEY,
+    user_id CHAR(36) NOT NULL,
+    title VARCHAR(255) NOT NULL,
+    source VARCHAR(255),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS knowledge_chunks (
+    id CHAR(36) PRIMARY KEY,
+    document_id CHAR(36) NOT NULL,
+    user_id CHAR(36) NOT NULL,
+    chunk_index INTEGER NOT NULL,
+    content TEXT NOT NULL,
+    search_vector TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', content)) STORED,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    FOREIGN KEY (document_id) REFERENCES knowledge_documents(id) ON DELETE CASCADE
+);`
+
+// addDeviceGuardrailColumns adds the per-device policy for AI replies
+// blocked by guardrails to existing installations
+const addDeviceGuardrailColumns = `
+ALTER TABLE device_setting ADD COLUMN IF NOT EXISTS guardrail_action VARCHAR(20) DEFAULT 'fallback' CHECK (guardrail_action IN ('fallback', 'handoff', 'silence'));
+ALTER TABLE device_setting ADD COLUMN IF NOT EXISTS guardrail_message TEXT;`
+
+// addSessionRefreshColumns adds rotating refresh tokens to sessions. Rows of
+// one login share a family_id so a reused refresh token revokes them all.
+// Signed access tokens outgrow VARCHAR(255) once they carry an ID.
+const addSessionRefreshColumns = `
+ALTER TABLE user_sessions ALTER COLUMN token TYPE TEXT;
+ALTER TABLE user_sessions ADD COLUMN IF NOT EXISTS family_id CHAR(36);
+ALTER TABLE user_sessions ADD COLUMN IF NOT EXISTS refresh_token_hash CHAR(64);
+ALTER TABLE user_sessions ADD COLUMN IF NOT EXISTS refresh_expires_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE user_sessions ADD COLUMN IF NOT EXISTS rotated_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE user_sessions ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMP WITH TIME ZONE;`
+
+// hashSessionTokens replaces the raw JWTs of existing sessions with their
+// SHA-256, the form tokens are now stored and looked up in. The column stays
+// TEXT so the ALTER above doesn't rewrite the table on every start.
+const hashSessionTokens = `
+UPDATE user_sessions SET token = encode(sha256(convert_to(token, 'UTF8')), 'hex') WHERE length(token) <> 64;`
+
+// relaxDeviceModelCheck drops the fixed list of OpenRouter models a device
+// could use, models of other backends ("ollama:llama3.1") are checked by the
+// API against the registered backends instead
+const relaxDeviceModelCheck = `
+ALTER TABLE device_setting DROP CONSTRAINT IF EXISTS device_setting_api_key_option_check;
+ALTER TABLE device_setting ALTER COLUMN api_key_option TYPE VARCHAR(255);`
+
+// createProspectOrdersTable holds the orders prospects place with a tenant
+// through the AI create_order tool, apart from the tenant's own plan orders
+const createProspectOrdersTable = `
+CREATE TABLE IF NOT EXISTS prospect_orders (
+    id SERIAL PRIMARY KEY,
+    user_id CHAR(36) NOT NULL,
+    device_id VARCHAR(255) NOT NULL,
+    prospect_num VARCHAR(255) NOT NULL,
+    execution_id VARCHAR(255),
+    product VARCHAR(255) NOT NULL,
+    amount DECIMAL(10,2) NOT NULL,
+    status VARCHAR(20) DEFAULT 'Pending' CHECK (status IN ('Pending', 'Processing', 'Success', 'Failed')),
+    method VARCHAR(50) DEFAULT 'whatsapp',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);`
+
 const createIndexes = `
 -- Performance indexes for 5000+ concurrent users
 CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);
@@ -213,4 +305,13 @@ CREATE INDEX IF NOT EXISTS idx_wasapbot_prospect_num ON wasapBot(prospect_num);
 CREATE INDEX IF NOT EXISTS idx_wasapbot_user_id ON wasapBot(user_id);
 CREATE INDEX IF NOT EXISTS idx_user_sessions_user_id ON user_sessions(user_id);
 CREATE INDEX IF NOT EXISTS idx_user_sessions_token ON user_sessions(token);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_sessions_refresh_token_hash ON user_sessions(refresh_token_hash);
+CREATE INDEX IF NOT EXISTS idx_user_sessions_family_id ON user_sessions(family_id);
+CREATE INDEX IF NOT EXISTS idx_ai_usage_user_created ON ai_usage(user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_ai_usage_device_id ON ai_usage(device_id);
+CREATE INDEX IF NOT EXISTS idx_prospect_orders_prospect ON prospect_orders(device_id, prospect_num);
+CREATE INDEX IF NOT EXISTS idx_knowledge_documents_user_id ON knowledge_documents(user_id);
+CREATE INDEX IF NOT EXISTS idx_knowledge_chunks_document_id ON knowledge_chunks(document_id);
+CREATE INDEX IF NOT EXISTS idx_knowledge_chunks_user_id ON knowledge_chunks(user_id);
+CREATE INDEX IF NOT EXISTS idx_knowledge_chunks_search ON knowledge_chunks USING GIN(search_vector);
 `
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"sparkle-concept-sync/internal/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type AICacheHandler struct {
+	aiService *services.AIService
+}
+
+func NewAICacheHandler(aiService *services.AIService) *AICacheHandler {
+	return &AICacheHandler{aiService: aiService}
+}
+
+// GetCacheStats returns the AI response cache hit/miss counters of the authenticated user
+func (h *AICacheHandler) GetCacheStats(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+
+	stats, err := h.aiService.GetCacheStats(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Cache unavailable",
+		})
+	}
+
+	return c.JSON(stats)
+}
+
+// PurgeCache removes the authenticated user's cached AI responses, optionally
+// limited to a single flow with ?flow_id=
+func (h *AICacheHandler) PurgeCache(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+	flowID := c.Query("flow_id")
+
+	deleted, err := h.aiService.PurgeCache(c.Context(), userID, flowID)
+	if err != nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "Failed to purge cache",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Cache purged successfully",
+		"deleted": deleted,
+	})
+}
@@ -1,8 +1,16 @@
 package handlers
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
 	"sparkle-concept-sync/internal/models"
+	"sparkle-concept-sync/internal/services"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -12,10 +20,25 @@ import (
 )
 
 type AuthHandler struct {
-	db        *sql.DB
-	jwtSecret string
+	db               *sql.DB
+	redisService     *services.RedisService
+	websocketService *services.WebSocketService
+	jwtSecret        string
+	accessTTL        time.Duration
+	refreshTTL       time.Duration
 }
 
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+	// sessionCacheTTL bounds how long a validated session is trusted without
+	// asking Postgres, in case an invalidation is missed
+	sessionCacheTTL = 5 * time.Minute
+	// rotatedSessionRetention is how long a rotated session is kept after its
+	// access token expired, so reusing its refresh token is still caught
+	rotatedSessionRetention = 24 * time.Hour
+)
+
 type LoginRequest struct {
 	Email    string `json:"email" validate:"required,email"`
 	Password string `json:"password" validate:"required"`
@@ -27,9 +50,15 @@ type RegisterRequest struct {
 	Password string `json:"password" validate:"required,min=8"`
 }
 
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
 type AuthResponse struct {
-	Token string      `json:"token"`
-	User  models.User `json:"user"`
+	Token        string      `json:"token"`
+	RefreshToken string      `json:"refresh_token"`
+	ExpiresAt    time.Time   `json:"expires_at"`
+	User         models.User `json:"user"`
 }
 
 type Claims struct {
@@ -38,10 +67,25 @@ type Claims struct {
 	jwt.RegisteredClaims
 }
 
-func NewAuthHandler(db *sql.DB, jwtSecret string) *AuthHandler {
+func NewAuthHandler(db *sql.DB, redisService *services.RedisService, websocketService *services.WebSocketService, jwtSecret string) *AuthHandler {
 	return &AuthHandler{
-		db:        db,
-		jwtSecret: jwtSecret,
+		db:               db,
+		redisService:     redisService,
+		websocketService: websocketService,
+		jwtSecret:        jwtSecret,
+		accessTTL:        defaultAccessTokenTTL,
+		refreshTTL:       defaultRefreshTokenTTL,
+	}
+}
+
+// SetTokenTTLs sets how long access and refresh tokens live, zero keeps the
+// current value
+func (h *AuthHandler) SetTokenTTLs(access, refresh time.Duration) {
+	if access > 0 {
+		h.accessTTL = access
+	}
+	if refresh > 0 {
+		h.refreshTTL = refresh
 	}
 }
 
@@ -92,33 +136,19 @@ func (h *AuthHandler) Login(c *fiber.Ctx) error {
 		// logger.Error("Failed to update last login", err)
 	}
 
-	// Generate JWT token
-	token, err := h.generateJWT(user.ID, user.Email)
+	// Start a new session family
+	session, err := h.startSession(user.ID, user.Email)
 	if err != nil {
+		log.Printf("Failed to create session for user %s: %v", user.ID, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate token",
 		})
 	}
 
-	// Store session in database
-	sessionID := uuid.New().String()
-	_, err = h.db.Exec(`
-		INSERT INTO user_sessions (id, user_id, token, expires_at) 
-		VALUES ($1, $2, $3, $4)`,
-		sessionID, user.ID, token, time.Now().Add(24*time.Hour),
-	)
-	if err != nil {
-		// Log error but don't fail login
-		// logger.Error("Failed to store session", err)
-	}
-
 	// Remove password hash from response
 	user.PasswordHash = ""
 
-	return c.JSON(AuthResponse{
-		Token: token,
-		User:  user,
-	})
+	return c.JSON(session.response(user))
 }
 
 // Register creates a new user account
@@ -177,33 +207,121 @@ func (h *AuthHandler) Register(c *fiber.Ctx) error {
 		UpdatedAt: updatedAt,
 	}
 
-	// Generate JWT token
-	token, err := h.generateJWT(user.ID, user.Email)
+	// Start a new session family
+	session, err := h.startSession(user.ID, user.Email)
 	if err != nil {
+		log.Printf("Failed to create session for user %s: %v", user.ID, err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate token",
 		})
 	}
 
-	// Store session in database
-	sessionID := uuid.New().String()
-	_, err = h.db.Exec(`
-		INSERT INTO user_sessions (id, user_id, token, expires_at) 
-		VALUES ($1, $2, $3, $4)`,
-		sessionID, user.ID, token, time.Now().Add(24*time.Hour),
+	return c.Status(fiber.StatusCreated).JSON(session.response(user))
+}
+
+// Refresh exchanges a refresh token for a new token pair. Each refresh token
+// works once; presenting one that was already rotated means it leaked, so the
+// whole session family is revoked.
+func (h *AuthHandler) Refresh(c *fiber.Ctx) error {
+	var req RefreshRequest
+	if err := c.BodyParser(&req); err != nil || req.RefreshToken == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Refresh token required",
+		})
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	defer tx.Rollback()
+
+	var sessionID, familyID string
+	var user models.User
+	var refreshExpiresAt time.Time
+	var rotatedAt, revokedAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT s.id, s.family_id, s.refresh_expires_at, s.rotated_at, s.revoked_at,
+		       u.id, u.email, u.full_name, u.is_active, u.created_at, u.updated_at, u.last_login
+		FROM user_sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.refresh_token_hash = $1
+		FOR UPDATE OF s`,
+		hashToken(req.RefreshToken),
+	).Scan(
+		&sessionID, &familyID, &refreshExpiresAt, &rotatedAt, &revokedAt,
+		&user.ID, &user.Email, &user.FullName, &user.IsActive,
+		&user.CreatedAt, &user.UpdatedAt, &user.LastLogin,
 	)
 	if err != nil {
-		// Log error but don't fail registration
-		// logger.Error("Failed to store session", err)
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid refresh token",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
 	}
 
-	return c.Status(fiber.StatusCreated).JSON(AuthResponse{
-		Token: token,
-		User:  user,
-	})
+	switch {
+	case revokedAt.Valid:
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Session revoked",
+		})
+	case rotatedAt.Valid:
+		log.Printf("⚠️ Refresh token reuse for user %s, revoking session family %s", user.ID, familyID)
+		revoked, err := revokeSessions(tx, "family_id = $1", familyID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+		if err := tx.Commit(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+		h.forgetSessions(c.Context(), revoked)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Refresh token reuse detected, please log in again",
+		})
+	case time.Now().After(refreshExpiresAt):
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Refresh token expired",
+		})
+	case !user.IsActive:
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Account is disabled",
+		})
+	}
+
+	if _, err := tx.Exec(`UPDATE user_sessions SET rotated_at = NOW() WHERE id = $1`, sessionID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	session, err := h.issueSession(tx, user.ID, user.Email, familyID)
+	if err != nil {
+		log.Printf("Failed to rotate session for user %s: %v", user.ID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate token",
+		})
+	}
+	if err := tx.Commit(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	return c.JSON(session.response(user))
 }
 
-// Logout invalidates the user session
+// Logout revokes the session family of the access token, so its refresh
+// token stops working too
 func (h *AuthHandler) Logout(c *fiber.Ctx) error {
 	// Get token from Authorization header
 	authHeader := c.Get("Authorization")
@@ -219,18 +337,39 @@ func (h *AuthHandler) Logout(c *fiber.Ctx) error {
 		token = authHeader[7:]
 	}
 
-	// Delete session from database
-	_, err := h.db.Exec("DELETE FROM user_sessions WHERE token = $1", token)
+	// Revoke the session and the rest of its family
+	revoked, err := revokeSessions(h.db,
+		"token = $1 OR family_id = (SELECT family_id FROM user_sessions WHERE token = $1)",
+		hashToken(token),
+	)
 	if err != nil {
-		// Log error but don't fail logout
-		// logger.Error("Failed to delete session", err)
+		log.Printf("Failed to revoke session: %v", err)
 	}
+	h.forgetSessions(c.Context(), revoked)
 
 	return c.JSON(fiber.Map{
 		"message": "Logged out successfully",
 	})
 }
 
+// LogoutAll revokes every session of the current user, logging out all devices
+func (h *AuthHandler) LogoutAll(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+
+	revoked, err := revokeSessions(h.db, "user_id = $1", userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+	h.forgetSessions(c.Context(), revoked)
+
+	return c.JSON(fiber.Map{
+		"message": "Logged out of all devices",
+		"revoked": len(revoked),
+	})
+}
+
 // JWTMiddleware validates JWT tokens
 func (h *AuthHandler) JWTMiddleware() fiber.Handler {
 	return func(c *fiber.Ctx) error {
@@ -248,38 +387,10 @@ func (h *AuthHandler) JWTMiddleware() fiber.Handler {
 			tokenString = authHeader[7:]
 		}
 
-		// Parse and validate token
-		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(h.jwtSecret), nil
-		})
-
-		if err != nil || !token.Valid {
+		claims, err := h.Authenticate(c.Context(), tokenString)
+		if err != nil {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Invalid token",
-			})
-		}
-
-		// Extract claims
-		claims, ok := token.Claims.(*Claims)
-		if !ok {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Invalid token claims",
-			})
-		}
-
-		// Check if session exists in database
-		var sessionExists bool
-		err = h.db.QueryRow(`
-			SELECT EXISTS(
-				SELECT 1 FROM user_sessions 
-				WHERE token = $1 AND user_id = $2 AND expires_at > NOW()
-			)`,
-			tokenString, claims.UserID,
-		).Scan(&sessionExists)
-
-		if err != nil || !sessionExists {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Session expired or invalid",
+				"error": err.Error(),
 			})
 		}
 
@@ -291,13 +402,83 @@ func (h *AuthHandler) JWTMiddleware() fiber.Handler {
 	}
 }
 
-// generateJWT creates a new JWT token
-func (h *AuthHandler) generateJWT(userID, email string) (string, error) {
+// Authenticate validates a JWT and its session, the error says why a token
+// was rejected. Valid sessions are cached in Redis until revoked.
+func (h *AuthHandler) Authenticate(ctx context.Context, tokenString string) (*Claims, error) {
+	// Parse and validate token
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		return []byte(h.jwtSecret), nil
+	})
+
+	if err != nil || !token.Valid {
+		return nil, errors.New("Invalid token")
+	}
+
+	// Extract claims
+	claims, ok := token.Claims.(*Claims)
+	if !ok {
+		return nil, errors.New("Invalid token claims")
+	}
+
+	tokenHash := hashToken(tokenString)
+	if userID, err := h.redisService.GetCachedUserSession(ctx, tokenHash); err == nil && userID == claims.UserID {
+		return claims, nil
+	}
+
+	// Check if session exists in database
+	var sessionExists bool
+	err = h.db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM user_sessions 
+			WHERE token = $1 AND user_id = $2 AND expires_at > NOW() AND revoked_at IS NULL
+		)`,
+		tokenHash, claims.UserID,
+	).Scan(&sessionExists)
+
+	if err != nil || !sessionExists {
+		return nil, errors.New("Session expired or invalid")
+	}
+
+	ttl := sessionCacheTTL
+	if claims.ExpiresAt != nil && time.Until(claims.ExpiresAt.Time) < ttl {
+		ttl = time.Until(claims.ExpiresAt.Time)
+	}
+	if ttl > 0 {
+		if err := h.redisService.CacheUserSession(ctx, tokenHash, claims.UserID, ttl); err != nil {
+			log.Printf("Failed to cache session: %v", err)
+		}
+	}
+
+	return claims, nil
+}
+
+// WebSocketSession authenticates the token of a WebSocket connection. The
+// connection lives as long as the access token.
+func (h *AuthHandler) WebSocketSession(tokenString string) (services.WebSocketSession, error) {
+	claims, err := h.Authenticate(context.Background(), tokenString)
+	if err != nil {
+		return services.WebSocketSession{}, err
+	}
+
+	session := services.WebSocketSession{
+		UserID:    claims.UserID,
+		SessionID: hashToken(tokenString),
+	}
+	if claims.ExpiresAt != nil {
+		session.ExpiresAt = claims.ExpiresAt.Time
+	}
+	return session, nil
+}
+
+// generateJWT creates a new access token. The ID keeps tokens issued in the
+// same second distinct.
+func (h *AuthHandler) generateJWT(userID, email string, expiresAt time.Time) (string, error) {
 	claims := Claims{
 		UserID: userID,
 		Email:  email,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ID:        uuid.New().String(),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    "sparkle-concept-sync",
 		},
@@ -307,6 +488,126 @@ func (h *AuthHandler) generateJWT(userID, email string) (string, error) {
 	return token.SignedString([]byte(h.jwtSecret))
 }
 
+// session is a freshly issued access and refresh token pair
+type session struct {
+	accessToken  string
+	refreshToken string
+	expiresAt    time.Time
+}
+
+func (s *session) response(user models.User) AuthResponse {
+	return AuthResponse{
+		Token:        s.accessToken,
+		RefreshToken: s.refreshToken,
+		ExpiresAt:    s.expiresAt,
+		User:         user,
+	}
+}
+
+// sessionDB is satisfied by both *sql.DB and *sql.Tx
+type sessionDB interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// startSession opens a new session family at login and drops the user's
+// sessions that can no longer be refreshed
+func (h *AuthHandler) startSession(userID, email string) (*session, error) {
+	_, err := h.db.Exec(`
+		DELETE FROM user_sessions
+		WHERE user_id = $1 AND COALESCE(refresh_expires_at, expires_at) <= NOW()`,
+		userID,
+	)
+	if err != nil {
+		log.Printf("Failed to clean up sessions for user %s: %v", userID, err)
+	}
+
+	return h.issueSession(h.db, userID, email, uuid.New().String())
+}
+
+// issueSession stores a new token pair in the session family. Only hashes of
+// the tokens are kept.
+func (h *AuthHandler) issueSession(db sessionDB, userID, email, familyID string) (*session, error) {
+	now := time.Now()
+	expiresAt := now.Add(h.accessTTL)
+
+	accessToken, err := h.generateJWT(userID, email, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO user_sessions (id, user_id, token, expires_at, family_id, refresh_token_hash, refresh_expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		uuid.New().String(), userID, hashToken(accessToken), expiresAt, familyID, hashToken(refreshToken), now.Add(h.refreshTTL),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session{
+		accessToken:  accessToken,
+		refreshToken: refreshToken,
+		expiresAt:    expiresAt,
+	}, nil
+}
+
+// revokeSessions revokes the live sessions matching the condition and returns
+// their token hashes
+func revokeSessions(db sessionDB, condition string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(`
+		UPDATE user_sessions SET revoked_at = NOW()
+		WHERE revoked_at IS NULL AND (`+condition+`)
+		RETURNING token`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokenHashes []string
+	for rows.Next() {
+		var tokenHash string
+		if err := rows.Scan(&tokenHash); err != nil {
+			return nil, err
+		}
+		tokenHashes = append(tokenHashes, tokenHash)
+	}
+	return tokenHashes, rows.Err()
+}
+
+// forgetSessions drops revoked sessions from the session cache and closes
+// the WebSocket connections opened with them
+func (h *AuthHandler) forgetSessions(ctx context.Context, tokenHashes []string) {
+	for _, tokenHash := range tokenHashes {
+		if err := h.redisService.InvalidateUserSession(ctx, tokenHash); err != nil {
+			log.Printf("Failed to invalidate cached session: %v", err)
+		}
+	}
+	h.websocketService.RevokeSessions(tokenHashes)
+}
+
+// newRefreshToken returns an opaque random token
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is the SHA-256 hex digest a token is looked up by
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 // GetCurrentUser returns current authenticated user info
 func (h *AuthHandler) GetCurrentUser(c *fiber.Ctx) error {
 	userID := c.Locals("user_id").(string)
@@ -331,8 +632,36 @@ func (h *AuthHandler) GetCurrentUser(c *fiber.Ctx) error {
 	return c.JSON(user)
 }
 
-// CleanupExpiredSessions removes expired sessions (should be called periodically)
-func (h *AuthHandler) CleanupExpiredSessions() error {
-	_, err := h.db.Exec("DELETE FROM user_sessions WHERE expires_at <= NOW()")
-	return err
+// CleanupExpiredSessions removes sessions that can no longer be used:
+// expired ones, revoked ones whose access token expired and rotated ones
+// past rotatedSessionRetention. It returns how many were removed.
+func (h *AuthHandler) CleanupExpiredSessions() (int64, error) {
+	result, err := h.db.Exec(`
+		DELETE FROM user_sessions
+		WHERE COALESCE(refresh_expires_at, expires_at) <= NOW()
+		   OR (revoked_at IS NOT NULL AND expires_at <= NOW())
+		   OR (rotated_at IS NOT NULL AND expires_at <= NOW() - $1::int * INTERVAL '1 second')`,
+		int64(rotatedSessionRetention/time.Second),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// StartSessionCleanup runs CleanupExpiredSessions now and then every interval
+func (h *AuthHandler) StartSessionCleanup(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if removed, err := h.CleanupExpiredSessions(); err != nil {
+				log.Printf("Failed to clean up sessions: %v", err)
+			} else if removed > 0 {
+				log.Printf("🧹 Removed %d stale sessions", removed)
+			}
+			<-ticker.C
+		}
+	}()
 }
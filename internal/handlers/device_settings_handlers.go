@@ -9,11 +9,12 @@ import (
 )
 
 type DeviceSettingsHandler struct {
-	service *services.DeviceSettingsService
+	service   *services.DeviceSettingsService
+	aiService *services.AIService
 }
 
-func NewDeviceSettingsHandler(service *services.DeviceSettingsService) *DeviceSettingsHandler {
-	return &DeviceSettingsHandler{service: service}
+func NewDeviceSettingsHandler(service *services.DeviceSettingsService, aiService *services.AIService) *DeviceSettingsHandler {
+	return &DeviceSettingsHandler{service: service, aiService: aiService}
 }
 
 // GetDevices returns all devices for the authenticated user
@@ -63,6 +64,18 @@ func (h *DeviceSettingsHandler) CreateDevice(c *fiber.Ctx) error {
 		})
 	}
 
+	if req.GuardrailAction != nil && !services.ValidGuardrailAction(*req.GuardrailAction) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Guardrail action must be fallback, handoff or silence",
+		})
+	}
+
+	if !h.aiService.ValidateModel(req.APIKeyOption) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Unsupported AI model",
+		})
+	}
+
 	// Generate ID and set user
 	req.ID = uuid.New().String()
 	req.UserID = &userID
@@ -102,6 +115,18 @@ func (h *DeviceSettingsHandler) UpdateDevice(c *fiber.Ctx) error {
 		})
 	}
 
+	if req.GuardrailAction != nil && !services.ValidGuardrailAction(*req.GuardrailAction) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Guardrail action must be fallback, handoff or silence",
+		})
+	}
+
+	if !h.aiService.ValidateModel(req.APIKeyOption) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Unsupported AI model",
+		})
+	}
+
 	// Preserve ID and user
 	req.ID = id
 	req.UserID = &userID
@@ -12,12 +12,14 @@ import (
 type HealthHandler struct {
 	db           *sql.DB
 	redisService *services.RedisService
+	breakers     *services.CircuitBreakerRegistry
 }
 
-func NewHealthHandler(db *sql.DB, redisService *services.RedisService) *HealthHandler {
+func NewHealthHandler(db *sql.DB, redisService *services.RedisService, breakers *services.CircuitBreakerRegistry) *HealthHandler {
 	return &HealthHandler{
 		db:           db,
 		redisService: redisService,
+		breakers:     breakers,
 	}
 }
 
@@ -42,16 +44,21 @@ func (h *HealthHandler) DetailedHealthCheck(c *fiber.Ctx) error {
 			"database": h.checkDatabase(),
 			"redis":    h.checkRedis(),
 		},
+		"circuit_breakers": h.breakers.Snapshot(),
 	}
 
 	// Determine overall status
 	dbHealthy := health["checks"].(fiber.Map)["database"].(fiber.Map)["status"] == "healthy"
 	redisHealthy := health["checks"].(fiber.Map)["redis"].(fiber.Map)["status"] == "healthy"
 
-	if !dbHealthy || !redisHealthy {
+	if !dbHealthy {
 		health["status"] = "unhealthy"
 		return c.Status(fiber.StatusServiceUnavailable).JSON(health)
 	}
+	// Without Redis the service keeps running on in-memory storage
+	if !redisHealthy {
+		health["status"] = "degraded"
+	}
 
 	return c.JSON(health)
 }
@@ -85,11 +92,18 @@ func (h *HealthHandler) checkRedis() fiber.Map {
 
 	if err != nil {
 		return fiber.Map{
-			"status":   "unhealthy",
+			"status":   "degraded",
 			"error":    err.Error(),
 			"duration": duration.String(),
 		}
 	}
+	// Reachable again, but not switched back from memory yet
+	if h.redisService.Degraded() {
+		return fiber.Map{
+			"status":   "degraded",
+			"duration": duration.String(),
+		}
+	}
 
 	return fiber.Map{
 		"status":   "healthy",
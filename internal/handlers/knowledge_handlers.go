@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"database/sql"
+	"io"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"sparkle-concept-sync/internal/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// knowledgeFileTypes are the uploads accepted as plain text
+var knowledgeFileTypes = map[string]bool{
+	".txt":  true,
+	".md":   true,
+	".csv":  true,
+	".json": true,
+}
+
+type KnowledgeHandler struct {
+	knowledgeService *services.KnowledgeService
+}
+
+func NewKnowledgeHandler(knowledgeService *services.KnowledgeService) *KnowledgeHandler {
+	return &KnowledgeHandler{knowledgeService: knowledgeService}
+}
+
+type addDocumentRequest struct {
+	Title   string `json:"title"`
+	Source  string `json:"source"`
+	Content string `json:"content"`
+}
+
+// AddDocument adds a document to the authenticated user's knowledge base,
+// either as JSON {title, content} or as a multipart text file upload
+func (h *KnowledgeHandler) AddDocument(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+
+	var req addDocumentRequest
+	if file, err := c.FormFile("file"); err == nil {
+		ext := strings.ToLower(filepath.Ext(file.Filename))
+		if !knowledgeFileTypes[ext] {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Unsupported file type, upload .txt, .md, .csv or .json",
+			})
+		}
+
+		f, err := file.Open()
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Failed to read file",
+			})
+		}
+		defer f.Close()
+
+		content, err := io.ReadAll(f)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Failed to read file",
+			})
+		}
+
+		req.Title = c.FormValue("title", file.Filename)
+		req.Source = file.Filename
+		req.Content = string(content)
+	} else if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	req.Title = strings.TrimSpace(req.Title)
+	if req.Title == "" || strings.TrimSpace(req.Content) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Title and content are required",
+		})
+	}
+	if !utf8.ValidString(req.Content) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Content must be UTF-8 text",
+		})
+	}
+
+	document, err := h.knowledgeService.AddDocument(c.Context(), userID, req.Title, req.Source, req.Content)
+	if err == services.ErrDocumentTooLarge || err == services.ErrEmptyDocument {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to add document",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(document)
+}
+
+// GetDocuments lists the authenticated user's knowledge base documents
+func (h *KnowledgeHandler) GetDocuments(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+
+	documents, err := h.knowledgeService.GetDocuments(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch documents",
+		})
+	}
+
+	return c.JSON(documents)
+}
+
+// DeleteDocument removes a document from the authenticated user's knowledge base
+func (h *KnowledgeHandler) DeleteDocument(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+
+	if err := h.knowledgeService.DeleteDocument(userID, c.Params("id")); err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Document not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete document",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Document deleted successfully",
+	})
+}
+
+// Search previews the chunks an AI node would retrieve for ?q=, limited by ?k=
+func (h *KnowledgeHandler) Search(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+
+	query := c.Query("q")
+	if strings.TrimSpace(query) == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Query is required",
+		})
+	}
+
+	chunks, err := h.knowledgeService.Search(c.Context(), userID, query, c.QueryInt("k"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to search knowledge base",
+		})
+	}
+
+	return c.JSON(chunks)
+}
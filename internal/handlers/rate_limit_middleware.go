@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"sparkle-concept-sync/internal/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RateLimitKey returns who a request is counted against, or "" to skip the limit
+type RateLimitKey func(c *fiber.Ctx) string
+
+type RateLimitHandler struct {
+	limiter *services.RateLimiter
+}
+
+func NewRateLimitHandler(limiter *services.RateLimiter) *RateLimitHandler {
+	return &RateLimitHandler{limiter: limiter}
+}
+
+// ByIP counts requests per client IP
+func ByIP(c *fiber.Ctx) string {
+	return c.IP()
+}
+
+// ByUser counts requests per authenticated user, it must run after JWTMiddleware
+func ByUser(c *fiber.Ctx) string {
+	userID, _ := c.Locals("user_id").(string)
+	return userID
+}
+
+// ByDevice counts requests per :device_id route parameter, so it has to be
+// registered on the route itself rather than with Use
+func ByDevice(c *fiber.Ctx) string {
+	return c.Params("device_id")
+}
+
+// Limit rejects requests over the limit of tier with 429 Too Many Requests.
+// Every response carries the X-RateLimit-* headers of the request's window.
+func (h *RateLimitHandler) Limit(tier services.RateLimitTier, key RateLimitKey) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		subject := key(c)
+		if subject == "" {
+			return c.Next()
+		}
+
+		result, err := h.limiter.Allow(c.Context(), tier, subject)
+		if result == nil {
+			return c.Next()
+		}
+		// The limit couldn't be checked, there's no window to report
+		if err != nil {
+			if result.Allowed {
+				return c.Next()
+			}
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"error": "Rate limiting unavailable, try again later",
+			})
+		}
+
+		c.Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+		c.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Set("X-RateLimit-Reset", strconv.FormatInt(result.ResetAt.Unix(), 10))
+
+		if result.Allowed {
+			return c.Next()
+		}
+
+		retryAfter := int(math.Ceil(time.Until(result.ResetAt).Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error":       "Too many requests",
+			"retry_after": retryAfter,
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"time"
+
+	"sparkle-concept-sync/internal/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type UsageHandler struct {
+	usageService *services.UsageService
+	quotaService *services.QuotaService
+}
+
+func NewUsageHandler(usageService *services.UsageService, quotaService *services.QuotaService) *UsageHandler {
+	return &UsageHandler{
+		usageService: usageService,
+		quotaService: quotaService,
+	}
+}
+
+// GetUsageSummary returns the authenticated user's AI token usage and cost
+// grouped by ?period=daily|monthly. from and to are dates (YYYY-MM-DD) and
+// default to the last 30 days; ?device_id= limits the summary to one device.
+func (h *UsageHandler) GetUsageSummary(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+
+	period := c.Query("period", "daily")
+	if period != "daily" && period != "monthly" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "period must be daily or monthly",
+		})
+	}
+
+	to := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1)
+	from := to.AddDate(0, 0, -30)
+
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid from date, expected YYYY-MM-DD",
+			})
+		}
+		from = parsed
+	}
+	if value := c.Query("to"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid to date, expected YYYY-MM-DD",
+			})
+		}
+		// The to date is inclusive
+		to = parsed.AddDate(0, 0, 1)
+	}
+
+	if !from.Before(to) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "from must be before to",
+		})
+	}
+
+	summaries, err := h.usageService.GetUsageSummary(userID, period, from, to, c.Query("device_id"))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to load usage summary",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"period":  period,
+		"from":    from.Format("2006-01-02"),
+		"to":      to.AddDate(0, 0, -1).Format("2006-01-02"),
+		"summary": summaries,
+	})
+}
+
+// GetQuota returns the authenticated user's AI allowance and consumption for
+// the current month
+func (h *UsageHandler) GetQuota(c *fiber.Ctx) error {
+	userID := c.Locals("user_id").(string)
+
+	status, err := h.quotaService.GetQuotaStatus(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to load quota",
+		})
+	}
+
+	return c.JSON(status)
+}
@@ -11,13 +11,15 @@ import (
 type WAHAHandler struct {
 	flowService      *services.FlowService
 	providerService  *services.ProviderService
+	deviceService    *services.DeviceSettingsService
 	websocketService *services.WebSocketService
 }
 
-func NewWAHAHandler(flowService *services.FlowService, providerService *services.ProviderService, websocketService *services.WebSocketService) *WAHAHandler {
+func NewWAHAHandler(flowService *services.FlowService, providerService *services.ProviderService, deviceService *services.DeviceSettingsService, websocketService *services.WebSocketService) *WAHAHandler {
 	return &WAHAHandler{
 		flowService:      flowService,
 		providerService:  providerService,
+		deviceService:    deviceService,
 		websocketService: websocketService,
 	}
 }
@@ -118,31 +120,31 @@ func (h *WAHAHandler) processMessage(message models.WhatsAppMessage) {
 
 	log.Printf("Processing message from %s: %s", message.From, message.Body)
 
-	// Execute flow
+	// Execute flow, the flow engine delivers its replies through the provider
 	response, err := h.flowService.ExecuteFlow(message)
 	if err != nil {
 		log.Printf("Flow execution error: %v", err)
 		return
 	}
 
-	// Send response via provider
-	if response != nil {
-		err = h.providerService.SendMessage(message.DeviceID, message.From, response)
-		if err != nil {
-			log.Printf("Failed to send response: %v", err)
+	// Broadcast real-time update to the device's owner
+	if h.websocketService != nil {
+		device, err := h.deviceService.GetDeviceByIDDevice(message.DeviceID)
+		if err != nil || device.UserID == nil {
+			log.Printf("Not broadcasting message of device %s without an owner", message.DeviceID)
 			return
 		}
-	}
 
-	// Broadcast real-time update
-	if h.websocketService != nil {
 		update := models.WebSocketMessage{
-			Type:     "message_processed",
-			DeviceID: message.DeviceID,
-			Data: map[string]interface{}{
-				"from":     message.From,
-				"message":  message.Body,
-				"response": response,
+			Type:        models.EventMessageProcessed,
+			UserID:      *device.UserID,
+			DeviceID:    message.DeviceID,
+			ProspectNum: message.From,
+			FlowID:      h.flowService.ConversationFlowID(message.DeviceID, message.From),
+			Data: models.MessageProcessedEvent{
+				From:     message.From,
+				Message:  message.Body,
+				Response: response,
 			},
 		}
 		h.websocketService.Broadcast(update)
@@ -0,0 +1,138 @@
+package models
+
+// Real-time event types sent to dashboard clients over /ws. Each is carried
+// in a WebSocketMessage whose Data is the payload struct named next to it;
+// fields are only ever added to payloads, never renamed or removed.
+const (
+	// EventMessageReceived: MessageReceivedEvent
+	EventMessageReceived = "message_received"
+	// EventMessageSent: MessageSentEvent
+	EventMessageSent = "message_sent"
+	// EventMessageFailed: MessageFailedEvent
+	EventMessageFailed = "message_failed"
+	// EventMessageProcessed: MessageProcessedEvent, once the flow handled a message
+	EventMessageProcessed = "message_processed"
+	// EventExecutionStarted: ExecutionStartedEvent
+	EventExecutionStarted = "execution_started"
+	// EventNodeEntered: NodeEnteredEvent
+	EventNodeEntered = "node_entered"
+	// EventExecutionCompleted: ExecutionCompletedEvent
+	EventExecutionCompleted = "execution_completed"
+	// EventHumanTakeover: HumanTakeoverEvent
+	EventHumanTakeover = "human_takeover"
+	// EventDeviceStatusChanged: DeviceStatusChangedEvent
+	EventDeviceStatusChanged = "device_status_changed"
+	// EventQuotaWarning, EventQuotaSoftLimit and EventQuotaExhausted: QuotaEvent
+	EventQuotaWarning   = "quota_warning"
+	EventQuotaSoftLimit = "quota_soft_limit"
+	EventQuotaExhausted = "quota_exhausted"
+)
+
+// Reasons a conversation was handed to a human agent
+const (
+	HandoffManualNode = "manual_node"
+	HandoffTool       = "handoff_tool"
+	HandoffQuota      = "quota_exhausted"
+	HandoffGuardrail  = "guardrail"
+)
+
+// Device statuses, derived from the device's provider circuit breaker
+const (
+	DeviceOnline  = "online"
+	DeviceOffline = "offline"
+)
+
+// MessageReceivedEvent is a prospect's message arriving at a device
+type MessageReceivedEvent struct {
+	DeviceID    string `json:"device_id"`
+	ProspectNum string `json:"prospect_num"`
+	MessageID   string `json:"message_id,omitempty"`
+	MessageType string `json:"message_type"`
+	Message     string `json:"message"`
+}
+
+// MessageSentEvent is a message delivered to a prospect by the flow
+type MessageSentEvent struct {
+	DeviceID    string `json:"device_id"`
+	ProspectNum string `json:"prospect_num"`
+	ExecutionID string `json:"execution_id"`
+	MessageType string `json:"message_type"`
+	Content     string `json:"content"`
+	Stage       string `json:"stage,omitempty"`
+}
+
+// MessageFailedEvent is a message the provider couldn't deliver
+type MessageFailedEvent struct {
+	DeviceID    string `json:"device_id"`
+	ProspectNum string `json:"prospect_num"`
+	ExecutionID string `json:"execution_id"`
+	Error       string `json:"error"`
+}
+
+// MessageProcessedEvent summarizes the flow's handling of a message
+type MessageProcessedEvent struct {
+	From     string      `json:"from"`
+	Message  string      `json:"message"`
+	Response *AIResponse `json:"response"`
+}
+
+// ExecutionStartedEvent is a conversation starting a flow, Restarted when a
+// finished conversation starts over
+type ExecutionStartedEvent struct {
+	ExecutionID string `json:"execution_id"`
+	FlowID      string `json:"flow_id"`
+	DeviceID    string `json:"device_id"`
+	ProspectNum string `json:"prospect_num"`
+	Restarted   bool   `json:"restarted"`
+}
+
+// NodeEnteredEvent is an execution reaching a flow node
+type NodeEnteredEvent struct {
+	ExecutionID string `json:"execution_id"`
+	FlowID      string `json:"flow_id"`
+	NodeID      string `json:"node_id"`
+	NodeType    string `json:"node_type"`
+	Stage       string `json:"stage,omitempty"`
+}
+
+// ExecutionCompletedEvent is an execution finishing, Status is "completed" or
+// "failed" with the reason in Error
+type ExecutionCompletedEvent struct {
+	ExecutionID string `json:"execution_id"`
+	FlowID      string `json:"flow_id"`
+	Status      string `json:"status"`
+	Stage       string `json:"stage,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// HumanTakeoverEvent is the bot handing a conversation to an agent, Reason is
+// one of the Handoff constants
+type HumanTakeoverEvent struct {
+	ExecutionID string `json:"execution_id"`
+	DeviceID    string `json:"device_id"`
+	ProspectNum string `json:"prospect_num"`
+	Reason      string `json:"reason"`
+}
+
+// DeviceStatusChangedEvent is a device going offline after repeated send
+// failures or coming back online
+type DeviceStatusChangedEvent struct {
+	DeviceID string `json:"device_id"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+// QuotaEvent is a user's AI usage crossing a quota threshold
+type QuotaEvent struct {
+	Period       string         `json:"period"`
+	Usage        float64        `json:"usage"`
+	UsedMessages int64          `json:"used_messages"`
+	UsedTokens   int64          `json:"used_tokens"`
+	Allowance    QuotaAllowance `json:"allowance"`
+}
+
+// QuotaAllowance is what a user's plan allows per period
+type QuotaAllowance struct {
+	Messages int64 `json:"messages"`
+	Tokens   int64 `json:"tokens"`
+}
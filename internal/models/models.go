@@ -28,18 +28,21 @@ type UserSession struct {
 
 // DeviceSetting represents WhatsApp device configuration
 type DeviceSetting struct {
-	ID           string    `json:"id" db:"id"`
-	DeviceID     *string   `json:"device_id" db:"device_id"`
-	APIKeyOption string    `json:"api_key_option" db:"api_key_option"`
-	WebhookID    *string   `json:"webhook_id" db:"webhook_id"`
-	Provider     string    `json:"provider" db:"provider"`
-	PhoneNumber  *string   `json:"phone_number" db:"phone_number"`
-	APIKey       *string   `json:"api_key" db:"api_key"`
-	IDDevice     *string   `json:"id_device" db:"id_device"`
-	UserID       *string   `json:"user_id" db:"user_id"`
-	Instance     *string   `json:"instance" db:"instance"`
-	CreatedAt    time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+	ID           string  `json:"id" db:"id"`
+	DeviceID     *string `json:"device_id" db:"device_id"`
+	APIKeyOption string  `json:"api_key_option" db:"api_key_option"`
+	WebhookID    *string `json:"webhook_id" db:"webhook_id"`
+	Provider     string  `json:"provider" db:"provider"`
+	PhoneNumber  *string `json:"phone_number" db:"phone_number"`
+	APIKey       *string `json:"api_key" db:"api_key"`
+	IDDevice     *string `json:"id_device" db:"id_device"`
+	UserID       *string `json:"user_id" db:"user_id"`
+	Instance     *string `json:"instance" db:"instance"`
+	// GuardrailAction is fallback, handoff or silence for AI replies blocked by guardrails
+	GuardrailAction  *string   `json:"guardrail_action" db:"guardrail_action"`
+	GuardrailMessage *string   `json:"guardrail_message" db:"guardrail_message"`
+	CreatedAt        time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at" db:"updated_at"`
 }
 
 // FlowNode represents a node in the chatbot flow
@@ -168,6 +171,35 @@ type WhatsAppMessage struct {
 type AIResponse struct {
 	Stage    string      `json:"Stage"`
 	Response []AIMessage `json:"Response"`
+	Model    string      `json:"model,omitempty"` // Model that actually produced the reply
+	Usage    *AIUsage    `json:"usage,omitempty"` // Tokens spent, nil when served from cache
+	// Citations are the knowledge base chunks the reply was grounded on
+	Citations []Citation `json:"citations,omitempty"`
+	// ToolCalls are the tools the model ran before answering
+	ToolCalls []ToolInvocation `json:"tool_calls,omitempty"`
+}
+
+// ToolInvocation records a tool call made by the AI and its outcome
+type ToolInvocation struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Result    string `json:"result,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Citation references a knowledge base chunk used for an AI reply
+type Citation struct {
+	DocumentID string  `json:"document_id"`
+	ChunkID    string  `json:"chunk_id"`
+	Title      string  `json:"title"`
+	Score      float64 `json:"score"`
+}
+
+// AIUsage is the token usage reported by the AI provider for a reply
+type AIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
 }
 
 // AIMessage represents a single AI message
@@ -176,13 +208,64 @@ type AIMessage struct {
 	Content string `json:"content"`
 }
 
-// WebSocketMessage represents a WebSocket message
+// WebSocketMessage represents a WebSocket message. DeviceID, ProspectNum and
+// FlowID route it to subscribers of the matching topics, Data is the payload
+// of its type from the event catalog in events.go.
 type WebSocketMessage struct {
-	Type      string                 `json:"type"`
-	UserID    string                 `json:"user_id"`
-	DeviceID  string                 `json:"device_id,omitempty"`
-	Data      map[string]interface{} `json:"data"`
-	Timestamp time.Time              `json:"timestamp"`
+	// ID orders the events of a user, clients send the last one they saw to
+	// replay what they missed
+	ID          string      `json:"id,omitempty"`
+	Type        string      `json:"type"`
+	UserID      string      `json:"user_id"`
+	DeviceID    string      `json:"device_id,omitempty"`
+	ProspectNum string      `json:"prospect_num,omitempty"`
+	FlowID      string      `json:"flow_id,omitempty"`
+	Data        interface{} `json:"data"`
+	Timestamp   time.Time   `json:"timestamp"`
+}
+
+// AIUsageRecord represents the stored usage and cost of a single AI reply
+type AIUsageRecord struct {
+	ID               string    `json:"id" db:"id"`
+	UserID           string    `json:"user_id" db:"user_id"`
+	DeviceID         *string   `json:"device_id" db:"device_id"`
+	FlowID           *string   `json:"flow_id" db:"flow_id"`
+	ExecutionID      *string   `json:"execution_id" db:"execution_id"`
+	Model            string    `json:"model" db:"model"`
+	PromptTokens     int       `json:"prompt_tokens" db:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens" db:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens" db:"total_tokens"`
+	Cost             float64   `json:"cost" db:"cost"`
+	CreatedAt        time.Time `json:"created_at" db:"created_at"`
+}
+
+// UsageSummary aggregates AI usage over a day or month
+type UsageSummary struct {
+	Period           time.Time `json:"period"`
+	Requests         int64     `json:"requests"`
+	PromptTokens     int64     `json:"prompt_tokens"`
+	CompletionTokens int64     `json:"completion_tokens"`
+	TotalTokens      int64     `json:"total_tokens"`
+	Cost             float64   `json:"cost"`
+}
+
+// KnowledgeDocument represents a document of a user's knowledge base
+type KnowledgeDocument struct {
+	ID         string    `json:"id" db:"id"`
+	UserID     string    `json:"user_id" db:"user_id"`
+	Title      string    `json:"title" db:"title"`
+	Source     *string   `json:"source" db:"source"`
+	ChunkCount int       `json:"chunk_count" db:"chunk_count"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+}
+
+// KnowledgeChunk is a retrieved piece of a knowledge base document
+type KnowledgeChunk struct {
+	ID         string  `json:"id" db:"id"`
+	DocumentID string  `json:"document_id" db:"document_id"`
+	Title      string  `json:"title" db:"title"`
+	Content    string  `json:"content" db:"content"`
+	Score      float64 `json:"score"`
 }
 
 // Analytics represents analytics data
@@ -201,9 +284,14 @@ type ExecutionProcess struct {
 	ExecutionID     string                 `json:"execution_id"`
 	FlowID          string                 `json:"flow_id"`
 	CurrentNodeID   string                 `json:"current_node_id"`
+	LastNodeID      string                 `json:"last_node_id"`
 	ProspectNum     string                 `json:"prospect_num"`
+	DeviceID        string                 `json:"device_id"`
+	UserID          string                 `json:"user_id"`
+	Stage           string                 `json:"stage"`
 	Variables       map[string]interface{} `json:"variables"`
 	WaitingForReply bool                   `json:"waiting_for_reply"`
+	Human           bool                   `json:"human"`
 	Status          string                 `json:"status"`
 	CreatedAt       time.Time              `json:"created_at"`
 	UpdatedAt       time.Time              `json:"updated_at"`
@@ -234,3 +322,18 @@ func (cl *ConversationLog) MarshalAIResponse() ([]byte, error) {
 func (cl *ConversationLog) UnmarshalAIResponse(data []byte) error {
 	return json.Unmarshal(data, &cl.AIResponse)
 }
+
+// Add returns the sum of two usages, treating nil as zero
+func (u *AIUsage) Add(other *AIUsage) *AIUsage {
+	if u == nil {
+		return other
+	}
+	if other == nil {
+		return u
+	}
+	return &AIUsage{
+		PromptTokens:     u.PromptTokens + other.PromptTokens,
+		CompletionTokens: u.CompletionTokens + other.CompletionTokens,
+		TotalTokens:      u.TotalTokens + other.TotalTokens,
+	}
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// CachePolicy controls response caching for a single AI prompt
+type CachePolicy struct {
+	Disabled bool
+	// TTL overrides the default cache lifetime when set
+	TTL time.Duration
+	// FlowID and FlowVersion scope the entry to one revision of a flow, so
+	// editing the flow never serves answers generated for the old prompt
+	FlowID      string
+	FlowVersion string
+}
+
+// CacheStats are the AI response cache counters of a user
+type CacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+const (
+	aiCachePrefix = "ai_cache"
+	// noFlowScope is used for prompts that don't belong to a flow
+	noFlowScope = "-"
+)
+
+func (p CachePolicy) ttl() time.Duration {
+	if p.TTL > 0 {
+		return p.TTL
+	}
+	return cacheTimeout
+}
+
+// cacheKey builds a tenant-scoped key from a digest of everything that shapes
+// the reply: system prompt, model, flow version, context (instructions,
+// stage, history) and the normalized user message
+func (s *AIService) cacheKey(userID, model, prompt string, flowContext map[string]interface{}, policy CachePolicy) string {
+	digestInput, err := json.Marshal(map[string]interface{}{
+		"system":       chatbotSystemPrompt,
+		"structured":   s.structuredOutput,
+		"model":        model,
+		"flow_version": policy.FlowVersion,
+		"context":      flowContext,
+		"prompt":       normalizePrompt(prompt),
+	})
+	if err != nil {
+		return ""
+	}
+
+	digest := sha256.Sum256(digestInput)
+	return fmt.Sprintf("%s:%s:%s:%s", aiCachePrefix, userID, flowScope(policy.FlowID), hex.EncodeToString(digest[:]))
+}
+
+// getCachedResponse looks up key and counts the hit or miss for the user
+func (s *AIService) getCachedResponse(ctx context.Context, userID, key string, dest interface{}) bool {
+	hit := s.redisService.GetJSON(ctx, key, dest) == nil
+
+	counter := "misses"
+	if hit {
+		counter = "hits"
+	}
+	s.redisService.Increment(ctx, fmt.Sprintf("%s_stats:%s:%s", aiCachePrefix, userID, counter))
+
+	return hit
+}
+
+// GetCacheStats returns the AI cache hit and miss counters of a user
+func (s *AIService) GetCacheStats(ctx context.Context, userID string) (*CacheStats, error) {
+	stats := &CacheStats{}
+	for counter, dest := range map[string]*int64{"hits": &stats.Hits, "misses": &stats.Misses} {
+		value, err := s.redisService.Get(ctx, fmt.Sprintf("%s_stats:%s:%s", aiCachePrefix, userID, counter))
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			return nil, err
+		}
+		fmt.Sscanf(value, "%d", dest)
+	}
+	return stats, nil
+}
+
+// PurgeCache removes the cached AI responses of a user, limited to one flow
+// when flowID is set, and returns the number of removed entries
+func (s *AIService) PurgeCache(ctx context.Context, userID, flowID string) (int64, error) {
+	pattern := fmt.Sprintf("%s:%s:*", aiCachePrefix, escapeGlob(userID))
+	if flowID != "" {
+		pattern = fmt.Sprintf("%s:%s:%s:*", aiCachePrefix, escapeGlob(userID), escapeGlob(flowID))
+	}
+	return s.redisService.DeletePattern(ctx, pattern)
+}
+
+// normalizePrompt makes trivially different wordings of the same message
+// share a cache entry: case, punctuation and spacing are ignored
+func normalizePrompt(prompt string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range strings.ToLower(prompt) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if space && b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteRune(r)
+			space = false
+		default:
+			space = true
+		}
+	}
+	return b.String()
+}
+
+func flowScope(flowID string) string {
+	if flowID == "" {
+		return noFlowScope
+	}
+	return flowID
+}
+
+// escapeGlob escapes Redis glob metacharacters in a key segment
+func escapeGlob(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+	return replacer.Replace(s)
+}
@@ -0,0 +1,215 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"sparkle-concept-sync/internal/models"
+)
+
+// allowedMessageTypes are the AIMessage types the rest of the pipeline understands
+var allowedMessageTypes = map[string]bool{
+	"text":      true,
+	"image":     true,
+	"audio":     true,
+	"video":     true,
+	"delay":     true,
+	"condition": true,
+}
+
+var (
+	codeFencePattern    = regexp.MustCompile("(?s)```[a-zA-Z]*\\s*(.*?)\\s*```")
+	contentFieldPattern = regexp.MustCompile(`"content"\s*:\s*"((?:[^"\\]|\\.)*)"`)
+)
+
+// ResponseFormat requests structured output from OpenRouter
+type ResponseFormat struct {
+	Type       string      `json:"type"`
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+// JSONSchema is a named JSON schema for OpenRouter's json_schema response format
+type JSONSchema struct {
+	Name   string                 `json:"name"`
+	Strict bool                   `json:"strict"`
+	Schema map[string]interface{} `json:"schema"`
+}
+
+// aiResponseFormat describes models.AIResponse for models that support JSON schema mode
+var aiResponseFormat = &ResponseFormat{
+	Type: "json_schema",
+	JSONSchema: &JSONSchema{
+		Name:   "whatsapp_reply",
+		Strict: true,
+		Schema: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"Stage": map[string]interface{}{"type": "string"},
+				"Response": map[string]interface{}{
+					"type": "array",
+					"items": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"type": map[string]interface{}{
+								"type": "string",
+								"enum": []string{"text", "image", "audio", "video", "delay", "condition"},
+							},
+							"content": map[string]interface{}{"type": "string"},
+						},
+						"required":             []string{"type", "content"},
+						"additionalProperties": false,
+					},
+				},
+			},
+			"required":             []string{"Stage", "Response"},
+			"additionalProperties": false,
+		},
+	},
+}
+
+// decodeAIResponse extracts and validates the JSON reply of a model. It strips
+// markdown code fences, ignores text around the outermost JSON object and
+// tolerates trailing commas.
+func decodeAIResponse(raw string) (*models.AIResponse, error) {
+	object, ok := extractJSONObject(stripCodeFences(raw))
+	if !ok {
+		return nil, fmt.Errorf("no JSON object found in reply")
+	}
+
+	var aiResponse models.AIResponse
+	if err := json.Unmarshal([]byte(removeTrailingCommas(object)), &aiResponse); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	if err := validateAIResponse(&aiResponse); err != nil {
+		return nil, err
+	}
+
+	if aiResponse.Stage == "" {
+		aiResponse.Stage = "General Response"
+	}
+	return &aiResponse, nil
+}
+
+// validateAIResponse checks the reply has messages and that every message has a known type
+func validateAIResponse(aiResponse *models.AIResponse) error {
+	if len(aiResponse.Response) == 0 {
+		return fmt.Errorf("Response array is empty")
+	}
+
+	var problems []string
+	for i, message := range aiResponse.Response {
+		if !allowedMessageTypes[message.Type] {
+			problems = append(problems, fmt.Sprintf("Response[%d].type %q is not one of text, image, audio, video, delay, condition", i, message.Type))
+		}
+		if strings.TrimSpace(message.Content) == "" {
+			problems = append(problems, fmt.Sprintf("Response[%d].content is empty", i))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// salvageAIResponse recovers the content strings of a reply that could not be
+// repaired, so customers never receive raw or half-broken JSON
+func salvageAIResponse(raw string) *models.AIResponse {
+	text := strings.TrimSpace(stripCodeFences(raw))
+
+	var messages []models.AIMessage
+	for _, match := range contentFieldPattern.FindAllStringSubmatch(text, -1) {
+		content, err := strconv.Unquote(`"` + match[1] + `"`)
+		if err != nil || strings.TrimSpace(content) == "" {
+			continue
+		}
+		messages = append(messages, models.AIMessage{Type: "text", Content: content})
+	}
+
+	// Only plain prose is safe to send as is
+	if len(messages) == 0 && text != "" && !strings.Contains(text, "{") {
+		messages = append(messages, models.AIMessage{Type: "text", Content: text})
+	}
+
+	if len(messages) == 0 {
+		return nil
+	}
+	return &models.AIResponse{
+		Stage:    "General Response",
+		Response: messages,
+	}
+}
+
+// stripCodeFences returns the body of the first fenced code block, or the input unchanged
+func stripCodeFences(raw string) string {
+	if match := codeFencePattern.FindStringSubmatch(raw); match != nil {
+		return match[1]
+	}
+	return raw
+}
+
+// extractJSONObject returns the outermost balanced {...} object in text
+func extractJSONObject(text string) (string, bool) {
+	start := strings.Index(text, "{")
+	if start < 0 {
+		return "", false
+	}
+
+	depth := 0
+	inString := false
+	escaped := false
+	for i := start; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				return text[start : i+1], true
+			}
+		}
+	}
+	return "", false
+}
+
+// removeTrailingCommas drops commas directly before a closing } or ] outside of strings
+func removeTrailingCommas(object string) string {
+	var b strings.Builder
+	b.Grow(len(object))
+
+	inString := false
+	escaped := false
+	for i := 0; i < len(object); i++ {
+		c := object[i]
+		switch {
+		case escaped:
+			escaped = false
+		case inString && c == '\\':
+			escaped = true
+		case c == '"':
+			inString = !inString
+		case !inString && c == ',':
+			j := i + 1
+			for j < len(object) && strings.ContainsRune(" \t\r\n", rune(object[j])) {
+				j++
+			}
+			if j < len(object) && (object[j] == '}' || object[j] == ']') {
+				continue
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"testing"
+)
+
+func TestDecodeAIResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		stage   string
+		content string
+	}{
+		{
+			name:    "plain",
+			raw:     `{"Stage":"Greeting","Response":[{"type":"text","content":"Hi"}]}`,
+			stage:   "Greeting",
+			content: "Hi",
+		},
+		{
+			name:    "code fence",
+			raw:     "```json\n{\"Stage\":\"Greeting\",\"Response\":[{\"type\":\"text\",\"content\":\"Hi\"}]}\n```",
+			stage:   "Greeting",
+			content: "Hi",
+		},
+		{
+			name:    "surrounding text",
+			raw:     `Sure! {"Stage":"Greeting","Response":[{"type":"text","content":"Hi {there}"}]} Hope that helps.`,
+			stage:   "Greeting",
+			content: "Hi {there}",
+		},
+		{
+			name:    "trailing commas",
+			raw:     `{"Stage":"Greeting","Response":[{"type":"text","content":"a, ]",},],}`,
+			stage:   "Greeting",
+			content: "a, ]",
+		},
+		{
+			name:    "default stage",
+			raw:     `{"Response":[{"type":"text","content":"Hi"}]}`,
+			stage:   "General Response",
+			content: "Hi",
+		},
+	}
+
+	for _, tt := range tests {
+		response, err := decodeAIResponse(tt.raw)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if response.Stage != tt.stage || response.Response[0].Content != tt.content {
+			t.Errorf("%s: got stage %q content %q", tt.name, response.Stage, response.Response[0].Content)
+		}
+	}
+}
+
+func TestDecodeAIResponseRejectsInvalidReplies(t *testing.T) {
+	tests := map[string]string{
+		"no object":     "Hello there",
+		"invalid JSON":  `{"Stage": "x", "Response": [}`,
+		"empty":         `{"Stage":"x","Response":[]}`,
+		"unknown type":  `{"Stage":"x","Response":[{"type":"sticker","content":"a"}]}`,
+		"empty content": `{"Stage":"x","Response":[{"type":"text","content":"  "}]}`,
+	}
+
+	for name, raw := range tests {
+		if _, err := decodeAIResponse(raw); err == nil {
+			t.Errorf("%s: decoded %q without error", name, raw)
+		}
+	}
+}
+
+func TestSalvageAIResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		raw      string
+		contents []string
+	}{
+		{
+			name:     "content fields of broken JSON",
+			raw:      `{"Stage":"x","Response":[{"type":"text","content":"Hello \"friend\""},{"type":"text","content":"Bye"}`,
+			contents: []string{`Hello "friend"`, "Bye"},
+		},
+		{
+			name:     "plain prose",
+			raw:      "We open at nine.",
+			contents: []string{"We open at nine."},
+		},
+		{
+			name: "JSON without content",
+			raw:  `{"Stage":"x","Response":[`,
+		},
+		{
+			name: "blank",
+			raw:  "  ",
+		},
+	}
+
+	for _, tt := range tests {
+		response := salvageAIResponse(tt.raw)
+		if tt.contents == nil {
+			if response != nil {
+				t.Errorf("%s: salvaged %+v, want nothing", tt.name, response)
+			}
+			continue
+		}
+		if response == nil || len(response.Response) != len(tt.contents) {
+			t.Errorf("%s: salvaged %+v, want %d messages", tt.name, response, len(tt.contents))
+			continue
+		}
+		for i, content := range tt.contents {
+			if message := response.Response[i]; message.Type != "text" || message.Content != content {
+				t.Errorf("%s: message %d = %+v, want text %q", tt.name, i, message, content)
+			}
+		}
+	}
+}
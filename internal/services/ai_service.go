@@ -1,196 +1,453 @@
 package services
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"sparkle-concept-sync/internal/models"
 )
 
 type AIService struct {
-	openRouterAPIKey string
 	redisService     *RedisService
-	httpClient       *http.Client
+	backends         map[string]LLMClient
+	defaultBackend   string
+	fallbackChain    []ModelRoute
+	maxRetries       int
+	breakers         *CircuitBreakerRegistry
+	structuredOutput bool
+	guardrails       *Guardrails
+	rateLimiter      *RateLimiter
 }
 
-type OpenRouterRequest struct {
-	Model    string    `json:"model"`
-	Messages []Message `json:"messages"`
+// ModelRoute is a single entry of the AI model fallback chain
+type ModelRoute struct {
+	Model   string
+	Timeout time.Duration
 }
 
-type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
-}
-
-type OpenRouterResponse struct {
-	Choices []Choice  `json:"choices"`
-	Error   *APIError `json:"error,omitempty"`
+// chatbotSystemPrompt tells the model to answer in the models.AIResponse format
+const chatbotSystemPrompt = `You are an AI assistant for a WhatsApp chatbot. You must respond in this exact JSON format:
+{
+  "Stage": "Current conversation stage",
+  "Response": [
+    {"type": "text", "content": "Your response message here"}
+  ]
 }
 
-type Choice struct {
-	Message Message `json:"message"`
-}
+Available response types: text, image, audio, video, delay, condition
+Keep responses conversational and helpful. Always include a Stage and Response array.`
 
-type APIError struct {
-	Message string `json:"message"`
-	Code    string `json:"code"`
-}
+// repairPrompt asks the model to fix a reply that failed validation
+const repairPrompt = `Your previous reply could not be used: %v.
+Reply again with only the corrected JSON object in the required format, without code fences or any other text.`
 
 const (
-	openRouterBaseURL = "https://openrouter.ai/api/v1/chat/completions"
-	cacheTimeout      = 5 * time.Minute
+	cacheTimeout        = 5 * time.Minute
+	defaultModelTimeout = 15 * time.Second
+	defaultMaxRetries   = 2
+	retryBaseDelay      = 500 * time.Millisecond
 )
 
-func NewAIService(openRouterAPIKey string, redisService *RedisService) *AIService {
+// DefaultFallbackChain is the model order tried when the requested model fails
+var DefaultFallbackChain = []ModelRoute{
+	{Model: "openai/gpt-4.1", Timeout: 15 * time.Second},
+	{Model: "google/gemini-2.5-pro", Timeout: 20 * time.Second},
+	{Model: "openai/gpt-5-mini", Timeout: 10 * time.Second},
+}
+
+func NewAIService(openRouterAPIKey string, redisService *RedisService, breakers *CircuitBreakerRegistry) *AIService {
 	return &AIService{
-		openRouterAPIKey: openRouterAPIKey,
-		redisService:     redisService,
-		httpClient: &http.Client{
-			Timeout: 15 * time.Second,
+		redisService: redisService,
+		breakers:     breakers,
+		backends: map[string]LLMClient{
+			OpenRouterBackend: NewOpenRouterClient(openRouterAPIKey),
 		},
+		defaultBackend: OpenRouterBackend,
+		fallbackChain:  DefaultFallbackChain,
+		maxRetries:     defaultMaxRetries,
+		guardrails:     NewGuardrails(nil, ""),
+		rateLimiter:    NewRateLimiter(redisService),
+	}
+}
+
+// RegisterBackend makes an LLM backend available to models prefixed with
+// "<name>:", e.g. "ollama:llama3.1" for a backend registered as ollama
+func (s *AIService) RegisterBackend(name string, client LLMClient) {
+	s.backends[name] = client
+}
+
+// SetDefaultBackend selects the backend serving models without a backend prefix
+func (s *AIService) SetDefaultBackend(name string) error {
+	if _, ok := s.backends[name]; !ok {
+		return fmt.Errorf("unknown LLM backend %q", name)
 	}
+	s.defaultBackend = name
+	return nil
+}
+
+// backendFor returns the client serving model and the model name it expects.
+// A "<backend>:" prefix picks a registered backend, which lets a device or
+// flow node use a self-hosted model through its model setting.
+func (s *AIService) backendFor(model string) (LLMClient, string) {
+	if name, backendModel, ok := strings.Cut(model, ":"); ok {
+		if client, ok := s.backends[name]; ok {
+			return client, backendModel
+		}
+	}
+	return s.backends[s.defaultBackend], model
+}
+
+// SetRateLimiter shares a configured rate limiter, AI requests count against
+// its ai tier per user
+func (s *AIService) SetRateLimiter(limiter *RateLimiter) {
+	s.rateLimiter = limiter
+}
+
+// checkRateLimit counts an AI request of the user
+func (s *AIService) checkRateLimit(ctx context.Context, userID string) error {
+	result, _ := s.rateLimiter.Allow(ctx, RateLimitAI, userID)
+	if result != nil && !result.Allowed {
+		return fmt.Errorf("%w for user %s, retry after %s", ErrRateLimited, userID, result.ResetAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// SetFallbackChain replaces the ordered list of models tried after the requested one
+func (s *AIService) SetFallbackChain(chain []ModelRoute) {
+	s.fallbackChain = chain
+}
+
+// SetStructuredOutput enables the JSON schema response format for models
+// that support it
+func (s *AIService) SetStructuredOutput(enabled bool) {
+	s.structuredOutput = enabled
+}
+
+// ParseModelChain parses a chain spec such as
+// "openai/gpt-4.1=15s,google/gemini-2.5-pro=20s,openai/gpt-5-mini".
+// Entries without a timeout use the default model timeout.
+func ParseModelChain(spec string) []ModelRoute {
+	var chain []ModelRoute
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		route := ModelRoute{Model: entry, Timeout: defaultModelTimeout}
+		if name, timeout, ok := strings.Cut(entry, "="); ok {
+			route.Model = strings.TrimSpace(name)
+			if d, err := time.ParseDuration(strings.TrimSpace(timeout)); err == nil && d > 0 {
+				route.Timeout = d
+			} else {
+				log.Printf("Invalid timeout %q for model %s, using default", timeout, route.Model)
+			}
+		}
+		chain = append(chain, route)
+	}
+	return chain
 }
 
 // GetAIResponse generates AI response with caching and rate limiting
 func (s *AIService) GetAIResponse(ctx context.Context, prompt, model, userID string) (*models.AIResponse, error) {
-	// Create cache key
-	cacheKey := fmt.Sprintf("ai_response:%s:%s:%s", userID, model, prompt)
+	policy := CachePolicy{}
+	return s.getAIResponse(ctx, prompt, model, userID, guardScope{input: prompt}, s.cacheKey(userID, model, prompt, nil, policy), policy.ttl(), nil)
+}
+
+// guardScope is what the guardrails check a request against: the prospect's
+// own message and the node instructions the reply must not leak
+type guardScope struct {
+	input        string
+	instructions string
+}
+
+// flowGuardScope returns the guard scope of a flow prompt
+func flowGuardScope(prompt string, flowContext map[string]interface{}) guardScope {
+	instructions, _ := flowContext["instructions"].(string)
+	return guardScope{input: prompt, instructions: instructions}
+}
+
+// getAIResponse answers prompt, using the cache entry under cacheKey unless it
+// is empty. The model may call the given tools before answering. A reply
+// blocked by the guardrails is returned without messages, to account for its
+// usage, together with ErrReplyBlocked.
+func (s *AIService) getAIResponse(ctx context.Context, prompt, model, userID string, guard guardScope, cacheKey string, cacheTTL time.Duration, tools *ToolSet) (*models.AIResponse, error) {
+	if err := s.guardrails.ScreenInput(guard.input); err != nil {
+		return nil, err
+	}
 
 	// Try to get from cache first
-	if cached, err := s.redisService.Get(ctx, cacheKey); err == nil && cached != "" {
+	if cacheKey != "" {
 		var response models.AIResponse
-		if err := json.Unmarshal([]byte(cached), &response); err == nil {
+		if s.getCachedResponse(ctx, userID, cacheKey, &response) {
+			// Served from cache, no tokens were spent on this reply
+			response.Usage = nil
 			return &response, nil
 		}
 	}
 
 	// Check rate limit
-	rateLimitKey := fmt.Sprintf("rate_limit:ai:%s", userID)
-	if !s.redisService.CheckRateLimit(ctx, rateLimitKey, 100, time.Minute) {
-		return nil, fmt.Errorf("rate limit exceeded for user %s", userID)
+	if err := s.checkRateLimit(ctx, userID); err != nil {
+		return nil, err
 	}
 
-	// Make API request
-	response, err := s.makeOpenRouterRequest(ctx, prompt, model)
+	// Make API request, falling back through the model chain on failure
+	aiResponse, err := s.requestWithFallback(ctx, prompt, model, tools)
 	if err != nil {
 		return nil, err
 	}
 
-	// Parse AI response
-	aiResponse, err := s.parseAIResponse(response)
-	if err != nil {
-		return nil, err
+	// Only replies that passed the guardrails are cached
+	if err := s.guardReply(ctx, aiResponse, guard.instructions); err != nil {
+		aiResponse.Response = nil
+		return aiResponse, err
 	}
 
 	// Cache the response
-	if responseBytes, err := json.Marshal(aiResponse); err == nil {
-		s.redisService.Set(ctx, cacheKey, string(responseBytes), cacheTimeout)
+	if cacheKey != "" {
+		SetTyped(ctx, s.redisService, cacheKey, aiResponse, cacheTTL)
 	}
 
 	return aiResponse, nil
 }
 
-func (s *AIService) makeOpenRouterRequest(ctx context.Context, prompt, model string) (string, error) {
+// requestWithFallback tries the requested model first and then every model of
+// the fallback chain, skipping models whose circuit breaker is open
+func (s *AIService) requestWithFallback(ctx context.Context, prompt, model string, tools *ToolSet) (*models.AIResponse, error) {
+	var lastErr error
+
+	for _, route := range s.modelRoutes(model) {
+		var response string
+		var usage *models.AIUsage
+		breaker := s.breakers.Get("ai:" + route.Model)
+
+		err := breaker.Call(func() error {
+			var err error
+			response, usage, err = s.converse(ctx, prompt, route, tools)
+			return err
+		})
+		if err == nil {
+			aiResponse, repairUsage, err := s.parseAIResponse(ctx, route, prompt, response)
+			if err == nil {
+				aiResponse.Model = route.Model
+				aiResponse.Usage = usage.Add(repairUsage)
+				aiResponse.ToolCalls = tools.Invocations()
+				return aiResponse, nil
+			}
+
+			lastErr = err
+			log.Printf("Discarding AI response from %s: %v", route.Model, err)
+
+			// The repair already retried this model, another one would
+			// repeat tool calls with side effects
+			if tools.Executed() {
+				return nil, fmt.Errorf("unusable AI response after running tools: %v", err)
+			}
+			// Another model may follow the format where this one didn't
+			continue
+		}
+
+		lastErr = err
+
+		// Another model would repeat tool calls with side effects, such as orders
+		if tools.Executed() {
+			return nil, fmt.Errorf("AI request failed after running tools: %v", err)
+		}
+
+		if errors.Is(err, ErrCircuitOpen) {
+			log.Printf("Skipping AI model %s: %v", route.Model, err)
+			continue
+		}
+
+		// The caller gave up, nothing left to try
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if isFatalAIError(err) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("all AI models failed, last error: %v", lastErr)
+}
+
+// callModelWithRetry calls a single model, retrying retryable errors with jittered backoff
+func (s *AIService) callModelWithRetry(ctx context.Context, route ModelRoute, messages []Message, tools []ToolDefinition) (*ChatCompletion, error) {
+	var lastErr error
+
+	for attempt := 0; attempt <= s.maxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleepWithJitter(ctx, attempt); err != nil {
+				return nil, err
+			}
+		}
+
+		attemptCtx, cancel := context.WithTimeout(ctx, route.Timeout)
+		completion, err := s.complete(attemptCtx, route.Model, messages, tools)
+		cancel()
+		if err == nil {
+			return completion, nil
+		}
+
+		lastErr = err
+		log.Printf("AI request to %s failed (attempt %d): %v", route.Model, attempt+1, err)
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !isRetryableAIError(err) {
+			break
+		}
+	}
+
+	return nil, lastErr
+}
+
+// modelRoutes returns the requested model followed by the fallback chain without duplicates
+func (s *AIService) modelRoutes(model string) []ModelRoute {
 	// Default to GPT-4 if model not specified
 	if model == "" {
 		model = "openai/gpt-4"
 	}
 
-	// Construct system prompt for chatbot context
-	systemPrompt := `You are an AI assistant for a WhatsApp chatbot. You must respond in this exact JSON format:
-{
-  "Stage": "Current conversation stage",
-  "Response": [
-    {"type": "text", "content": "Your response message here"}
-  ]
+	routes := []ModelRoute{{Model: model, Timeout: defaultModelTimeout}}
+	for _, route := range s.fallbackChain {
+		if route.Model == model {
+			routes[0].Timeout = route.Timeout
+			continue
+		}
+		routes = append(routes, route)
+	}
+	return routes
 }
 
-Available response types: text, image, audio, video, delay, condition
-Keep responses conversational and helpful. Always include a Stage and Response array.`
+// MaxResponseTime is the longest a reply can take: every model of the
+// fallback chain timing out on every retry of every tool round, each followed
+// by a repair call, plus the moderation call
+func (s *AIService) MaxResponseTime() time.Duration {
+	// sleepWithJitter waits at most 1.5 times the backoff
+	var backoff time.Duration
+	for attempt := 1; attempt <= s.maxRetries; attempt++ {
+		backoff += (retryBaseDelay << (attempt - 1)) * 3 / 2
+	}
 
-	request := OpenRouterRequest{
-		Model: model,
-		Messages: []Message{
-			{Role: "system", Content: systemPrompt},
-			{Role: "user", Content: prompt},
-		},
+	total := moderationTimeout
+	for _, route := range s.modelRoutes("") {
+		call := time.Duration(s.maxRetries+1)*route.Timeout + backoff
+		total += time.Duration(maxToolRounds+1)*call + route.Timeout
 	}
+	return total
+}
 
-	requestBody, err := json.Marshal(request)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %v", err)
+// isRetryableAIError reports whether the same model is worth calling again
+func isRetryableAIError(err error) bool {
+	var statusErr *llmStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests || statusErr.StatusCode >= 500
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "POST", openRouterBaseURL, bytes.NewBuffer(requestBody))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %v", err)
+	// A per-model timeout moves on to the next model instead of retrying
+	if errors.Is(err, context.DeadlineExceeded) {
+		return false
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+s.openRouterAPIKey)
-	req.Header.Set("HTTP-Referer", "https://sparkle-concept-sync.com")
-	req.Header.Set("X-Title", "Sparkle Concept Sync")
+	// Transport errors (connection reset, DNS, ...)
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
 
-	resp, err := s.httpClient.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to make request: %v", err)
+// isFatalAIError reports errors that no other model can fix, such as a bad API key
+func isFatalAIError(err error) bool {
+	var statusErr *llmStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden
 	}
-	defer resp.Body.Close()
+	return false
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %v", err)
-	}
+// sleepWithJitter waits an exponentially growing, randomized delay before a retry
+func sleepWithJitter(ctx context.Context, attempt int) error {
+	backoff := retryBaseDelay << (attempt - 1)
+	delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("API request failed with status %d: %s", resp.StatusCode, string(body))
-	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
 
-	var openRouterResponse OpenRouterResponse
-	if err := json.Unmarshal(body, &openRouterResponse); err != nil {
-		return "", fmt.Errorf("failed to unmarshal response: %v", err)
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
 	}
+}
 
-	if openRouterResponse.Error != nil {
-		return "", fmt.Errorf("API error: %s", openRouterResponse.Error.Message)
+// chatMessages builds the conversation sent for a chatbot prompt
+func chatMessages(prompt string) []Message {
+	return []Message{
+		{Role: "system", Content: chatbotSystemPrompt},
+		{Role: "user", Content: prompt},
 	}
+}
+
+// complete performs a chat completion on the model's backend
+func (s *AIService) complete(ctx context.Context, model string, messages []Message, tools []ToolDefinition) (*ChatCompletion, error) {
+	client, backendModel := s.backendFor(model)
 
-	if len(openRouterResponse.Choices) == 0 {
-		return "", fmt.Errorf("no choices in response")
+	request := ChatRequest{
+		Model:    backendModel,
+		Messages: messages,
+		Tools:    tools,
+	}
+	if s.structuredOutput {
+		request.ResponseFormat = aiResponseFormat
 	}
 
-	return openRouterResponse.Choices[0].Message.Content, nil
+	return client.Complete(ctx, request)
 }
 
-func (s *AIService) parseAIResponse(response string) (*models.AIResponse, error) {
-	var aiResponse models.AIResponse
-
-	// Try to parse as JSON first
-	if err := json.Unmarshal([]byte(response), &aiResponse); err == nil {
-		// Validate that we have required fields
-		if aiResponse.Stage != "" && len(aiResponse.Response) > 0 {
-			return &aiResponse, nil
+// parseAIResponse decodes a model reply. An invalid reply gets one repair
+// round-trip with the same model, after which its text content is salvaged.
+// The token usage of the repair call is returned alongside.
+func (s *AIService) parseAIResponse(ctx context.Context, route ModelRoute, prompt, response string) (*models.AIResponse, *models.AIUsage, error) {
+	aiResponse, err := decodeAIResponse(response)
+	if err == nil {
+		return aiResponse, nil, nil
+	}
+	log.Printf("Invalid AI response from %s, requesting repair: %v", route.Model, err)
+
+	messages := append(chatMessages(prompt),
+		Message{Role: "assistant", Content: response},
+		Message{Role: "user", Content: fmt.Sprintf(repairPrompt, err)},
+	)
+
+	repairCtx, cancel := context.WithTimeout(ctx, route.Timeout)
+	completion, repairErr := s.complete(repairCtx, route.Model, messages, nil)
+	cancel()
+
+	var usage *models.AIUsage
+	if repairErr == nil {
+		usage = completion.Usage
+		if aiResponse, err := decodeAIResponse(completion.Content); err == nil {
+			return aiResponse, usage, nil
+		}
+		if salvaged := salvageAIResponse(completion.Content); salvaged != nil {
+			return salvaged, usage, nil
 		}
+	} else {
+		log.Printf("AI response repair with %s failed: %v", route.Model, repairErr)
 	}
 
-	// If JSON parsing fails or invalid structure, create a fallback response
-	aiResponse = models.AIResponse{
-		Stage: "General Response",
-		Response: []models.AIMessage{
-			{
-				Type:    "text",
-				Content: response,
-			},
-		},
+	if salvaged := salvageAIResponse(response); salvaged != nil {
+		return salvaged, usage, nil
 	}
-
-	return &aiResponse, nil
+	return nil, usage, fmt.Errorf("unusable AI response: %v", err)
 }
 
 // GetAvailableModels returns list of supported AI models
@@ -205,8 +462,21 @@ func (s *AIService) GetAvailableModels() []string {
 	}
 }
 
-// ValidateModel checks if a model is supported
+// ValidateModel checks if a model is supported. Any model of a registered
+// backend other than OpenRouter is accepted as is, including unprefixed
+// models when another backend is the default.
 func (s *AIService) ValidateModel(model string) bool {
+	if model == "" {
+		return false
+	}
+	if name, _, ok := strings.Cut(model, ":"); ok && name != OpenRouterBackend {
+		if _, ok := s.backends[name]; ok {
+			return true
+		}
+	} else if !ok && s.defaultBackend != OpenRouterBackend {
+		return true
+	}
+
 	supportedModels := s.GetAvailableModels()
 	for _, supportedModel := range supportedModels {
 		if model == supportedModel {
@@ -217,17 +487,34 @@ func (s *AIService) ValidateModel(model string) bool {
 }
 
 // ProcessFlowPrompt processes a chatbot flow prompt with context
-func (s *AIService) ProcessFlowPrompt(ctx context.Context, prompt, model, userID string, flowContext map[string]interface{}) (*models.AIResponse, error) {
+func (s *AIService) ProcessFlowPrompt(ctx context.Context, prompt, model, userID string, flowContext map[string]interface{}, cachePolicy CachePolicy) (*models.AIResponse, error) {
 	// Enhance prompt with flow context
 	enhancedPrompt := s.buildContextualPrompt(prompt, flowContext)
 
-	return s.GetAIResponse(ctx, enhancedPrompt, model, userID)
+	cacheKey := ""
+	if !cachePolicy.Disabled {
+		cacheKey = s.cacheKey(userID, model, prompt, flowContext, cachePolicy)
+	}
+
+	return s.getAIResponse(ctx, enhancedPrompt, model, userID, flowGuardScope(prompt, flowContext), cacheKey, cachePolicy.ttl(), nil)
+}
+
+// ProcessFlowPromptWithTools is ProcessFlowPrompt for nodes that declare
+// tools. Replies are never cached since tools act on live data.
+func (s *AIService) ProcessFlowPromptWithTools(ctx context.Context, prompt, model, userID string, flowContext map[string]interface{}, tools *ToolSet) (*models.AIResponse, error) {
+	enhancedPrompt := s.buildContextualPrompt(prompt, flowContext)
+
+	return s.getAIResponse(ctx, enhancedPrompt, model, userID, flowGuardScope(prompt, flowContext), "", 0, tools)
 }
 
 func (s *AIService) buildContextualPrompt(prompt string, context map[string]interface{}) string {
 	contextStr := ""
 
 	if context != nil {
+		if instructions, ok := context["instructions"].(string); ok && instructions != "" {
+			contextStr += fmt.Sprintf("Instructions: %s\n", instructions)
+		}
+
 		if stage, ok := context["stage"].(string); ok && stage != "" {
 			contextStr += fmt.Sprintf("Current Stage: %s\n", stage)
 		}
@@ -245,6 +532,13 @@ func (s *AIService) buildContextualPrompt(prompt string, context map[string]inte
 				contextStr += fmt.Sprintf("Business Niche: %s\n", niche)
 			}
 		}
+
+		if knowledge, ok := context["knowledge"].([]models.KnowledgeChunk); ok && len(knowledge) > 0 {
+			contextStr += "Knowledge Base (answer from these facts when relevant, don't invent details):\n"
+			for i, chunk := range knowledge {
+				contextStr += fmt.Sprintf("[%d] %s: %s\n", i+1, chunk.Title, chunk.Content)
+			}
+		}
 	}
 
 	if contextStr != "" {
@@ -253,37 +547,3 @@ func (s *AIService) buildContextualPrompt(prompt string, context map[string]inte
 
 	return prompt
 }
-
-// Circuit breaker for AI service reliability
-type CircuitBreaker struct {
-	failureCount    int
-	lastFailureTime time.Time
-	timeout         time.Duration
-	threshold       int
-}
-
-func NewCircuitBreaker(threshold int, timeout time.Duration) *CircuitBreaker {
-	return &CircuitBreaker{
-		threshold: threshold,
-		timeout:   timeout,
-	}
-}
-
-func (cb *CircuitBreaker) Call(operation func() error) error {
-	if cb.failureCount >= cb.threshold {
-		if time.Since(cb.lastFailureTime) < cb.timeout {
-			return fmt.Errorf("circuit breaker is open")
-		}
-		cb.failureCount = 0
-	}
-
-	err := operation()
-	if err != nil {
-		cb.failureCount++
-		cb.lastFailureTime = time.Now()
-		return err
-	}
-
-	cb.failureCount = 0
-	return nil
-}
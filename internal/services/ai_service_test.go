@@ -0,0 +1,276 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestAIService returns an AIService whose default backend is client,
+// falling back through the given models, without retries or guardrails
+func newTestAIService(t *testing.T, client *FakeLLMClient, fallback ...string) *AIService {
+	t.Helper()
+
+	redisService := NewRedisService("redis://127.0.0.1:1")
+	t.Cleanup(func() { redisService.Close() })
+
+	s := NewAIService("", redisService, NewCircuitBreakerRegistry(2, time.Minute))
+	s.RegisterBackend("fake", client)
+	if err := s.SetDefaultBackend("fake"); err != nil {
+		t.Fatal(err)
+	}
+
+	var chain []ModelRoute
+	for _, model := range fallback {
+		chain = append(chain, ModelRoute{Model: model, Timeout: time.Second})
+	}
+	s.SetFallbackChain(chain)
+	s.maxRetries = 0
+	s.SetGuardrails(nil)
+	return s
+}
+
+// countingToolSet returns a ToolSet with a create_order tool counting its calls
+func countingToolSet(calls *int32) *ToolSet {
+	return &ToolSet{tools: map[string]aiTool{
+		"create_order": {
+			definition: functionTool("create_order", "Create an order.", `{"type":"object"}`),
+			handler: func(ctx context.Context, toolCtx ToolContext, arguments json.RawMessage) (interface{}, error) {
+				atomic.AddInt32(calls, 1)
+				return map[string]interface{}{"order_id": 1}, nil
+			},
+		},
+	}}
+}
+
+func createOrderCall() *ChatCompletion {
+	return &ChatCompletion{ToolCalls: []ToolCall{{
+		ID:       "call_1",
+		Type:     "function",
+		Function: FunctionCall{Name: "create_order", Arguments: `{"product":"Tea","amount":10}`},
+	}}}
+}
+
+// hasToolResult reports whether the request already carries a tool result
+func hasToolResult(request ChatRequest) bool {
+	for _, message := range request.Messages {
+		if message.Role == "tool" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRequestWithFallbackStopsOnParseFailureAfterTools(t *testing.T) {
+	var models []string
+	client := &FakeLLMClient{Completion: func(request ChatRequest) (*ChatCompletion, error) {
+		models = append(models, request.Model)
+		if len(request.Tools) > 0 && !hasToolResult(request) {
+			return createOrderCall(), nil
+		}
+		// Neither valid JSON nor prose that could be salvaged
+		return &ChatCompletion{Content: `{"Stage": broken`}, nil
+	}}
+	s := newTestAIService(t, client, "second")
+
+	var calls int32
+	_, err := s.requestWithFallback(context.Background(), "I'll take the tea", "first", countingToolSet(&calls))
+	if err == nil || !strings.Contains(err.Error(), "after running tools") {
+		t.Fatalf("error = %v, want a failure after running tools", err)
+	}
+	if calls != 1 {
+		t.Fatalf("create_order ran %d times, want 1", calls)
+	}
+	for _, model := range models {
+		if model == "second" {
+			t.Fatal("fell back to another model after tools ran")
+		}
+	}
+}
+
+const validReply = `{"Stage":"Greeting","Response":[{"type":"text","content":"Hello"}]}`
+
+func TestRequestWithFallbackOrder(t *testing.T) {
+	var models []string
+	client := &FakeLLMClient{Completion: func(request ChatRequest) (*ChatCompletion, error) {
+		models = append(models, request.Model)
+		if request.Model != "third" {
+			return nil, &llmStatusError{StatusCode: http.StatusBadGateway}
+		}
+		return &ChatCompletion{Content: validReply}, nil
+	}}
+	// The requested model isn't repeated when it is also in the chain
+	s := newTestAIService(t, client, "second", "first", "third")
+
+	response, err := s.requestWithFallback(context.Background(), "Hi", "first", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Model != "third" {
+		t.Fatalf("answered by %s, want third", response.Model)
+	}
+	if got := strings.Join(models, ","); got != "first,second,third" {
+		t.Fatalf("tried %s, want first,second,third", got)
+	}
+}
+
+func TestRequestWithFallbackSkipsOpenBreaker(t *testing.T) {
+	var models []string
+	client := &FakeLLMClient{Completion: func(request ChatRequest) (*ChatCompletion, error) {
+		models = append(models, request.Model)
+		return &ChatCompletion{Content: validReply}, nil
+	}}
+	s := newTestAIService(t, client, "second")
+
+	breaker := s.breakers.Get("ai:first")
+	for breaker.State() != BreakerOpen {
+		breaker.Call(func() error { return &llmStatusError{StatusCode: http.StatusServiceUnavailable} })
+	}
+
+	response, err := s.requestWithFallback(context.Background(), "Hi", "first", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Model != "second" || len(models) != 1 || models[0] != "second" {
+		t.Fatalf("answered by %s after calling %v, want only second", response.Model, models)
+	}
+}
+
+func TestRequestWithFallbackOpensBreaker(t *testing.T) {
+	client := &FakeLLMClient{Completion: func(request ChatRequest) (*ChatCompletion, error) {
+		return nil, &llmStatusError{StatusCode: http.StatusBadGateway}
+	}}
+	s := newTestAIService(t, client)
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.requestWithFallback(context.Background(), "Hi", "first", nil); err == nil {
+			t.Fatal("request succeeded against a failing model")
+		}
+	}
+	if state := s.breakers.Get("ai:first").State(); state != BreakerOpen {
+		t.Fatalf("breaker is %s after repeated failures, want open", state)
+	}
+}
+
+func TestRequestWithFallbackStopsOnFatalError(t *testing.T) {
+	var models []string
+	client := &FakeLLMClient{Completion: func(request ChatRequest) (*ChatCompletion, error) {
+		models = append(models, request.Model)
+		return nil, &llmStatusError{StatusCode: http.StatusUnauthorized}
+	}}
+	s := newTestAIService(t, client, "second")
+
+	if _, err := s.requestWithFallback(context.Background(), "Hi", "first", nil); err == nil {
+		t.Fatal("request succeeded with a rejected API key")
+	}
+	if len(models) != 1 {
+		t.Fatalf("tried %v after a fatal error, want only first", models)
+	}
+}
+
+func TestRequestWithFallbackStopsAfterToolsRan(t *testing.T) {
+	var models []string
+	client := &FakeLLMClient{Completion: func(request ChatRequest) (*ChatCompletion, error) {
+		models = append(models, request.Model)
+		if !hasToolResult(request) {
+			return createOrderCall(), nil
+		}
+		return nil, &llmStatusError{StatusCode: http.StatusBadGateway}
+	}}
+	s := newTestAIService(t, client, "second")
+
+	var calls int32
+	if _, err := s.requestWithFallback(context.Background(), "Hi", "first", countingToolSet(&calls)); err == nil {
+		t.Fatal("request succeeded against a failing model")
+	}
+	if calls != 1 || len(models) != 2 || models[1] != "first" {
+		t.Fatalf("tool ran %d times over models %v, want once on first only", calls, models)
+	}
+}
+
+func TestConverseToolRoundLimit(t *testing.T) {
+	var requests []ChatRequest
+	client := &FakeLLMClient{Completion: func(request ChatRequest) (*ChatCompletion, error) {
+		requests = append(requests, request)
+		if len(request.Tools) > 0 {
+			return createOrderCall(), nil
+		}
+		return &ChatCompletion{Content: validReply}, nil
+	}}
+	s := newTestAIService(t, client)
+
+	var calls int32
+	response, err := s.requestWithFallback(context.Background(), "Hi", "first", countingToolSet(&calls))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != maxToolRounds {
+		t.Fatalf("tools ran %d times, want %d", calls, maxToolRounds)
+	}
+	if len(requests) != maxToolRounds+1 || len(requests[maxToolRounds].Tools) != 0 {
+		t.Fatalf("made %d requests, want %d with the last one without tools", len(requests), maxToolRounds+1)
+	}
+	if len(response.ToolCalls) != maxToolRounds {
+		t.Fatalf("response lists %d tool calls, want %d", len(response.ToolCalls), maxToolRounds)
+	}
+}
+
+func TestRequestWithFallbackRepairsReply(t *testing.T) {
+	var models []string
+	client := &FakeLLMClient{Completion: func(request ChatRequest) (*ChatCompletion, error) {
+		models = append(models, request.Model)
+		last := request.Messages[len(request.Messages)-1].Content
+		if strings.Contains(last, "could not be used") {
+			return &ChatCompletion{Content: validReply}, nil
+		}
+		return &ChatCompletion{Content: `{"Stage":"x","Response":[]}`}, nil
+	}}
+	s := newTestAIService(t, client, "second")
+
+	response, err := s.requestWithFallback(context.Background(), "Hi", "first", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Model != "first" || response.Response[0].Content != "Hello" {
+		t.Fatalf("got %+v from %s, want the repaired reply of first", response.Response, response.Model)
+	}
+	if len(models) != 2 || models[1] != "first" {
+		t.Fatalf("called %v, want the repair on first", models)
+	}
+}
+
+func TestRequestWithFallbackMovesOnFromUnusableReply(t *testing.T) {
+	client := &FakeLLMClient{Completion: func(request ChatRequest) (*ChatCompletion, error) {
+		if request.Model == "first" {
+			return &ChatCompletion{Content: `{"Stage": broken`}, nil
+		}
+		return &ChatCompletion{Content: validReply}, nil
+	}}
+	s := newTestAIService(t, client, "second")
+
+	response, err := s.requestWithFallback(context.Background(), "Hi", "first", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Model != "second" {
+		t.Fatalf("answered by %s, want second", response.Model)
+	}
+}
+
+func TestMaxResponseTime(t *testing.T) {
+	s := newTestAIService(t, NewFakeLLMClient(), "fallback")
+	s.maxRetries = 1
+
+	// The default model (15s) and the fallback (1s) each take 4 tool rounds
+	// of 2 attempts and 750ms of backoff, and a repair, plus moderation (10s)
+	want := (4*(30*time.Second+750*time.Millisecond) + 15*time.Second) +
+		(4*(2*time.Second+750*time.Millisecond) + time.Second) +
+		moderationTimeout
+	if got := s.MaxResponseTime(); got != want {
+		t.Fatalf("MaxResponseTime = %v, want %v", got, want)
+	}
+}
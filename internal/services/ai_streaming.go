@@ -0,0 +1,224 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"sparkle-concept-sync/internal/models"
+)
+
+const (
+	// Streamed replies are plain text so they can be split while arriving
+	streamingSystemPrompt = `You are an AI assistant for a WhatsApp chatbot.
+Reply in plain conversational text, without JSON or markdown code blocks.
+Separate distinct WhatsApp messages with a blank line and keep each one short.`
+
+	maxStreamMessageLength = 300
+)
+
+// errDeliveryFailed aborts a stream whose messages can no longer be delivered
+var errDeliveryFailed = errors.New("stream delivery failed")
+
+// StreamAIResponse streams a reply from the model's backend and calls onMessage for each
+// complete message as soon as it is available. The returned response contains
+// every delivered message for logging. If the stream breaks after messages were
+// delivered, the partial response is returned together with the error.
+func (s *AIService) StreamAIResponse(ctx context.Context, prompt, model, userID string, onMessage func(models.AIMessage) error) (*models.AIResponse, error) {
+	return s.streamAIResponse(ctx, prompt, model, userID, guardScope{input: prompt}, onMessage)
+}
+
+// streamAIResponse checks every message against the guardrails before it is
+// delivered. A blocked message ends the stream with ErrReplyBlocked.
+func (s *AIService) streamAIResponse(ctx context.Context, prompt, model, userID string, guard guardScope, onMessage func(models.AIMessage) error) (*models.AIResponse, error) {
+	if err := s.guardrails.ScreenInput(guard.input); err != nil {
+		return nil, err
+	}
+
+	// Check rate limit
+	if err := s.checkRateLimit(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, route := range s.modelRoutes(model) {
+		aiResponse := &models.AIResponse{Stage: "General Response", Model: route.Model}
+		splitter := &messageSplitter{maxLen: maxStreamMessageLength}
+
+		// Delivery failures and blocked messages are kept apart so they don't
+		// count against the model
+		var deliveryErr, blockedErr error
+		var guardUsage *models.AIUsage
+		deliver := func(segments []string) error {
+			for _, segment := range segments {
+				message := models.AIMessage{Type: "text", Content: segment}
+				usage, err := s.guardMessage(ctx, &message, guard.instructions)
+				guardUsage = guardUsage.Add(usage)
+				if err != nil {
+					blockedErr = err
+					return errDeliveryFailed
+				}
+				if err := onMessage(message); err != nil {
+					deliveryErr = err
+					return errDeliveryFailed
+				}
+				aiResponse.Response = append(aiResponse.Response, message)
+			}
+			return nil
+		}
+
+		err := s.breakers.Get("ai:" + route.Model).Call(func() error {
+			usage, err := s.streamRequest(ctx, prompt, route, func(delta string) error {
+				return deliver(splitter.Write(delta))
+			})
+			if err == nil {
+				err = deliver(splitter.Flush())
+			}
+			aiResponse.Usage = usage.Add(guardUsage)
+			if errors.Is(err, errDeliveryFailed) {
+				return nil
+			}
+			return err
+		})
+		if blockedErr != nil {
+			return aiResponse, blockedErr
+		}
+		if deliveryErr != nil {
+			return aiResponse, fmt.Errorf("failed to deliver streamed message: %v", deliveryErr)
+		}
+		if err == nil {
+			return aiResponse, nil
+		}
+
+		// Falling back now would repeat what the prospect already received
+		if len(aiResponse.Response) > 0 {
+			return aiResponse, err
+		}
+
+		lastErr = err
+		log.Printf("AI stream from %s failed: %v", route.Model, err)
+
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if isFatalAIError(err) {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("all AI models failed, last error: %v", lastErr)
+}
+
+// StreamFlowPrompt is the streaming counterpart of ProcessFlowPrompt
+func (s *AIService) StreamFlowPrompt(ctx context.Context, prompt, model, userID string, flowContext map[string]interface{}, onMessage func(models.AIMessage) error) (*models.AIResponse, error) {
+	enhancedPrompt := s.buildContextualPrompt(prompt, flowContext)
+
+	return s.streamAIResponse(ctx, enhancedPrompt, model, userID, flowGuardScope(prompt, flowContext), onMessage)
+}
+
+// streamRequest streams a chat completion from the model's backend and calls
+// onDelta for every content fragment. The route timeout bounds the wait for
+// each fragment rather than the whole reply.
+func (s *AIService) streamRequest(parent context.Context, prompt string, route ModelRoute, onDelta func(string) error) (*models.AIUsage, error) {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	idle := time.AfterFunc(route.Timeout, cancel)
+	defer idle.Stop()
+
+	client, backendModel := s.backendFor(route.Model)
+	request := ChatRequest{
+		Model: backendModel,
+		Messages: []Message{
+			{Role: "system", Content: streamingSystemPrompt},
+			{Role: "user", Content: prompt},
+		},
+	}
+
+	usage, err := client.Stream(ctx, request, func(delta string) error {
+		idle.Reset(route.Timeout)
+		return onDelta(delta)
+	})
+	if err != nil {
+		return usage, streamError(parent, ctx, route, err)
+	}
+	return usage, nil
+}
+
+// streamError reports an idle timeout as a deadline rather than a cancellation,
+// so circuit breakers count a stalled model as a failure
+func streamError(parent, ctx context.Context, route ModelRoute, err error) error {
+	if parent.Err() == nil && errors.Is(ctx.Err(), context.Canceled) {
+		return fmt.Errorf("no data from %s within %s: %w", route.Model, route.Timeout, context.DeadlineExceeded)
+	}
+	return err
+}
+
+// messageSplitter accumulates streamed text and cuts it into WhatsApp messages
+// at paragraph boundaries, or at sentence boundaries when a paragraph gets long
+type messageSplitter struct {
+	buf    strings.Builder
+	maxLen int
+}
+
+// Write adds a fragment and returns the messages completed by it
+func (m *messageSplitter) Write(fragment string) []string {
+	m.buf.WriteString(fragment)
+
+	var segments []string
+	for {
+		text := m.buf.String()
+
+		if i := strings.Index(text, "\n\n"); i >= 0 {
+			segments = appendSegment(segments, text[:i])
+			m.reset(text[i+2:])
+			continue
+		}
+
+		if len(text) >= m.maxLen {
+			if cut := lastSentenceEnd(text); cut > 0 {
+				segments = appendSegment(segments, text[:cut])
+				m.reset(text[cut:])
+				continue
+			}
+		}
+
+		return segments
+	}
+}
+
+// Flush returns whatever text is left once the stream ended
+func (m *messageSplitter) Flush() []string {
+	text := m.buf.String()
+	m.buf.Reset()
+	return appendSegment(nil, text)
+}
+
+func (m *messageSplitter) reset(rest string) {
+	m.buf.Reset()
+	m.buf.WriteString(rest)
+}
+
+// lastSentenceEnd returns the position just after the last sentence terminator
+// that is followed by whitespace, or 0 if there is none
+func lastSentenceEnd(text string) int {
+	for i := len(text) - 2; i > 0; i-- {
+		switch text[i] {
+		case '.', '!', '?':
+			if text[i+1] == ' ' || text[i+1] == '\n' {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+func appendSegment(segments []string, text string) []string {
+	if text = strings.TrimSpace(text); text != "" {
+		segments = append(segments, text)
+	}
+	return segments
+}
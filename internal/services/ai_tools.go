@@ -0,0 +1,376 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"sparkle-concept-sync/internal/models"
+)
+
+const (
+	// maxToolRounds bounds how many times the model may call tools before it
+	// has to answer
+	maxToolRounds = 3
+	toolTimeout   = 10 * time.Second
+)
+
+// ToolContext identifies the conversation a tool runs for, so tools only
+// touch the data of the tenant and prospect at hand
+type ToolContext struct {
+	UserID      string
+	DeviceID    string
+	ProspectNum string
+	ExecutionID string
+}
+
+type toolHandler func(ctx context.Context, toolCtx ToolContext, arguments json.RawMessage) (interface{}, error)
+
+type aiTool struct {
+	definition ToolDefinition
+	handler    toolHandler
+	// handsOff marks tools that pass the conversation to a human agent
+	handsOff bool
+}
+
+// ToolSet is the set of tools available to one AI request. It records every
+// call so the flow engine can log them and react to a handoff.
+type ToolSet struct {
+	tools   map[string]aiTool
+	toolCtx ToolContext
+
+	mu          sync.Mutex
+	invocations []models.ToolInvocation
+	handoff     bool
+}
+
+// Definitions returns the tool declarations sent to the model
+func (t *ToolSet) Definitions() []ToolDefinition {
+	if t == nil {
+		return nil
+	}
+
+	definitions := make([]ToolDefinition, 0, len(t.tools))
+	for _, tool := range t.tools {
+		definitions = append(definitions, tool.definition)
+	}
+	// A stable order keeps requests reproducible
+	sort.Slice(definitions, func(i, j int) bool {
+		return definitions[i].Function.Name < definitions[j].Function.Name
+	})
+	return definitions
+}
+
+// Execute runs a tool call and returns its JSON encoded result. Failures are
+// reported to the model as {"error": ...} so it can tell the prospect.
+func (t *ToolSet) Execute(ctx context.Context, call ToolCall) string {
+	invocation := models.ToolInvocation{Name: call.Function.Name, Arguments: call.Function.Arguments}
+
+	result, err := t.execute(ctx, call)
+	if err == nil {
+		var encoded []byte
+		if encoded, err = json.Marshal(result); err == nil {
+			invocation.Result = string(encoded)
+		}
+	}
+	if err != nil {
+		log.Printf("AI tool %s failed for %s: %v", call.Function.Name, t.toolCtx.ProspectNum, err)
+		invocation.Error = err.Error()
+	}
+
+	t.mu.Lock()
+	t.invocations = append(t.invocations, invocation)
+	t.mu.Unlock()
+
+	if invocation.Error != "" {
+		encoded, _ := json.Marshal(map[string]string{"error": invocation.Error})
+		return string(encoded)
+	}
+	return invocation.Result
+}
+
+func (t *ToolSet) execute(ctx context.Context, call ToolCall) (interface{}, error) {
+	tool, ok := t.tools[call.Function.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown tool %q", call.Function.Name)
+	}
+
+	arguments := json.RawMessage(call.Function.Arguments)
+	if strings.TrimSpace(call.Function.Arguments) == "" {
+		arguments = json.RawMessage("{}")
+	}
+
+	toolCtx, cancel := context.WithTimeout(ctx, toolTimeout)
+	defer cancel()
+
+	if tool.handsOff {
+		t.mu.Lock()
+		t.handoff = true
+		t.mu.Unlock()
+	}
+	return tool.handler(toolCtx, t.toolCtx, arguments)
+}
+
+// Invocations returns the tool calls made so far
+func (t *ToolSet) Invocations() []models.ToolInvocation {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]models.ToolInvocation(nil), t.invocations...)
+}
+
+// Executed reports whether any tool has run
+func (t *ToolSet) Executed() bool {
+	if t == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.invocations) > 0
+}
+
+// HandoffRequested reports whether the model asked for a human agent
+func (t *ToolSet) HandoffRequested() bool {
+	if t == nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.handoff
+}
+
+// converse runs a chat with the model, executing the tools it calls and
+// feeding the results back until it answers or runs out of tool rounds
+func (s *AIService) converse(ctx context.Context, prompt string, route ModelRoute, tools *ToolSet) (string, *models.AIUsage, error) {
+	messages := chatMessages(prompt)
+	definitions := tools.Definitions()
+	var usage *models.AIUsage
+
+	for round := 0; ; round++ {
+		// Out of rounds, the model has to answer with what it has
+		if round == maxToolRounds {
+			definitions = nil
+		}
+
+		completion, err := s.callModelWithRetry(ctx, route, messages, definitions)
+		if err != nil {
+			return "", usage, err
+		}
+		usage = usage.Add(completion.Usage)
+
+		if len(completion.ToolCalls) == 0 || definitions == nil {
+			return completion.Content, usage, nil
+		}
+
+		messages = append(messages, Message{Role: "assistant", Content: completion.Content, ToolCalls: completion.ToolCalls})
+		for _, call := range completion.ToolCalls {
+			messages = append(messages, Message{Role: "tool", ToolCallID: call.ID, Content: tools.Execute(ctx, call)})
+		}
+	}
+}
+
+// ToolService provides the tools AI nodes can declare, backed by our own data
+type ToolService struct {
+	db    *sql.DB
+	tools map[string]aiTool
+}
+
+func NewToolService(db *sql.DB) *ToolService {
+	s := &ToolService{db: db}
+	s.tools = map[string]aiTool{
+		"check_order_status": {
+			definition: functionTool("check_order_status",
+				"Look up the status of one of the customer's orders by its order number.",
+				`{"type":"object","properties":{"order_id":{"type":"string","description":"Order number"}},"required":["order_id"]}`),
+			handler: s.checkOrderStatus,
+		},
+		"create_order": {
+			definition: functionTool("create_order",
+				"Create a pending order once the customer has confirmed the product and price.",
+				`{"type":"object","properties":{"product":{"type":"string"},"amount":{"type":"number","description":"Total price"}},"required":["product","amount"]}`),
+			handler: s.createOrder,
+		},
+		"capture_lead": {
+			definition: functionTool("capture_lead",
+				"Save the customer's name and interest as a lead.",
+				`{"type":"object","properties":{"name":{"type":"string"},"niche":{"type":"string","description":"Product or service the customer is interested in"}},"required":["name"]}`),
+			handler: s.captureLead,
+		},
+		"handoff_to_human": {
+			definition: functionTool("handoff_to_human",
+				"Hand the conversation over to a human agent when the customer asks for one or the request can't be handled.",
+				`{"type":"object","properties":{"reason":{"type":"string"}}}`),
+			handler:  s.handoffToHuman,
+			handsOff: true,
+		},
+	}
+	return s
+}
+
+// ToolSet returns the named tools bound to a conversation, or nil when none
+// of the names is a known tool
+func (s *ToolService) ToolSet(names []string, toolCtx ToolContext) *ToolSet {
+	tools := make(map[string]aiTool)
+	for _, name := range names {
+		tool, ok := s.tools[name]
+		if !ok {
+			log.Printf("Ignoring unknown AI tool %q", name)
+			continue
+		}
+		tools[name] = tool
+	}
+	if len(tools) == 0 {
+		return nil
+	}
+
+	return &ToolSet{tools: tools, toolCtx: toolCtx}
+}
+
+func functionTool(name, description, parameters string) ToolDefinition {
+	return ToolDefinition{
+		Type: "function",
+		Function: FunctionDefinition{
+			Name:        name,
+			Description: description,
+			Parameters:  json.RawMessage(parameters),
+		},
+	}
+}
+
+func (s *ToolService) checkOrderStatus(ctx context.Context, toolCtx ToolContext, arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		OrderID json.RawMessage `json:"order_id"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %v", err)
+	}
+
+	// Models send the order number as a string or a number
+	orderID := strings.Trim(strings.TrimSpace(string(args.OrderID)), `"`)
+	if orderID == "" {
+		return nil, fmt.Errorf("order_id is required")
+	}
+	id, err := strconv.Atoi(orderID)
+	if err != nil {
+		return map[string]interface{}{"found": false}, nil
+	}
+
+	// Prospects only see the orders they placed themselves on this device
+	query := `SELECT id, product, amount, status, created_at FROM prospect_orders
+			  WHERE id = $1 AND user_id = $2 AND device_id = $3 AND prospect_num = $4`
+
+	var order models.Order
+	err = s.db.QueryRowContext(ctx, query, id, toolCtx.UserID, toolCtx.DeviceID, toolCtx.ProspectNum).Scan(
+		&order.ID, &order.Product, &order.Amount, &order.Status, &order.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return map[string]interface{}{"found": false}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up order")
+	}
+
+	return map[string]interface{}{
+		"found":      true,
+		"order_id":   order.ID,
+		"product":    order.Product,
+		"amount":     order.Amount,
+		"status":     stringValue(order.Status),
+		"created_at": order.CreatedAt.Format(time.RFC3339),
+	}, nil
+}
+
+func (s *ToolService) createOrder(ctx context.Context, toolCtx ToolContext, arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Product string  `json:"product"`
+		Amount  float64 `json:"amount"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %v", err)
+	}
+
+	args.Product = strings.TrimSpace(args.Product)
+	if args.Product == "" || args.Amount <= 0 {
+		return nil, fmt.Errorf("product and a positive amount are required")
+	}
+
+	var orderID int
+	query := `INSERT INTO prospect_orders (user_id, device_id, prospect_num, execution_id, product, amount, status, method)
+			  VALUES ($1, $2, $3, $4, $5, $6, 'Pending', 'whatsapp') RETURNING id`
+	err := s.db.QueryRowContext(ctx, query,
+		toolCtx.UserID, toolCtx.DeviceID, toolCtx.ProspectNum, nullString(toolCtx.ExecutionID), args.Product, args.Amount,
+	).Scan(&orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create order")
+	}
+
+	log.Printf("AI created order %d for prospect %s via device %s", orderID, toolCtx.ProspectNum, toolCtx.DeviceID)
+	return map[string]interface{}{
+		"order_id": orderID,
+		"status":   "Pending",
+	}, nil
+}
+
+func (s *ToolService) captureLead(ctx context.Context, toolCtx ToolContext, arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Name  string `json:"name"`
+		Niche string `json:"niche"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %v", err)
+	}
+
+	args.Name = strings.TrimSpace(args.Name)
+	if args.Name == "" {
+		return nil, fmt.Errorf("name is required")
+	}
+
+	_, err := s.db.ExecContext(ctx, `UPDATE ai_whatsapp SET prospect_name = $1, niche = COALESCE($2, niche), updated_at = NOW() WHERE execution_id = $3`,
+		args.Name, nullString(args.Niche), toolCtx.ExecutionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save lead")
+	}
+
+	result, err := s.db.ExecContext(ctx, `UPDATE wasapBot SET nama = $1, niche = COALESCE($2, niche) WHERE prospect_num = $3 AND user_id = $4`,
+		args.Name, nullString(args.Niche), toolCtx.ProspectNum, toolCtx.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save lead")
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		_, err = s.db.ExecContext(ctx, `INSERT INTO wasapBot (prospect_num, nama, niche, instance, user_id) VALUES ($1, $2, $3, $4, $5)`,
+			toolCtx.ProspectNum, args.Name, nullString(args.Niche), toolCtx.DeviceID, toolCtx.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save lead")
+		}
+	}
+
+	return map[string]interface{}{"saved": true}, nil
+}
+
+func (s *ToolService) handoffToHuman(ctx context.Context, toolCtx ToolContext, arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal(arguments, &args)
+
+	log.Printf("AI handed %s over to a human: %s", toolCtx.ProspectNum, args.Reason)
+	return map[string]interface{}{
+		"status": "handed_off",
+		"note":   "Tell the customer a team member will reply shortly.",
+	}, nil
+}
@@ -0,0 +1,243 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a circuit breaker
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// ErrCircuitOpen is returned when a call is rejected by an open breaker
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// httpStatusError is implemented by errors carrying the HTTP status an
+// upstream answered with
+type httpStatusError interface {
+	HTTPStatus() int
+}
+
+// CircuitBreaker protects a single upstream (an AI model, a provider instance).
+// It opens after threshold consecutive failures, rejects calls for timeout,
+// then lets a single probe call through in half-open state.
+type CircuitBreaker struct {
+	mu              sync.Mutex
+	state           BreakerState
+	failureCount    int
+	lastFailureTime time.Time
+	openedAt        time.Time
+	probeInFlight   bool
+	timeout         time.Duration
+	threshold       int
+}
+
+// BreakerSnapshot is a point-in-time view of a breaker for health reporting
+type BreakerSnapshot struct {
+	State           BreakerState `json:"state"`
+	FailureCount    int          `json:"failure_count"`
+	LastFailureTime *time.Time   `json:"last_failure_time,omitempty"`
+	OpenedAt        *time.Time   `json:"opened_at,omitempty"`
+}
+
+func NewCircuitBreaker(threshold int, timeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		state:     BreakerClosed,
+		threshold: threshold,
+		timeout:   timeout,
+	}
+}
+
+// Call runs operation if the breaker allows it and records the outcome. Only
+// upstream failures count, see isUpstreamFailure; cancellation by the caller
+// and requests the upstream rejected on their own merits don't.
+func (cb *CircuitBreaker) Call(operation func() error) error {
+	if err := cb.allow(); err != nil {
+		return err
+	}
+
+	err := operation()
+	switch {
+	case err == nil:
+		cb.recordSuccess()
+	case isUpstreamFailure(err):
+		cb.recordFailure()
+	default:
+		cb.releaseProbe()
+	}
+	return err
+}
+
+// isUpstreamFailure reports errors that say the upstream is unhealthy:
+// transport errors, timeouts, 429 and 5xx. Other 4xx answers are about the
+// request itself, such as an oversized prompt or one tenant's bad API key,
+// and must not open a breaker shared by every tenant.
+func isUpstreamFailure(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var statusErr httpStatusError
+	if errors.As(err, &statusErr) {
+		status := statusErr.HTTPStatus()
+		return status == http.StatusTooManyRequests || status >= 500
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	// Connection refused or reset, DNS failures, client timeouts
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// State returns the current breaker state
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.refreshState()
+	return cb.state
+}
+
+// Snapshot returns the current breaker state and counters
+func (cb *CircuitBreaker) Snapshot() BreakerSnapshot {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.refreshState()
+	snapshot := BreakerSnapshot{
+		State:        cb.state,
+		FailureCount: cb.failureCount,
+	}
+	if !cb.lastFailureTime.IsZero() {
+		lastFailure := cb.lastFailureTime
+		snapshot.LastFailureTime = &lastFailure
+	}
+	if cb.state != BreakerClosed {
+		openedAt := cb.openedAt
+		snapshot.OpenedAt = &openedAt
+	}
+	return snapshot
+}
+
+func (cb *CircuitBreaker) allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.refreshState()
+	switch cb.state {
+	case BreakerOpen:
+		return ErrCircuitOpen
+	case BreakerHalfOpen:
+		// Only one probe at a time while half-open
+		if cb.probeInFlight {
+			return ErrCircuitOpen
+		}
+		cb.probeInFlight = true
+	}
+	return nil
+}
+
+// refreshState moves an open breaker to half-open once its timeout elapsed.
+// Callers must hold cb.mu.
+func (cb *CircuitBreaker) refreshState() {
+	if cb.state == BreakerOpen && time.Since(cb.openedAt) >= cb.timeout {
+		cb.state = BreakerHalfOpen
+		cb.probeInFlight = false
+	}
+}
+
+func (cb *CircuitBreaker) recordSuccess() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.state = BreakerClosed
+	cb.failureCount = 0
+	cb.probeInFlight = false
+}
+
+func (cb *CircuitBreaker) recordFailure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.failureCount++
+	cb.lastFailureTime = time.Now()
+	cb.probeInFlight = false
+
+	// A failed probe re-opens immediately
+	if cb.state == BreakerHalfOpen || cb.failureCount >= cb.threshold {
+		cb.state = BreakerOpen
+		cb.openedAt = cb.lastFailureTime
+	}
+}
+
+func (cb *CircuitBreaker) releaseProbe() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probeInFlight = false
+}
+
+// CircuitBreakerRegistry hands out one breaker per upstream name,
+// e.g. "ai:openai/gpt-4.1" or "provider:device-123"
+type CircuitBreakerRegistry struct {
+	mu        sync.RWMutex
+	breakers  map[string]*CircuitBreaker
+	threshold int
+	timeout   time.Duration
+}
+
+func NewCircuitBreakerRegistry(threshold int, timeout time.Duration) *CircuitBreakerRegistry {
+	return &CircuitBreakerRegistry{
+		breakers:  make(map[string]*CircuitBreaker),
+		threshold: threshold,
+		timeout:   timeout,
+	}
+}
+
+// Get returns the breaker for name, creating it on first use
+func (r *CircuitBreakerRegistry) Get(name string) *CircuitBreaker {
+	r.mu.RLock()
+	breaker, ok := r.breakers[name]
+	r.mu.RUnlock()
+	if ok {
+		return breaker
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if breaker, ok := r.breakers[name]; ok {
+		return breaker
+	}
+	breaker = NewCircuitBreaker(r.threshold, r.timeout)
+	r.breakers[name] = breaker
+	return breaker
+}
+
+// Snapshot returns the state of every known breaker keyed by name
+func (r *CircuitBreakerRegistry) Snapshot() map[string]BreakerSnapshot {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.breakers))
+	for name := range r.breakers {
+		names = append(names, name)
+	}
+	r.mu.RUnlock()
+
+	snapshot := make(map[string]BreakerSnapshot, len(names))
+	for _, name := range names {
+		snapshot[name] = r.Get(name).Snapshot()
+	}
+	return snapshot
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var errUpstream = &llmStatusError{StatusCode: http.StatusBadGateway}
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	cb := NewCircuitBreaker(3, time.Minute)
+	failing := func() error { return errUpstream }
+
+	for i := 0; i < 3; i++ {
+		if cb.State() != BreakerClosed {
+			t.Fatalf("breaker opened after %d failures", i)
+		}
+		cb.Call(failing)
+	}
+	if cb.State() != BreakerOpen {
+		t.Fatalf("state = %s after threshold failures, want open", cb.State())
+	}
+
+	called := false
+	err := cb.Call(func() error { called = true; return nil })
+	if !errors.Is(err, ErrCircuitOpen) || called {
+		t.Fatalf("open breaker let a call through: err=%v called=%v", err, called)
+	}
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+	cb := NewCircuitBreaker(2, time.Minute)
+
+	cb.Call(func() error { return errUpstream })
+	cb.Call(func() error { return nil })
+	cb.Call(func() error { return errUpstream })
+
+	if cb.State() != BreakerClosed {
+		t.Fatal("non-consecutive failures opened the breaker")
+	}
+}
+
+func TestCircuitBreakerHalfOpenProbe(t *testing.T) {
+	cb := NewCircuitBreaker(1, 20*time.Millisecond)
+	cb.Call(func() error { return errUpstream })
+
+	time.Sleep(30 * time.Millisecond)
+	if cb.State() != BreakerHalfOpen {
+		t.Fatalf("state = %s after timeout, want half-open", cb.State())
+	}
+
+	// A second call is rejected while the probe is in flight
+	err := cb.Call(func() error {
+		if err := cb.Call(func() error { return nil }); !errors.Is(err, ErrCircuitOpen) {
+			t.Errorf("concurrent call during probe: err = %v, want ErrCircuitOpen", err)
+		}
+		return errUpstream
+	})
+	if err != errUpstream {
+		t.Fatalf("probe error = %v", err)
+	}
+	if cb.State() != BreakerOpen {
+		t.Fatalf("state = %s after failed probe, want open", cb.State())
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := cb.Call(func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if cb.State() != BreakerClosed {
+		t.Fatalf("state = %s after successful probe, want closed", cb.State())
+	}
+}
+
+func TestCircuitBreakerIgnoresRequestErrors(t *testing.T) {
+	cb := NewCircuitBreaker(1, time.Minute)
+
+	cb.Call(func() error { return &llmStatusError{StatusCode: http.StatusBadRequest} })
+	cb.Call(func() error { return context.Canceled })
+	cb.Call(func() error { return errors.New("unusable reply") })
+
+	if cb.State() != BreakerClosed {
+		t.Fatal("errors that aren't upstream failures opened the breaker")
+	}
+}
+
+func TestCircuitBreakerReleasesProbeOnRequestError(t *testing.T) {
+	cb := NewCircuitBreaker(1, 10*time.Millisecond)
+	cb.Call(func() error { return errUpstream })
+	time.Sleep(20 * time.Millisecond)
+
+	cb.Call(func() error { return context.Canceled })
+	if err := cb.Call(func() error { return nil }); err != nil {
+		t.Fatalf("probe slot wasn't released after a cancelled probe: %v", err)
+	}
+}
+
+func TestIsUpstreamFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"too many requests", &llmStatusError{StatusCode: http.StatusTooManyRequests}, true},
+		{"server error", &llmStatusError{StatusCode: http.StatusServiceUnavailable}, true},
+		{"wrapped server error", fmt.Errorf("call: %w", errUpstream), true},
+		{"bad request", &llmStatusError{StatusCode: http.StatusBadRequest}, false},
+		{"unauthorized", &llmStatusError{StatusCode: http.StatusUnauthorized}, false},
+		{"provider server error", &providerStatusError{StatusCode: http.StatusInternalServerError}, true},
+		{"deadline", context.DeadlineExceeded, true},
+		{"cancelled", context.Canceled, false},
+		{"network", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"other", errors.New("invalid JSON"), false},
+	}
+
+	for _, tt := range tests {
+		if got := isUpstreamFailure(tt.err); got != tt.want {
+			t.Errorf("%s: isUpstreamFailure = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCircuitBreakerRegistry(t *testing.T) {
+	registry := NewCircuitBreakerRegistry(1, time.Minute)
+
+	if registry.Get("ai:a") != registry.Get("ai:a") {
+		t.Fatal("Get returned different breakers for the same name")
+	}
+	registry.Get("ai:a").Call(func() error { return errUpstream })
+
+	snapshot := registry.Snapshot()
+	if snapshot["ai:a"].State != BreakerOpen || snapshot["ai:a"].OpenedAt == nil {
+		t.Fatalf("snapshot of ai:a = %+v, want open", snapshot["ai:a"])
+	}
+	if registry.Get("ai:b").State() != BreakerClosed {
+		t.Fatal("breakers share state")
+	}
+}
@@ -15,7 +15,7 @@ func NewDeviceSettingsService(db *sql.DB) *DeviceSettingsService {
 
 // GetDevicesByUser returns all devices for a user
 func (s *DeviceSettingsService) GetDevicesByUser(userID string) ([]models.DeviceSetting, error) {
-	query := `SELECT id, device_id, api_key_option, webhook_id, provider, phone_number, api_key, id_device, user_id, instance, created_at, updated_at FROM device_setting WHERE user_id = $1`
+	query := `SELECT id, device_id, api_key_option, webhook_id, provider, phone_number, api_key, id_device, user_id, instance, guardrail_action, guardrail_message, created_at, updated_at FROM device_setting WHERE user_id = $1`
 
 	rows, err := s.db.Query(query, userID)
 	if err != nil {
@@ -29,7 +29,8 @@ func (s *DeviceSettingsService) GetDevicesByUser(userID string) ([]models.Device
 		err := rows.Scan(
 			&device.ID, &device.DeviceID, &device.APIKeyOption, &device.WebhookID,
 			&device.Provider, &device.PhoneNumber, &device.APIKey, &device.IDDevice,
-			&device.UserID, &device.Instance, &device.CreatedAt, &device.UpdatedAt,
+			&device.UserID, &device.Instance, &device.GuardrailAction, &device.GuardrailMessage,
+			&device.CreatedAt, &device.UpdatedAt,
 		)
 		if err != nil {
 			return nil, err
@@ -42,13 +43,32 @@ func (s *DeviceSettingsService) GetDevicesByUser(userID string) ([]models.Device
 
 // GetDeviceByID returns a device by ID
 func (s *DeviceSettingsService) GetDeviceByID(id string) (*models.DeviceSetting, error) {
-	query := `SELECT id, device_id, api_key_option, webhook_id, provider, phone_number, api_key, id_device, user_id, instance, created_at, updated_at FROM device_setting WHERE id = $1`
+	query := `SELECT id, device_id, api_key_option, webhook_id, provider, phone_number, api_key, id_device, user_id, instance, guardrail_action, guardrail_message, created_at, updated_at FROM device_setting WHERE id = $1`
 
 	var device models.DeviceSetting
 	err := s.db.QueryRow(query, id).Scan(
 		&device.ID, &device.DeviceID, &device.APIKeyOption, &device.WebhookID,
 		&device.Provider, &device.PhoneNumber, &device.APIKey, &device.IDDevice,
-		&device.UserID, &device.Instance, &device.CreatedAt, &device.UpdatedAt,
+		&device.UserID, &device.Instance, &device.GuardrailAction, &device.GuardrailMessage,
+		&device.CreatedAt, &device.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &device, nil
+}
+
+// GetDeviceByIDDevice returns a device by the id_device used in webhook URLs and flows
+func (s *DeviceSettingsService) GetDeviceByIDDevice(idDevice string) (*models.DeviceSetting, error) {
+	query := `SELECT id, device_id, api_key_option, webhook_id, provider, phone_number, api_key, id_device, user_id, instance, guardrail_action, guardrail_message, created_at, updated_at FROM device_setting WHERE id_device = $1 LIMIT 1`
+
+	var device models.DeviceSetting
+	err := s.db.QueryRow(query, idDevice).Scan(
+		&device.ID, &device.DeviceID, &device.APIKeyOption, &device.WebhookID,
+		&device.Provider, &device.PhoneNumber, &device.APIKey, &device.IDDevice,
+		&device.UserID, &device.Instance, &device.GuardrailAction, &device.GuardrailMessage,
+		&device.CreatedAt, &device.UpdatedAt,
 	)
 	if err != nil {
 		return nil, err
@@ -59,17 +79,17 @@ func (s *DeviceSettingsService) GetDeviceByID(id string) (*models.DeviceSetting,
 
 // CreateDevice creates a new device
 func (s *DeviceSettingsService) CreateDevice(device *models.DeviceSetting) error {
-	query := `INSERT INTO device_setting (id, device_id, api_key_option, webhook_id, provider, phone_number, api_key, id_device, user_id, instance) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+	query := `INSERT INTO device_setting (id, device_id, api_key_option, webhook_id, provider, phone_number, api_key, id_device, user_id, instance, guardrail_action, guardrail_message) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
 
-	_, err := s.db.Exec(query, device.ID, device.DeviceID, device.APIKeyOption, device.WebhookID, device.Provider, device.PhoneNumber, device.APIKey, device.IDDevice, device.UserID, device.Instance)
+	_, err := s.db.Exec(query, device.ID, device.DeviceID, device.APIKeyOption, device.WebhookID, device.Provider, device.PhoneNumber, device.APIKey, device.IDDevice, device.UserID, device.Instance, device.GuardrailAction, device.GuardrailMessage)
 	return err
 }
 
 // UpdateDevice updates an existing device
 func (s *DeviceSettingsService) UpdateDevice(device *models.DeviceSetting) error {
-	query := `UPDATE device_setting SET device_id = $2, api_key_option = $3, webhook_id = $4, provider = $5, phone_number = $6, api_key = $7, id_device = $8, instance = $9, updated_at = NOW() WHERE id = $1`
+	query := `UPDATE device_setting SET device_id = $2, api_key_option = $3, webhook_id = $4, provider = $5, phone_number = $6, api_key = $7, id_device = $8, instance = $9, guardrail_action = $10, guardrail_message = $11, updated_at = NOW() WHERE id = $1`
 
-	_, err := s.db.Exec(query, device.ID, device.DeviceID, device.APIKeyOption, device.WebhookID, device.Provider, device.PhoneNumber, device.APIKey, device.IDDevice, device.Instance)
+	_, err := s.db.Exec(query, device.ID, device.DeviceID, device.APIKeyOption, device.WebhookID, device.Provider, device.PhoneNumber, device.APIKey, device.IDDevice, device.Instance, device.GuardrailAction, device.GuardrailMessage)
 	return err
 }
 
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"context"
+	"errors"
+
+	"sparkle-concept-sync/internal/models"
+)
+
+// emit broadcasts a dashboard event. Events of conversations without an
+// owning user are dropped.
+func (s *FlowService) emit(event models.WebSocketMessage) {
+	if s.websocketService == nil || event.UserID == "" {
+		return
+	}
+	s.websocketService.Broadcast(event)
+}
+
+// executionEvent addresses an event to the owner and topics of an execution
+func executionEvent(execution *models.ExecutionProcess, eventType string, payload interface{}) models.WebSocketMessage {
+	return models.WebSocketMessage{
+		Type:        eventType,
+		UserID:      execution.UserID,
+		DeviceID:    execution.DeviceID,
+		ProspectNum: execution.ProspectNum,
+		FlowID:      execution.FlowID,
+		Data:        payload,
+	}
+}
+
+func (s *FlowService) emitStarted(execution *models.ExecutionProcess, restarted bool) {
+	s.emit(executionEvent(execution, models.EventExecutionStarted, models.ExecutionStartedEvent{
+		ExecutionID: execution.ExecutionID,
+		FlowID:      execution.FlowID,
+		DeviceID:    execution.DeviceID,
+		ProspectNum: execution.ProspectNum,
+		Restarted:   restarted,
+	}))
+}
+
+func (s *FlowService) emitCompleted(execution *models.ExecutionProcess, err error) {
+	event := models.ExecutionCompletedEvent{
+		ExecutionID: execution.ExecutionID,
+		FlowID:      execution.FlowID,
+		Status:      execution.Status,
+		Stage:       execution.Stage,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	s.emit(executionEvent(execution, models.EventExecutionCompleted, event))
+}
+
+// failExecution marks the execution failed, saves it and reports err
+func (s *FlowService) failExecution(run *flowRun, err error) error {
+	run.execution.Status = "failed"
+	s.saveExecution(run.execution)
+	s.emitCompleted(run.execution, err)
+	return err
+}
+
+// delivered records messages the provider sent to the prospect
+func (s *FlowService) delivered(run *flowRun, messages []models.AIMessage) {
+	execution := run.execution
+	run.sent.Response = append(run.sent.Response, messages...)
+
+	for _, message := range messages {
+		s.emit(executionEvent(execution, models.EventMessageSent, models.MessageSentEvent{
+			DeviceID:    execution.DeviceID,
+			ProspectNum: execution.ProspectNum,
+			ExecutionID: execution.ExecutionID,
+			MessageType: message.Type,
+			Content:     message.Content,
+			Stage:       execution.Stage,
+		}))
+	}
+}
+
+// deliveryFailed reports a message the provider couldn't send. A reply cut
+// short by the prospect's next message didn't fail.
+func (s *FlowService) deliveryFailed(run *flowRun, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	execution := run.execution
+	s.emit(executionEvent(execution, models.EventMessageFailed, models.MessageFailedEvent{
+		DeviceID:    execution.DeviceID,
+		ProspectNum: execution.ProspectNum,
+		ExecutionID: execution.ExecutionID,
+		Error:       err.Error(),
+	}))
+}
+
+// handOff stops the bot so a human agent takes over the conversation
+func (s *FlowService) handOff(run *flowRun, reason string) {
+	execution := run.execution
+	if execution.Human {
+		return
+	}
+
+	execution.Human = true
+	s.emit(executionEvent(execution, models.EventHumanTakeover, models.HumanTakeoverEvent{
+		ExecutionID: execution.ExecutionID,
+		DeviceID:    execution.DeviceID,
+		ProspectNum: execution.ProspectNum,
+		Reason:      reason,
+	}))
+}
@@ -1,41 +1,1087 @@
 package services
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
 	"sparkle-concept-sync/internal/models"
+
+	"github.com/google/uuid"
 )
 
 type FlowService struct {
-	db        *sql.DB
-	aiService *AIService
+	db               *sql.DB
+	redisService     *RedisService
+	aiService        *AIService
+	providerService  *ProviderService
+	deviceService    *DeviceSettingsService
+	scheduler        *SchedulerService
+	usageService     *UsageService
+	quotaService     *QuotaService
+	knowledge        *KnowledgeService
+	tools            *ToolService
+	websocketService *WebSocketService
+}
+
+// flowRun holds the state of one pass through a flow
+type flowRun struct {
+	flow      *models.ChatbotFlow
+	device    *models.DeviceSetting
+	execution *models.ExecutionProcess
+	sent      models.AIResponse
+	// hints are the routing hints of the last AI response, consumed by the next condition node
+	hints []string
 }
 
-func NewFlowService(db *sql.DB, aiService *AIService) *FlowService {
-	return &FlowService{
-		db:        db,
-		aiService: aiService,
+const (
+	// maxFlowSteps guards against loops in user-built flows
+	maxFlowSteps = 50
+	// maxConversationHistory is the number of characters of history kept for AI context
+	maxConversationHistory = 2000
+	maxNodeDelay           = time.Hour
+	// executionCacheTTL keeps executions of active conversations out of the database
+	executionCacheTTL = time.Hour
+	flowLockTTL       = 30 * time.Second
+	// flowLockMargin is added to the AI's worst case when waiting for the
+	// conversation's current run, for sending replies and saving state
+	flowLockMargin = time.Minute
+)
+
+var conditionPattern = regexp.MustCompile(`(?i)^\s*(\w+)\s+(contains|equals|==|!=|starts_with)\s+"(.*)"\s*$`)
+
+func NewFlowService(db *sql.DB, redisService *RedisService, aiService *AIService, providerService *ProviderService, deviceService *DeviceSettingsService, scheduler *SchedulerService, usageService *UsageService, quotaService *QuotaService, knowledge *KnowledgeService, tools *ToolService, websocketService *WebSocketService) *FlowService {
+	// Executions saved during an outage only reached the database, so what
+	// Redis still caches from before may be behind
+	redisService.OnRecover(func(ctx context.Context) {
+		if _, err := redisService.DeletePattern(ctx, "flow_execution*"); err != nil {
+			log.Printf("Failed to drop cached executions after Redis outage: %v", err)
+		}
+	})
+
+	s := &FlowService{
+		db:               db,
+		redisService:     redisService,
+		aiService:        aiService,
+		providerService:  providerService,
+		deviceService:    deviceService,
+		scheduler:        scheduler,
+		usageService:     usageService,
+		quotaService:     quotaService,
+		knowledge:        knowledge,
+		tools:            tools,
+		websocketService: websocketService,
 	}
+
+	// Delay nodes resume on whichever instance picks up the job
+	scheduler.Handle("flow", func(id string) {
+		deviceID, prospectNum := splitConversationKey(id)
+		s.resume(deviceID, prospectNum)
+	})
+	return s
 }
 
-// ExecuteFlow processes a WhatsApp message through the chatbot flow
+// ExecuteFlow processes a WhatsApp message through the chatbot flow of its
+// device and returns every message that was sent in reply
 func (s *FlowService) ExecuteFlow(message models.WhatsAppMessage) (*models.AIResponse, error) {
-	// This is a simplified implementation
-	// In a real system, this would:
-	// 1. Load the appropriate flow based on device and context
-	// 2. Execute the flow step by step
-	// 3. Handle conditions, delays, user inputs, etc.
-	// 4. Return appropriate responses
-
-	// For now, return a simple AI response
-	response := &models.AIResponse{
-		Stage: "Processing",
-		Response: []models.AIMessage{
-			{
-				Type:    "text",
-				Content: "Thank you for your message. I'm processing your request...",
-			},
+	ctx := context.Background()
+
+	device, err := s.deviceService.GetDeviceByIDDevice(message.DeviceID)
+	if err != nil {
+		return nil, fmt.Errorf("device %s not found: %v", message.DeviceID, err)
+	}
+
+	s.logConversation(device, message.From, "user", message.Body, message.Type, "", nil)
+	s.emit(models.WebSocketMessage{
+		Type:        models.EventMessageReceived,
+		UserID:      stringValue(device.UserID),
+		DeviceID:    message.DeviceID,
+		ProspectNum: message.From,
+		Data: models.MessageReceivedEvent{
+			DeviceID:    message.DeviceID,
+			ProspectNum: message.From,
+			MessageID:   message.MessageID,
+			MessageType: message.Type,
+			Message:     message.Body,
+		},
+	})
+
+	// A new message from the prospect replaces any pending delayed replies,
+	// which also lets a run waiting on one release the conversation
+	key := conversationKey(message.DeviceID, message.From)
+	s.scheduler.Cancel("flow:" + key)
+	s.scheduler.Cancel("reply:" + key)
+
+	lock, err := s.lockConversation(ctx, message.DeviceID, message.From)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release(ctx)
+
+	execution, err := s.loadExecution(message.DeviceID, message.From)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to load execution: %v", err)
+	}
+
+	// A human agent is handling this conversation
+	if execution != nil && execution.Human {
+		return nil, nil
+	}
+
+	var flow *models.ChatbotFlow
+	if execution != nil && execution.Status == "active" {
+		flow, err = s.loadFlowByID(execution.FlowID)
+	} else {
+		flow, err = s.loadFlowByDevice(message.DeviceID)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			log.Printf("No chatbot flow configured for device %s", message.DeviceID)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to load flow: %v", err)
+	}
+
+	if execution == nil {
+		execution, err = s.createExecution(flow, device, message)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create execution: %v", err)
+		}
+		s.emitStarted(execution, false)
+	} else if execution.Status != "active" {
+		// Finished conversations start over from the beginning
+		s.restartExecution(execution, flow)
+		s.emitStarted(execution, true)
+	}
+
+	execution.Variables["user_input"] = message.Body
+	appendHistory(execution, "Customer", message.Body)
+
+	if execution.WaitingForReply {
+		execution.WaitingForReply = false
+		execution.CurrentNodeID = nextNodeID(flow, execution.CurrentNodeID)
+	}
+
+	run := &flowRun{flow: flow, device: device, execution: execution}
+	if err := s.run(ctx, run); err != nil {
+		return &run.sent, err
+	}
+	return &run.sent, nil
+}
+
+// resume continues an execution after a delay node
+func (s *FlowService) resume(deviceID, prospectNum string) {
+	ctx := context.Background()
+
+	device, err := s.deviceService.GetDeviceByIDDevice(deviceID)
+	if err != nil {
+		log.Printf("Failed to resume flow for %s: device %s not found: %v", prospectNum, deviceID, err)
+		return
+	}
+
+	lock, err := s.lockConversation(ctx, deviceID, prospectNum)
+	if err != nil {
+		log.Printf("Failed to resume flow for %s: %v", prospectNum, err)
+		return
+	}
+	defer lock.Release(ctx)
+
+	execution, err := s.loadExecution(deviceID, prospectNum)
+	if err != nil || execution.Human || execution.Status != "active" {
+		return
+	}
+
+	flow, err := s.loadFlowByID(execution.FlowID)
+	if err != nil {
+		log.Printf("Failed to resume flow %s: %v", execution.FlowID, err)
+		return
+	}
+
+	run := &flowRun{flow: flow, device: device, execution: execution}
+	if err := s.run(ctx, run); err != nil {
+		log.Printf("Flow execution error after delay: %v", err)
+	}
+}
+
+// lockConversation keeps other messages and resumed delays of a conversation
+// from running the flow at the same time, on this or another instance. When
+// the lock can't be taken runs go ahead unlocked and a nil lock is returned.
+func (s *FlowService) lockConversation(ctx context.Context, deviceID, prospectNum string) (*DistributedLock, error) {
+	// The current run may be waiting for the AI, which can take longer than
+	// any fixed timeout when the whole fallback chain is slow
+	timeout := s.aiService.MaxResponseTime() + flowLockMargin
+	lock, err := s.redisService.AcquireLock(ctx, "flow:"+conversationKey(deviceID, prospectNum), flowLockTTL, timeout)
+	if errors.Is(err, ErrLockNotAcquired) {
+		return nil, fmt.Errorf("conversation %s is busy", prospectNum)
+	}
+	if err != nil {
+		log.Printf("Running flow for %s without a lock: %v", prospectNum, err)
+		return nil, nil
+	}
+
+	// AI replies and provider delays can outlast the lease
+	lock.KeepAlive()
+	return lock, nil
+}
+
+// run walks the flow from the current node until it waits for input, hands
+// over to a human, schedules a delay or reaches the end
+func (s *FlowService) run(ctx context.Context, run *flowRun) error {
+	execution := run.execution
+	run.sent.Stage = execution.Stage
+
+	for step := 0; ; step++ {
+		if step >= maxFlowSteps {
+			return s.failExecution(run, fmt.Errorf("flow %s exceeded %d steps", run.flow.ID, maxFlowSteps))
+		}
+
+		node := findNode(run.flow, execution.CurrentNodeID)
+		if node == nil {
+			execution.Status = "completed"
+			break
+		}
+		execution.LastNodeID = node.ID
+		s.emit(executionEvent(execution, models.EventNodeEntered, models.NodeEnteredEvent{
+			ExecutionID: execution.ExecutionID,
+			FlowID:      execution.FlowID,
+			NodeID:      node.ID,
+			NodeType:    node.Type,
+			Stage:       execution.Stage,
+		}))
+
+		next, stop, err := s.executeNode(ctx, run, node)
+		if errors.Is(err, context.Canceled) {
+			// The prospect wrote again while this node was replying. The
+			// execution stays active at this node for the run handling the
+			// new message.
+			break
+		}
+		if err != nil {
+			return s.failExecution(run, fmt.Errorf("node %s (%s) failed: %v", node.ID, node.Type, err))
+		}
+		if stop {
+			break
+		}
+		if next == "" {
+			execution.Status = "completed"
+			break
+		}
+		execution.CurrentNodeID = next
+	}
+
+	run.sent.Stage = execution.Stage
+	err := s.saveExecution(execution)
+	if execution.Status == "completed" {
+		s.emitCompleted(execution, nil)
+	}
+	return err
+}
+
+// executeNode performs a single node and returns the next node ID, or stop
+// when execution must pause at this node
+func (s *FlowService) executeNode(ctx context.Context, run *flowRun, node *models.FlowNode) (string, bool, error) {
+	execution := run.execution
+	next := nextNodeID(run.flow, node.ID)
+
+	switch node.Type {
+	case "start":
+		return next, false, nil
+
+	case "message":
+		text := dataString(node.Data, "message")
+		if text == "" {
+			return next, false, nil
+		}
+		err := s.send(ctx, run, &models.AIResponse{Response: []models.AIMessage{{Type: "text", Content: text}}})
+		return next, false, err
+
+	case "image", "audio", "video":
+		mediaURL := dataString(node.Data, node.Type+"Url")
+		if mediaURL == "" {
+			mediaURL = dataString(node.Data, "mediaUrl")
+		}
+		if mediaURL == "" {
+			return next, false, nil
+		}
+		caption := dataString(node.Data, "caption")
+		if err := s.providerService.SendMedia(ctx, execution.DeviceID, execution.ProspectNum, node.Type, mediaURL, caption); err != nil {
+			s.deliveryFailed(run, err)
+			return "", false, err
+		}
+		s.delivered(run, []models.AIMessage{{Type: node.Type, Content: mediaURL}})
+		s.logConversation(run.device, execution.ProspectNum, "bot", mediaURL, node.Type, execution.Stage, nil)
+		return next, false, nil
+
+	case "delay":
+		delay := time.Duration(dataFloat(node.Data, "delay") * float64(time.Second))
+		if delay <= 0 {
+			return next, false, nil
+		}
+		if delay > maxNodeDelay {
+			delay = maxNodeDelay
+		}
+
+		// Persist the position first so the continuation picks up after this node
+		execution.CurrentNodeID = next
+		if next == "" {
+			return "", false, nil
+		}
+		if err := s.scheduler.Schedule("flow:"+conversationKey(execution.DeviceID, execution.ProspectNum), delay); err != nil {
+			return "", false, fmt.Errorf("failed to schedule delay: %v", err)
+		}
+		return "", true, nil
+
+	case "stage":
+		if stage := dataString(node.Data, "stage"); stage != "" {
+			execution.Stage = stage
+		}
+		return next, false, nil
+
+	case "user_reply":
+		execution.WaitingForReply = true
+		return "", true, nil
+
+	case "ai_prompt", "advanced_ai_prompt":
+		// Stay on the node so the next message retries once the quota allows
+		if blocked, err := s.enforceQuota(ctx, run); blocked {
+			return "", true, err
+		}
+		err := s.runAIPrompt(ctx, run, node)
+		// A handoff_to_human tool call stops the bot
+		if execution.Human {
+			return "", true, err
+		}
+		return next, false, err
+
+	case "condition":
+		return s.selectBranch(run, node), false, nil
+
+	case "manual":
+		s.handOff(run, models.HandoffManualNode)
+		return "", true, nil
+
+	default:
+		log.Printf("Skipping unknown node type %q in flow %s", node.Type, run.flow.ID)
+		return next, false, nil
+	}
+}
+
+// runAIPrompt asks the AI for a reply using the node prompt as instructions
+// and executes the returned messages
+func (s *FlowService) runAIPrompt(ctx context.Context, run *flowRun, node *models.FlowNode) error {
+	execution := run.execution
+
+	model := dataString(node.Data, "model")
+	if model == "" {
+		model = run.device.APIKeyOption
+	}
+
+	userInput := variableString(execution, "user_input")
+
+	// The current message is the prompt itself, keep it out of the history so
+	// the cache key only depends on what came before
+	history := variableString(execution, "previous_messages")
+	history = strings.TrimSuffix(strings.TrimSuffix(history, "Customer: "+userInput), "\n")
+
+	flowContext := map[string]interface{}{
+		"instructions":      dataString(node.Data, "prompt"),
+		"stage":             execution.Stage,
+		"user_name":         variableString(execution, "prospect_name"),
+		"previous_messages": history,
+		"flow_data": map[string]interface{}{
+			"niche": stringValue(run.flow.Niche),
+		},
+	}
+
+	citations := s.retrieveKnowledge(ctx, run, node, userInput, flowContext)
+
+	tools := s.tools.ToolSet(dataStrings(node.Data, "tools"), ToolContext{
+		UserID:      execution.UserID,
+		DeviceID:    execution.DeviceID,
+		ProspectNum: execution.ProspectNum,
+		ExecutionID: execution.ExecutionID,
+	})
+
+	var response *models.AIResponse
+	var sent []models.AIMessage
+	var err error
+	if tools != nil {
+		// Tool calls need the whole reply before anything is sent, so they
+		// don't stream
+		response, err = s.aiService.ProcessFlowPromptWithTools(ctx, userInput, model, execution.UserID, flowContext, tools)
+		if err == nil {
+			var result *ResponseResult
+			result, err = s.providerService.ExecuteResponse(ctx, execution.DeviceID, execution.ProspectNum, response)
+			if result != nil {
+				sent = result.Sent
+				s.delivered(run, result.Sent)
+				run.hints = result.RoutingHints
+			}
+			if err != nil {
+				s.deliveryFailed(run, err)
+			}
+		}
+		if tools.HandoffRequested() {
+			s.handOff(run, models.HandoffTool)
+		}
+		applyCapturedLead(execution, tools.Invocations())
+	} else if dataBool(node.Data, "stream") {
+		response, err = s.providerService.DeliverStream(ctx, execution.DeviceID, execution.ProspectNum, func(onMessage func(models.AIMessage) error) (*models.AIResponse, error) {
+			return s.aiService.StreamFlowPrompt(ctx, userInput, model, execution.UserID, flowContext, onMessage)
+		})
+		if response != nil {
+			sent = response.Response
+			s.delivered(run, response.Response)
+		}
+	} else {
+		response, err = s.aiService.ProcessFlowPrompt(ctx, userInput, model, execution.UserID, flowContext, nodeCachePolicy(run.flow, node))
+		if err == nil {
+			var result *ResponseResult
+			result, err = s.providerService.ExecuteResponse(ctx, execution.DeviceID, execution.ProspectNum, response)
+			if result != nil {
+				sent = result.Sent
+				s.delivered(run, result.Sent)
+				run.hints = result.RoutingHints
+			}
+			if err != nil {
+				s.deliveryFailed(run, err)
+			}
+		}
+	}
+	if errors.Is(err, ErrInputBlocked) || errors.Is(err, ErrReplyBlocked) {
+		log.Printf("Guardrails stopped the AI reply to %s: %v", execution.ProspectNum, err)
+		err = s.applyGuardrailPolicy(ctx, run)
+	}
+	if response == nil {
+		return err
+	}
+
+	response.Citations = citations
+	run.sent.Model = response.Model
+	run.sent.Citations = append(run.sent.Citations, citations...)
+	run.sent.Usage = run.sent.Usage.Add(response.Usage)
+	s.recordUsage(run, response)
+
+	// Nothing of a blocked reply was sent
+	if len(response.Response) == 0 {
+		return err
+	}
+
+	if response.Stage != "" && response.Stage != "General Response" {
+		execution.Stage = response.Stage
+	}
+
+	reply := textContent(response)
+	if errors.Is(err, context.Canceled) {
+		// Only the part sent before the prospect wrote again is history
+		reply = textContent(&models.AIResponse{Response: sent})
+		if reply == "" {
+			return err
+		}
+	}
+	appendHistory(execution, "Bot", reply)
+	s.logConversation(run.device, execution.ProspectNum, "bot", reply, "text", execution.Stage, response)
+
+	return err
+}
+
+// applyCapturedLead keeps the prospect name saved by capture_lead in the
+// execution, so the saved state doesn't overwrite it with the old one
+func applyCapturedLead(execution *models.ExecutionProcess, invocations []models.ToolInvocation) {
+	for _, invocation := range invocations {
+		if invocation.Name != "capture_lead" || invocation.Error != "" {
+			continue
+		}
+
+		var args struct {
+			Name string `json:"name"`
+		}
+		if json.Unmarshal([]byte(invocation.Arguments), &args) == nil && strings.TrimSpace(args.Name) != "" {
+			execution.Variables["prospect_name"] = strings.TrimSpace(args.Name)
+		}
+	}
+}
+
+// retrieveKnowledge adds the knowledge base chunks most relevant to the
+// prospect's message to flowContext when the node enables "knowledgeBase",
+// returning them as citations. Retrieval failures only cost the grounding.
+func (s *FlowService) retrieveKnowledge(ctx context.Context, run *flowRun, node *models.FlowNode, userInput string, flowContext map[string]interface{}) []models.Citation {
+	if !dataBool(node.Data, "knowledgeBase") {
+		return nil
+	}
+
+	userID := run.execution.UserID
+	chunks, err := s.knowledge.Search(ctx, userID, userInput, int(dataFloat(node.Data, "knowledgeTopK")))
+	if err != nil {
+		log.Printf("Knowledge base search failed for user %s: %v", userID, err)
+		return nil
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	flowContext["knowledge"] = chunks
+
+	citations := make([]models.Citation, len(chunks))
+	for i, chunk := range chunks {
+		citations[i] = models.Citation{
+			DocumentID: chunk.DocumentID,
+			ChunkID:    chunk.ID,
+			Title:      chunk.Title,
+			Score:      chunk.Score,
+		}
+	}
+	return citations
+}
+
+// enforceQuota reports whether the user's AI quota is exhausted, in which
+// case the configured action replaces the AI reply. Quota lookups that fail
+// let the reply through rather than silencing every conversation.
+func (s *FlowService) enforceQuota(ctx context.Context, run *flowRun) (bool, error) {
+	execution := run.execution
+
+	status, err := s.quotaService.CheckQuota(ctx, execution.UserID)
+	if err != nil {
+		log.Printf("Failed to check AI quota for user %s: %v", execution.UserID, err)
+		return false, nil
+	}
+	if !status.Exhausted {
+		return false, nil
+	}
+
+	action, fallbackMessage := s.quotaService.ExhaustedAction()
+	log.Printf("AI quota exhausted for user %s, %s for %s", execution.UserID, action, execution.ProspectNum)
+
+	switch action {
+	case QuotaActionFallback:
+		return true, s.send(ctx, run, &models.AIResponse{Response: []models.AIMessage{{Type: "text", Content: fallbackMessage}}})
+	case QuotaActionHandoff:
+		s.handOff(run, models.HandoffQuota)
+	}
+	return true, nil
+}
+
+// applyGuardrailPolicy replaces a blocked AI reply as configured for the device
+func (s *FlowService) applyGuardrailPolicy(ctx context.Context, run *flowRun) error {
+	action := GuardrailActionFallback
+	if run.device.GuardrailAction != nil && *run.device.GuardrailAction != "" {
+		action = GuardrailAction(*run.device.GuardrailAction)
+	}
+
+	switch action {
+	case GuardrailActionHandoff:
+		s.handOff(run, models.HandoffGuardrail)
+	case GuardrailActionSilence:
+	default:
+		message := DefaultGuardrailMessage
+		if run.device.GuardrailMessage != nil && *run.device.GuardrailMessage != "" {
+			message = *run.device.GuardrailMessage
+		}
+		return s.send(ctx, run, &models.AIResponse{Response: []models.AIMessage{{Type: "text", Content: message}}})
+	}
+	return nil
+}
+
+// recordUsage stores the tokens spent on an AI reply for billing. Failures
+// are logged since the reply was already delivered.
+func (s *FlowService) recordUsage(run *flowRun, response *models.AIResponse) {
+	execution := run.execution
+	usageCtx := UsageContext{
+		UserID:      execution.UserID,
+		DeviceID:    execution.DeviceID,
+		FlowID:      run.flow.ID,
+		ExecutionID: execution.ExecutionID,
+	}
+
+	if err := s.usageService.RecordUsage(usageCtx, response.Model, response.Usage); err != nil {
+		log.Printf("Failed to record AI usage for execution %s: %v", execution.ExecutionID, err)
+	}
+}
+
+// nodeCachePolicy reads the per-node cache settings: "cache" (default true)
+// and "cacheTTL" in seconds
+func nodeCachePolicy(flow *models.ChatbotFlow, node *models.FlowNode) CachePolicy {
+	policy := CachePolicy{
+		FlowID:      flow.ID,
+		FlowVersion: strconv.FormatInt(flow.UpdatedAt.UnixNano(), 10),
+		TTL:         time.Duration(dataFloat(node.Data, "cacheTTL") * float64(time.Second)),
+	}
+	if enabled, ok := node.Data["cache"].(bool); ok && !enabled {
+		policy.Disabled = true
+	}
+	return policy
+}
+
+// send executes static node messages and records them
+func (s *FlowService) send(ctx context.Context, run *flowRun, response *models.AIResponse) error {
+	execution := run.execution
+
+	result, err := s.providerService.ExecuteResponse(ctx, execution.DeviceID, execution.ProspectNum, response)
+	if err != nil {
+		s.deliveryFailed(run, err)
+	}
+	if result != nil && len(result.Sent) > 0 {
+		s.delivered(run, result.Sent)
+
+		reply := textContent(&models.AIResponse{Response: result.Sent})
+		appendHistory(execution, "Bot", reply)
+		s.logConversation(run.device, execution.ProspectNum, "bot", reply, "text", execution.Stage, nil)
+	}
+	return err
+}
+
+// selectBranch picks the outgoing edge of a condition node. A routing hint
+// from the previous AI response wins, otherwise the node expression is evaluated.
+func (s *FlowService) selectBranch(run *flowRun, node *models.FlowNode) string {
+	edges := outgoingEdges(run.flow, node.ID)
+	if len(edges) == 0 {
+		return ""
+	}
+
+	hints := run.hints
+	run.hints = nil
+	for _, hint := range hints {
+		for _, edge := range edges {
+			if edgeMatches(edge, hint) {
+				return edge.Target
+			}
+		}
+	}
+
+	matched := evaluateCondition(dataString(node.Data, "condition"), run.execution)
+	for _, edge := range edges {
+		if matched && (edgeMatches(edge, "true") || edgeMatches(edge, "yes")) {
+			return edge.Target
+		}
+		if !matched && (edgeMatches(edge, "false") || edgeMatches(edge, "no")) {
+			return edge.Target
+		}
+	}
+
+	// Unlabelled branches: first edge is the "true" path
+	if matched {
+		return edges[0].Target
+	}
+	if len(edges) > 1 {
+		return edges[1].Target
+	}
+	return ""
+}
+
+// evaluateCondition evaluates expressions such as `user_input contains "yes"`
+// against the execution variables
+func evaluateCondition(expression string, execution *models.ExecutionProcess) bool {
+	match := conditionPattern.FindStringSubmatch(expression)
+	if match == nil {
+		return false
+	}
+
+	var value string
+	switch strings.ToLower(match[1]) {
+	case "stage":
+		value = execution.Stage
+	default:
+		value = variableString(execution, strings.ToLower(match[1]))
+	}
+	value = strings.ToLower(strings.TrimSpace(value))
+	expected := strings.ToLower(match[3])
+
+	switch strings.ToLower(match[2]) {
+	case "contains":
+		return strings.Contains(value, expected)
+	case "equals", "==":
+		return value == expected
+	case "!=":
+		return value != expected
+	case "starts_with":
+		return strings.HasPrefix(value, expected)
+	}
+	return false
+}
+
+func (s *FlowService) loadFlowByID(flowID string) (*models.ChatbotFlow, error) {
+	query := `SELECT id, name, niche, id_device, nodes, edges, user_id, updated_at FROM chatbot_flows WHERE id = $1`
+	return s.scanFlow(s.db.QueryRow(query, flowID))
+}
+
+// loadFlowByDevice returns the most recently updated flow attached to a device
+func (s *FlowService) loadFlowByDevice(deviceID string) (*models.ChatbotFlow, error) {
+	query := `SELECT id, name, niche, id_device, nodes, edges, user_id, updated_at FROM chatbot_flows WHERE id_device = $1 ORDER BY updated_at DESC LIMIT 1`
+	return s.scanFlow(s.db.QueryRow(query, deviceID))
+}
+
+func (s *FlowService) scanFlow(row *sql.Row) (*models.ChatbotFlow, error) {
+	var flow models.ChatbotFlow
+	var nodes, edges []byte
+	err := row.Scan(&flow.ID, &flow.Name, &flow.Niche, &flow.IDDevice, &nodes, &edges, &flow.UserID, &flow.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nodes) > 0 {
+		if err := flow.UnmarshalNodes(nodes); err != nil {
+			return nil, fmt.Errorf("invalid nodes in flow %s: %v", flow.ID, err)
+		}
+	}
+	if len(edges) > 0 {
+		if err := flow.UnmarshalEdges(edges); err != nil {
+			return nil, fmt.Errorf("invalid edges in flow %s: %v", flow.ID, err)
+		}
+	}
+	return &flow, nil
+}
+
+// ConversationFlowID returns the flow a conversation is running, or ""
+func (s *FlowService) ConversationFlowID(deviceID, prospectNum string) string {
+	execution, err := s.loadExecution(deviceID, prospectNum)
+	if err != nil || execution == nil {
+		return ""
+	}
+	return execution.FlowID
+}
+
+// loadExecution returns the latest execution of a conversation, from the
+// cache when possible
+func (s *FlowService) loadExecution(deviceID, prospectNum string) (*models.ExecutionProcess, error) {
+	if execution := s.cachedExecution(deviceID, prospectNum); execution != nil {
+		return execution, nil
+	}
+
+	execution, err := s.queryExecution(deviceID, prospectNum)
+	if err != nil {
+		return nil, err
+	}
+	s.cacheExecution(execution)
+	return execution, nil
+}
+
+func (s *FlowService) queryExecution(deviceID, prospectNum string) (*models.ExecutionProcess, error) {
+	query := `SELECT execution_id, flow_id, current_node_id, last_node_id, waiting_for_reply, execution_status, stage, conv_last, prospect_name, human, user_id, created_at, updated_at
+		FROM ai_whatsapp WHERE id_device = $1 AND prospect_num = $2 ORDER BY updated_at DESC LIMIT 1`
+
+	var executionID, flowID, currentNodeID, lastNodeID, status, stage, convLast, prospectName, userID sql.NullString
+	var waitingForReply sql.NullBool
+	var human sql.NullInt64
+	execution := models.ExecutionProcess{
+		DeviceID:    deviceID,
+		ProspectNum: prospectNum,
+	}
+
+	err := s.db.QueryRow(query, deviceID, prospectNum).Scan(
+		&executionID, &flowID, &currentNodeID, &lastNodeID, &waitingForReply, &status,
+		&stage, &convLast, &prospectName, &human, &userID, &execution.CreatedAt, &execution.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	execution.ExecutionID = executionID.String
+	execution.FlowID = flowID.String
+	execution.CurrentNodeID = currentNodeID.String
+	execution.LastNodeID = lastNodeID.String
+	execution.WaitingForReply = waitingForReply.Bool
+	execution.Status = status.String
+	execution.Stage = stage.String
+	execution.Human = human.Int64 == 1
+	execution.UserID = userID.String
+	execution.Variables = map[string]interface{}{
+		"previous_messages": convLast.String,
+		"prospect_name":     prospectName.String,
+	}
+
+	// Rows created before the flow engine have no execution ID yet
+	if execution.ExecutionID == "" {
+		execution.ExecutionID = uuid.New().String()
+		_, err = s.db.Exec(`UPDATE ai_whatsapp SET execution_id = $1 WHERE id_device = $2 AND prospect_num = $3 AND execution_id IS NULL`,
+			execution.ExecutionID, deviceID, prospectNum)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &execution, nil
+}
+
+func (s *FlowService) createExecution(flow *models.ChatbotFlow, device *models.DeviceSetting, message models.WhatsAppMessage) (*models.ExecutionProcess, error) {
+	prospectName := ""
+	if name, ok := message.Extra["name"].(string); ok {
+		prospectName = name
+	}
+
+	execution := &models.ExecutionProcess{
+		ExecutionID:   uuid.New().String(),
+		FlowID:        flow.ID,
+		CurrentNodeID: startNodeID(flow),
+		ProspectNum:   message.From,
+		DeviceID:      message.DeviceID,
+		UserID:        stringValue(device.UserID),
+		Status:        "active",
+		Variables: map[string]interface{}{
+			"prospect_name": prospectName,
 		},
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	_, err := s.db.Exec(`
+		INSERT INTO ai_whatsapp (execution_id, flow_id, flow_reference, id_device, niche, prospect_name, prospect_num, current_node_id, execution_status, waiting_for_reply, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, false, $10)`,
+		execution.ExecutionID, flow.ID, flow.Name, execution.DeviceID, flow.Niche, prospectName,
+		execution.ProspectNum, execution.CurrentNodeID, execution.Status, nullString(execution.UserID),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	s.cacheExecution(execution)
+	return execution, nil
+}
+
+// restartExecution points a finished execution back at the start of flow
+func (s *FlowService) restartExecution(execution *models.ExecutionProcess, flow *models.ChatbotFlow) {
+	execution.FlowID = flow.ID
+	execution.CurrentNodeID = startNodeID(flow)
+	execution.WaitingForReply = false
+	execution.Status = "active"
+}
+
+func (s *FlowService) saveExecution(execution *models.ExecutionProcess) error {
+	human := 0
+	if execution.Human {
+		human = 1
+	}
+	execution.UpdatedAt = time.Now()
+
+	_, err := s.db.Exec(`
+		UPDATE ai_whatsapp SET flow_id = $2, current_node_id = $3, last_node_id = $4, waiting_for_reply = $5,
+			execution_status = $6, stage = $7, conv_last = $8, human = $9, updated_at = NOW()
+		WHERE execution_id = $1`,
+		execution.ExecutionID, execution.FlowID, execution.CurrentNodeID, execution.LastNodeID, execution.WaitingForReply,
+		execution.Status, nullString(execution.Stage), variableString(execution, "previous_messages"), human,
+	)
+	if err != nil {
+		log.Printf("Failed to save execution %s: %v", execution.ExecutionID, err)
+		// The cached state may now be ahead of the database
+		s.uncacheExecution(execution)
+		return err
+	}
+
+	s.cacheExecution(execution)
+	return nil
+}
+
+// executionRefKey points a conversation at its cached execution
+func executionRefKey(deviceID, prospectNum string) string {
+	return "flow_execution_ref:" + conversationKey(deviceID, prospectNum)
+}
+
+// cachedExecution returns the cached execution of a conversation, or nil
+func (s *FlowService) cachedExecution(deviceID, prospectNum string) *models.ExecutionProcess {
+	ctx := context.Background()
+	executionID, err := s.redisService.Get(ctx, executionRefKey(deviceID, prospectNum))
+	if err != nil {
+		return nil
+	}
+
+	execution, err := s.redisService.GetCachedFlowExecution(ctx, executionID)
+	if err != nil {
+		log.Printf("Failed to read cached execution %s: %v", executionID, err)
+		return nil
+	}
+	if execution != nil && execution.Variables == nil {
+		execution.Variables = map[string]interface{}{}
+	}
+	return execution
+}
+
+// cacheExecution writes execution through to the cache. A failed write drops
+// the entry so a stale state can't be read back.
+func (s *FlowService) cacheExecution(execution *models.ExecutionProcess) {
+	ctx := context.Background()
+	err := s.redisService.CacheFlowExecution(ctx, execution, executionCacheTTL)
+	if err == nil {
+		err = s.redisService.Set(ctx, executionRefKey(execution.DeviceID, execution.ProspectNum), execution.ExecutionID, executionCacheTTL)
+	}
+	if err != nil {
+		log.Printf("Failed to cache execution %s: %v", execution.ExecutionID, err)
+		s.uncacheExecution(execution)
+	}
+}
+
+func (s *FlowService) uncacheExecution(execution *models.ExecutionProcess) {
+	if err := s.redisService.DeleteCachedFlowExecution(context.Background(), execution.ExecutionID); err != nil {
+		log.Printf("Failed to drop cached execution %s: %v", execution.ExecutionID, err)
+	}
+}
+
+// logConversation stores a message in conversation_log. AI replies keep the
+// full response, including the model that produced it, in ai_response.
+func (s *FlowService) logConversation(device *models.DeviceSetting, prospectNum, sender, message, messageType, stage string, aiResponse *models.AIResponse) {
+	switch messageType {
+	case "text", "image", "document", "audio", "video":
+	default:
+		messageType = "text"
+	}
+
+	var aiResponseJSON []byte
+	if aiResponse != nil {
+		var err error
+		if aiResponseJSON, err = json.Marshal(aiResponse); err != nil {
+			log.Printf("Failed to marshal AI response for log: %v", err)
+		}
+	}
+
+	_, err := s.db.Exec(`
+		INSERT INTO conversation_log (id, prospect_num, sender, message, message_type, stage, ai_response, device_id, user_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		uuid.New().String(), prospectNum, sender, message, messageType, nullString(stage),
+		aiResponseJSON, stringValue(device.IDDevice), device.UserID,
+	)
+	if err != nil {
+		log.Printf("Failed to log conversation for %s: %v", prospectNum, err)
+	}
+}
+
+func findNode(flow *models.ChatbotFlow, nodeID string) *models.FlowNode {
+	for i := range flow.Nodes {
+		if flow.Nodes[i].ID == nodeID {
+			return &flow.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// startNodeID returns the start node, or the first node of flows without one
+func startNodeID(flow *models.ChatbotFlow) string {
+	for _, node := range flow.Nodes {
+		if node.Type == "start" {
+			return node.ID
+		}
+	}
+	if len(flow.Nodes) > 0 {
+		return flow.Nodes[0].ID
+	}
+	return ""
+}
+
+func outgoingEdges(flow *models.ChatbotFlow, nodeID string) []models.FlowEdge {
+	var edges []models.FlowEdge
+	for _, edge := range flow.Edges {
+		if edge.Source == nodeID {
+			edges = append(edges, edge)
+		}
+	}
+	return edges
+}
+
+// nextNodeID follows the first outgoing edge of a node
+func nextNodeID(flow *models.ChatbotFlow, nodeID string) string {
+	if edges := outgoingEdges(flow, nodeID); len(edges) > 0 {
+		return edges[0].Target
+	}
+	return ""
+}
+
+// edgeMatches reports whether an edge's handle or label equals value, ignoring case
+func edgeMatches(edge models.FlowEdge, value string) bool {
+	value = strings.TrimSpace(value)
+	if edge.SourceHandle != nil && strings.EqualFold(*edge.SourceHandle, value) {
+		return true
+	}
+	return edge.Label != nil && strings.EqualFold(strings.TrimSpace(*edge.Label), value)
+}
+
+// appendHistory records a line of conversation for AI context, keeping only the tail
+func appendHistory(execution *models.ExecutionProcess, speaker, text string) {
+	if text == "" {
+		return
+	}
+
+	history := variableString(execution, "previous_messages")
+	if history != "" {
+		history += "\n"
+	}
+	history += speaker + ": " + text
+
+	if len(history) > maxConversationHistory {
+		cut := len(history) - maxConversationHistory
+		for cut < len(history) && !utf8.RuneStart(history[cut]) {
+			cut++
+		}
+		history = history[cut:]
+	}
+	execution.Variables["previous_messages"] = history
+}
+
+// textContent joins the text messages of a response
+func textContent(response *models.AIResponse) string {
+	var parts []string
+	for _, message := range response.Response {
+		if message.Type == "text" {
+			parts = append(parts, message.Content)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func variableString(execution *models.ExecutionProcess, name string) string {
+	value, _ := execution.Variables[name].(string)
+	return value
+}
+
+func dataString(data map[string]interface{}, key string) string {
+	value, _ := data[key].(string)
+	return strings.TrimSpace(value)
+}
+
+func dataFloat(data map[string]interface{}, key string) float64 {
+	switch value := data[key].(type) {
+	case float64:
+		return value
+	case string:
+		parsed, _ := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return parsed
+	}
+	return 0
+}
+
+func dataBool(data map[string]interface{}, key string) bool {
+	value, _ := data[key].(bool)
+	return value
+}
+
+// dataStrings reads a list setting given either as an array or as a comma
+// separated string
+func dataStrings(data map[string]interface{}, key string) []string {
+	var values []string
+	switch value := data[key].(type) {
+	case []interface{}:
+		for _, item := range value {
+			if str, ok := item.(string); ok && strings.TrimSpace(str) != "" {
+				values = append(values, strings.TrimSpace(str))
+			}
+		}
+	case string:
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
 	}
+	return values
+}
 
-	return response, nil
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
 }
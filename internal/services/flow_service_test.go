@@ -0,0 +1,449 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sparkle-concept-sync/internal/models"
+)
+
+// fakeDB is a database/sql driver serving canned rows by table, so flow tests
+// run without Postgres. Writes are recorded and otherwise ignored.
+type fakeDB struct {
+	mu     sync.Mutex
+	tables map[string]fakeTable
+	writes []string
+}
+
+// fakeTable answers every SELECT from a table with the same rows
+type fakeTable struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (db *fakeDB) Connect(ctx context.Context) (driver.Conn, error) { return &fakeConn{db: db}, nil }
+func (db *fakeDB) Driver() driver.Driver                            { return nil }
+
+// written returns the recorded writes containing fragment
+func (db *fakeDB) written(fragment string) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var writes []string
+	for _, write := range db.writes {
+		if strings.Contains(write, fragment) {
+			writes = append(writes, write)
+		}
+	}
+	return writes
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("transactions not supported") }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	s.db.writes = append(s.db.writes, fmt.Sprintf("%s %v", strings.Join(strings.Fields(s.query), " "), args))
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for name, table := range s.db.tables {
+		if strings.Contains(s.query, "FROM "+name+" ") {
+			return &fakeRows{columns: table.columns, rows: table.rows}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected query %q", s.query)
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// flowTest is a FlowService wired to fakes: canned database rows, a WAHA
+// instance recording the texts it is asked to send and an echoing AI
+type flowTest struct {
+	service *FlowService
+	db      *fakeDB
+	redis   *RedisService
+
+	mu   sync.Mutex
+	sent []string
+}
+
+const (
+	testDeviceID = "device-1"
+	testProspect = "62812"
+)
+
+func newFlowTest(t *testing.T, nodes []models.FlowNode, edges []models.FlowEdge) *flowTest {
+	t.Helper()
+	ft := &flowTest{}
+
+	waha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		if r.URL.Path == "/api/sendText" {
+			ft.mu.Lock()
+			ft.sent = append(ft.sent, fmt.Sprint(payload["text"]))
+			ft.mu.Unlock()
+		}
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(waha.Close)
+
+	nodesJSON, _ := json.Marshal(nodes)
+	edgesJSON, _ := json.Marshal(edges)
+	now := time.Now()
+	ft.db = &fakeDB{tables: map[string]fakeTable{
+		"device_setting": {
+			columns: []string{"id", "device_id", "api_key_option", "webhook_id", "provider", "phone_number", "api_key", "id_device", "user_id", "instance", "guardrail_action", "guardrail_message", "created_at", "updated_at"},
+			rows:    [][]driver.Value{{"1", "default", "fake:echo", nil, "waha", nil, nil, testDeviceID, "user-1", waha.URL, nil, nil, now, now}},
+		},
+		"chatbot_flows": {
+			columns: []string{"id", "name", "niche", "id_device", "nodes", "edges", "user_id", "updated_at"},
+			rows:    [][]driver.Value{{"flow-1", "Test flow", "tea", testDeviceID, nodesJSON, edgesJSON, "user-1", now}},
+		},
+		// No conversation yet
+		"ai_whatsapp": {},
+	}}
+	db := sql.OpenDB(ft.db)
+	t.Cleanup(func() { db.Close() })
+
+	ft.redis = NewRedisService("redis://127.0.0.1:1")
+	t.Cleanup(func() { ft.redis.Close() })
+
+	aiService := newTestAIService(t, NewFakeLLMClient())
+	scheduler := NewSchedulerService(ft.redis)
+	t.Cleanup(scheduler.Close)
+
+	breakers := NewCircuitBreakerRegistry(5, time.Minute)
+	deviceService := NewDeviceSettingsService(db)
+	ft.service = NewFlowService(db, ft.redis, aiService, NewProviderService(deviceService, breakers, scheduler, nil),
+		deviceService, scheduler, NewUsageService(db), NewQuotaService(db, ft.redis, nil), NewKnowledgeService(db), NewToolService(db), nil)
+	return ft
+}
+
+func (ft *flowTest) sentTexts() []string {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	return append([]string(nil), ft.sent...)
+}
+
+func (ft *flowTest) receive(t *testing.T, body string) *models.AIResponse {
+	t.Helper()
+
+	response, err := ft.service.ExecuteFlow(models.WhatsAppMessage{
+		DeviceID: testDeviceID,
+		From:     testProspect,
+		Body:     body,
+		Type:     "text",
+	})
+	if err != nil {
+		t.Fatalf("ExecuteFlow(%q): %v", body, err)
+	}
+	return response
+}
+
+func edge(source, target string) models.FlowEdge {
+	return models.FlowEdge{ID: source + "-" + target, Source: source, Target: target}
+}
+
+func labelledEdge(source, target, label string) models.FlowEdge {
+	e := edge(source, target)
+	e.Label = &label
+	return e
+}
+
+func TestExecuteFlowWaitsForReplyThenAnswersWithAI(t *testing.T) {
+	ft := newFlowTest(t, []models.FlowNode{
+		{ID: "start", Type: "start"},
+		{ID: "welcome", Type: "message", Data: map[string]interface{}{"message": "Welcome to our tea shop"}},
+		{ID: "stage", Type: "stage", Data: map[string]interface{}{"stage": "Greeting"}},
+		{ID: "wait", Type: "user_reply"},
+		{ID: "ai", Type: "ai_prompt", Data: map[string]interface{}{"prompt": "Sell tea", "cache": false}},
+	}, []models.FlowEdge{edge("start", "welcome"), edge("welcome", "stage"), edge("stage", "wait"), edge("wait", "ai")})
+
+	response := ft.receive(t, "Hi")
+	if got := ft.sentTexts(); len(got) != 1 || got[0] != "Welcome to our tea shop" {
+		t.Fatalf("first message sent %q, want the welcome", got)
+	}
+	if response.Stage != "Greeting" {
+		t.Fatalf("stage = %q, want Greeting", response.Stage)
+	}
+	if len(ft.db.written("INSERT INTO ai_whatsapp")) != 1 {
+		t.Fatal("the conversation's execution wasn't created")
+	}
+
+	// The execution is read back from the cache, waiting at user_reply
+	ft.receive(t, "Do you have green tea?")
+	got := ft.sentTexts()
+	if len(got) != 2 || got[1] != "Echo: Do you have green tea?" {
+		t.Fatalf("reply sent %q, want the AI echo", got)
+	}
+
+	execution, err := ft.service.loadExecution(testDeviceID, testProspect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if execution.Status != "completed" {
+		t.Fatalf("execution status = %q, want completed", execution.Status)
+	}
+	if history := variableString(execution, "previous_messages"); !strings.Contains(history, "Bot: Echo: Do you have green tea?") {
+		t.Fatalf("history %q lacks the AI reply", history)
+	}
+	if logs := ft.db.written("INSERT INTO conversation_log"); len(logs) != 4 {
+		t.Fatalf("logged %d messages, want 4", len(logs))
+	}
+}
+
+func TestExecuteFlowIgnoresHumanConversations(t *testing.T) {
+	ft := newFlowTest(t, []models.FlowNode{
+		{ID: "start", Type: "start"},
+		{ID: "manual", Type: "manual"},
+		{ID: "after", Type: "message", Data: map[string]interface{}{"message": "Still here"}},
+	}, []models.FlowEdge{edge("start", "manual"), edge("manual", "after")})
+
+	ft.receive(t, "Hi")
+	response := ft.receive(t, "Hello?")
+	if response != nil {
+		t.Fatalf("bot answered %+v during a human takeover", response)
+	}
+	if got := ft.sentTexts(); len(got) != 0 {
+		t.Fatalf("bot sent %q during a human takeover", got)
+	}
+}
+
+func TestExecuteFlowWaitsForBusyConversation(t *testing.T) {
+	ft := newFlowTest(t, []models.FlowNode{
+		{ID: "start", Type: "start"},
+		{ID: "welcome", Type: "message", Data: map[string]interface{}{"message": "Welcome"}},
+	}, []models.FlowEdge{edge("start", "welcome")})
+
+	ctx := context.Background()
+	held, err := ft.redis.Lock(ctx, "flow:"+conversationKey(testDeviceID, testProspect), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ft.receive(t, "Hi")
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	if got := ft.sentTexts(); len(got) != 0 {
+		t.Fatalf("flow ran while the conversation was busy, sent %q", got)
+	}
+
+	held.Release(ctx)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow didn't run once the conversation was released")
+	}
+	if got := ft.sentTexts(); len(got) != 1 {
+		t.Fatalf("sent %q after the conversation was released, want the welcome", got)
+	}
+}
+
+func TestLockConversationReportsBusy(t *testing.T) {
+	ft := newFlowTest(t, nil, nil)
+
+	ctx := context.Background()
+	held, err := ft.redis.Lock(ctx, "flow:"+conversationKey(testDeviceID, testProspect), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Release(ctx)
+
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := ft.service.lockConversation(waitCtx, testDeviceID, testProspect); err == nil || !strings.Contains(err.Error(), "busy") {
+		t.Fatalf("lockConversation error = %v, want busy", err)
+	}
+
+	// Other conversations aren't held up
+	lock, err := ft.service.lockConversation(waitCtx, testDeviceID, "62899")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Release(ctx)
+}
+
+func TestExecuteNode(t *testing.T) {
+	flow := &models.ChatbotFlow{
+		ID: "flow-1",
+		Nodes: []models.FlowNode{
+			{ID: "start", Type: "start"},
+			{ID: "stage", Type: "stage", Data: map[string]interface{}{"stage": "Closing"}},
+			{ID: "wait", Type: "user_reply"},
+			{ID: "no-delay", Type: "delay", Data: map[string]interface{}{"delay": 0.0}},
+			{ID: "delay", Type: "delay", Data: map[string]interface{}{"delay": "30"}},
+			{ID: "last-delay", Type: "delay", Data: map[string]interface{}{"delay": 30.0}},
+			{ID: "condition", Type: "condition", Data: map[string]interface{}{"condition": `user_input contains "yes"`}},
+			{ID: "empty", Type: "message"},
+			{ID: "mystery", Type: "mystery"},
+		},
+		Edges: []models.FlowEdge{
+			edge("start", "stage"), edge("stage", "wait"), edge("wait", "no-delay"),
+			edge("no-delay", "delay"), edge("delay", "condition"),
+			labelledEdge("condition", "accepted", "true"), labelledEdge("condition", "declined", "false"),
+			edge("empty", "mystery"), edge("mystery", "start"),
+		},
+	}
+
+	tests := []struct {
+		node      string
+		userInput string
+		next      string
+		stop      bool
+		check     func(t *testing.T, execution *models.ExecutionProcess)
+	}{
+		{node: "start", next: "stage"},
+		{node: "stage", next: "wait", check: func(t *testing.T, execution *models.ExecutionProcess) {
+			if execution.Stage != "Closing" {
+				t.Errorf("stage = %q, want Closing", execution.Stage)
+			}
+		}},
+		{node: "wait", stop: true, check: func(t *testing.T, execution *models.ExecutionProcess) {
+			if !execution.WaitingForReply {
+				t.Error("user_reply didn't wait for the prospect")
+			}
+		}},
+		{node: "no-delay", next: "delay"},
+		{node: "delay", stop: true, check: func(t *testing.T, execution *models.ExecutionProcess) {
+			if execution.CurrentNodeID != "condition" {
+				t.Errorf("delay left the execution at %q, want the node after it", execution.CurrentNodeID)
+			}
+		}},
+		{node: "last-delay", next: ""},
+		{node: "condition", userInput: "Yes please", next: "accepted"},
+		{node: "condition", userInput: "No thanks", next: "declined"},
+		{node: "empty", next: "mystery"},
+		{node: "mystery", next: "start"},
+	}
+
+	ft := newFlowTest(t, nil, nil)
+	for _, tt := range tests {
+		execution := &models.ExecutionProcess{
+			DeviceID:    testDeviceID,
+			ProspectNum: testProspect,
+			Variables:   map[string]interface{}{"user_input": tt.userInput},
+		}
+		run := &flowRun{flow: flow, execution: execution}
+
+		next, stop, err := ft.service.executeNode(context.Background(), run, findNode(flow, tt.node))
+		if err != nil {
+			t.Errorf("%s: %v", tt.node, err)
+			continue
+		}
+		if next != tt.next || stop != tt.stop {
+			t.Errorf("%s (%q): next=%q stop=%v, want next=%q stop=%v", tt.node, tt.userInput, next, stop, tt.next, tt.stop)
+		}
+		if tt.check != nil {
+			tt.check(t, execution)
+		}
+	}
+
+	// The delay node was scheduled for the conversation
+	jobs, _ := ft.redis.PopByScore(context.Background(), jobsKey("flow"), float64(time.Now().Add(time.Hour).UnixMilli()), 0)
+	if len(jobs) != 1 || jobs[0].Member != conversationKey(testDeviceID, testProspect) {
+		t.Fatalf("scheduled jobs = %v, want one resumption of the conversation", jobs)
+	}
+}
+
+func TestSelectBranchPrefersRoutingHints(t *testing.T) {
+	flow := &models.ChatbotFlow{
+		Nodes: []models.FlowNode{{ID: "condition", Type: "condition", Data: map[string]interface{}{"condition": `user_input contains "yes"`}}},
+		Edges: []models.FlowEdge{
+			labelledEdge("condition", "accepted", "true"),
+			labelledEdge("condition", "declined", "false"),
+			labelledEdge("condition", "human", "handoff"),
+		},
+	}
+	run := &flowRun{
+		flow:      flow,
+		execution: &models.ExecutionProcess{Variables: map[string]interface{}{"user_input": "yes"}},
+		hints:     []string{"Handoff"},
+	}
+
+	s := &FlowService{}
+	if next := s.selectBranch(run, &flow.Nodes[0]); next != "human" {
+		t.Fatalf("selectBranch = %q, want the hinted branch", next)
+	}
+	// Hints are used up by one condition
+	if next := s.selectBranch(run, &flow.Nodes[0]); next != "accepted" {
+		t.Fatalf("selectBranch = %q without hints, want accepted", next)
+	}
+}
+
+func TestEvaluateCondition(t *testing.T) {
+	execution := &models.ExecutionProcess{
+		Stage:     "Closing",
+		Variables: map[string]interface{}{"user_input": " Yes, I want it "},
+	}
+
+	tests := map[string]bool{
+		`user_input contains "want"`:      true,
+		`user_input starts_with "yes"`:    true,
+		`user_input equals "no"`:          false,
+		`user_input != "no"`:              true,
+		`stage == "closing"`:              true,
+		`prospect_name equals ""`:         true,
+		`user_input matches "x"`:          false,
+		`not a condition`:                 false,
+		`USER_INPUT CONTAINS "I WANT IT"`: true,
+		`stage starts_with "clo"`:         true,
+	}
+
+	for expression, want := range tests {
+		if got := evaluateCondition(expression, execution); got != want {
+			t.Errorf("evaluateCondition(%s) = %v, want %v", expression, got, want)
+		}
+	}
+}
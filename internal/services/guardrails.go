@@ -0,0 +1,248 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"sparkle-concept-sync/internal/models"
+)
+
+var (
+	// ErrInputBlocked is returned when a prospect's message looks like an
+	// attempt to take over the bot
+	ErrInputBlocked = errors.New("message blocked by guardrails")
+	// ErrReplyBlocked is returned when an AI reply must not reach the prospect
+	ErrReplyBlocked = errors.New("AI reply blocked by guardrails")
+)
+
+// GuardrailAction is what the flow engine sends instead of a blocked reply
+type GuardrailAction string
+
+const (
+	// GuardrailActionFallback sends the device's canned message
+	GuardrailActionFallback GuardrailAction = "fallback"
+	// GuardrailActionHandoff hands the conversation over to a human agent
+	GuardrailActionHandoff GuardrailAction = "handoff"
+	// GuardrailActionSilence doesn't reply at all
+	GuardrailActionSilence GuardrailAction = "silence"
+)
+
+// DefaultGuardrailMessage is sent for blocked replies when a device has no message of its own
+const DefaultGuardrailMessage = "Sorry, I can't help with that. Is there anything else I can help you with?"
+
+const (
+	moderationTimeout = 10 * time.Second
+	redactedSecret    = "[REDACTED]"
+	// Shorter sentences of a prompt are too generic to count as a leak
+	minLeakLength = 40
+)
+
+// moderationPrompt asks the moderation model for a one line verdict
+const moderationPrompt = `You moderate replies a business WhatsApp chatbot is about to send to a customer.
+Answer SAFE if the message is fine to send, or UNSAFE: <reason> if it is offensive, hateful, sexual, violent, harassing, discriminatory or otherwise harmful to the business.
+Answer with nothing else.`
+
+// injectionPatterns match common attempts to override or extract the bot's instructions
+var injectionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override)\s+(all\s+)?(of\s+)?(your\s+|the\s+|these\s+)?(previous|prior|above|earlier|original|system)\s+(instructions|prompts?|rules)\b`),
+	regexp.MustCompile(`(?i)\b(ignore|disregard|forget|override)\s+(all\s+)?(of\s+)?your\s+(instructions|prompts?|rules)\b`),
+	regexp.MustCompile(`(?i)\b(reveal|show|print|repeat|output|display|tell|give)\s+(me\s+|us\s+)?(your|the)\s+(system|initial|original|hidden)\s+(prompt|instructions)\b`),
+	regexp.MustCompile(`(?i)\b(reveal|print|repeat|output)\s+(me\s+|us\s+)?your\s+(prompt|instructions)\b`),
+	regexp.MustCompile(`(?i)\bsystem\s+prompt\b`),
+	regexp.MustCompile(`(?i)\b(developer|DAN|god)\s+mode\b`),
+	regexp.MustCompile(`(?i)\bjailbr(eak|oken)\b`),
+	regexp.MustCompile(`(?i)\byou\s+are\s+no\s+longer\s+(a|an|the)\b`),
+	regexp.MustCompile(`(?i)\b(abaikan|lupakan)\s+(semua\s+)?(arahan|peraturan)\b`),
+}
+
+// secretPatterns match credentials that must never be sent to a prospect
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`),
+	regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{20,}`),
+	regexp.MustCompile(`\bAKIA[0-9A-Z]{16}\b`),
+	regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}`),
+	regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}`),
+	regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`),
+	regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`),
+	regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/-]{20,}=*`),
+}
+
+var sentenceBoundary = regexp.MustCompile(`[.!?\n]+`)
+
+// Guardrails screens prospect messages for prompt injection and checks AI
+// replies against a blocklist, prompt leaks and an optional moderation model.
+// Secrets in replies are redacted rather than blocked.
+type Guardrails struct {
+	blocklist       []*regexp.Regexp
+	moderationModel string
+}
+
+// NewGuardrails creates guardrails blocking replies that contain any of the
+// blocklist terms. A moderationModel additionally has every reply reviewed.
+func NewGuardrails(blocklist []string, moderationModel string) *Guardrails {
+	g := &Guardrails{moderationModel: moderationModel}
+	for _, term := range blocklist {
+		if term = strings.TrimSpace(term); term != "" {
+			g.blocklist = append(g.blocklist, regexp.MustCompile(`(?i)\b`+regexp.QuoteMeta(term)+`\b`))
+		}
+	}
+	return g
+}
+
+// ParseBlocklist parses a comma separated list of blocked terms
+func ParseBlocklist(spec string) []string {
+	var terms []string
+	for _, term := range strings.Split(spec, ",") {
+		if term = strings.TrimSpace(term); term != "" {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// ValidGuardrailAction reports whether action is a known guardrail action
+func ValidGuardrailAction(action string) bool {
+	switch GuardrailAction(action) {
+	case GuardrailActionFallback, GuardrailActionHandoff, GuardrailActionSilence:
+		return true
+	}
+	return false
+}
+
+// ScreenInput rejects prospect messages that try to override the bot's instructions
+func (g *Guardrails) ScreenInput(input string) error {
+	if g == nil {
+		return nil
+	}
+
+	for _, pattern := range injectionPatterns {
+		if match := pattern.FindString(input); match != "" {
+			return fmt.Errorf("%w: possible prompt injection %q", ErrInputBlocked, match)
+		}
+	}
+	return nil
+}
+
+// checkText rejects text containing a blocked term or a sentence of the
+// system prompt or the node instructions
+func (g *Guardrails) checkText(text, instructions string) error {
+	for _, pattern := range g.blocklist {
+		if match := pattern.FindString(text); match != "" {
+			return fmt.Errorf("%w: blocked term %q", ErrReplyBlocked, match)
+		}
+	}
+
+	lower := strings.ToLower(text)
+	for _, prompt := range []string{chatbotSystemPrompt, streamingSystemPrompt, instructions} {
+		for _, sentence := range sentenceBoundary.Split(prompt, -1) {
+			sentence = strings.ToLower(strings.TrimSpace(sentence))
+			if len(sentence) >= minLeakLength && strings.Contains(lower, sentence) {
+				return fmt.Errorf("%w: reply leaks the prompt", ErrReplyBlocked)
+			}
+		}
+	}
+	return nil
+}
+
+// redactSecrets replaces credentials in text, reporting whether any were found
+func redactSecrets(text string) (string, bool) {
+	redacted := false
+	for _, pattern := range secretPatterns {
+		if pattern.MatchString(text) {
+			text = pattern.ReplaceAllString(text, redactedSecret)
+			redacted = true
+		}
+	}
+	return text, redacted
+}
+
+// SetGuardrails replaces the checks applied to prompts and replies, nil
+// disables them
+func (s *AIService) SetGuardrails(guardrails *Guardrails) {
+	s.guardrails = guardrails
+}
+
+// guardReply redacts secrets from the text messages of response and checks
+// them, returning ErrReplyBlocked if the reply must not be sent
+func (s *AIService) guardReply(ctx context.Context, response *models.AIResponse, instructions string) error {
+	if s.guardrails == nil {
+		return nil
+	}
+
+	var texts []string
+	for i := range response.Response {
+		message := &response.Response[i]
+		if message.Type != "text" {
+			continue
+		}
+		if err := s.guardText(message, instructions); err != nil {
+			return err
+		}
+		texts = append(texts, message.Content)
+	}
+
+	usage, err := s.moderate(ctx, strings.Join(texts, "\n\n"))
+	response.Usage = response.Usage.Add(usage)
+	return err
+}
+
+// guardMessage is guardReply for a single streamed message, returning the
+// tokens spent on moderation
+func (s *AIService) guardMessage(ctx context.Context, message *models.AIMessage, instructions string) (*models.AIUsage, error) {
+	if s.guardrails == nil || message.Type != "text" {
+		return nil, nil
+	}
+	if err := s.guardText(message, instructions); err != nil {
+		return nil, err
+	}
+
+	return s.moderate(ctx, message.Content)
+}
+
+func (s *AIService) guardText(message *models.AIMessage, instructions string) error {
+	content, redacted := redactSecrets(message.Content)
+	if redacted {
+		log.Printf("Redacted a secret from an AI reply")
+		message.Content = content
+	}
+	return s.guardrails.checkText(message.Content, instructions)
+}
+
+// moderate has the moderation model review text. Moderation failures let the
+// reply through, the other checks still apply.
+func (s *AIService) moderate(ctx context.Context, text string) (*models.AIUsage, error) {
+	model := s.guardrails.moderationModel
+	if model == "" || strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, moderationTimeout)
+	defer cancel()
+
+	// Not s.complete: the verdict is plain text, never the whatsapp_reply
+	// structured output
+	client, backendModel := s.backendFor(model)
+	completion, err := client.Complete(ctx, ChatRequest{
+		Model: backendModel,
+		Messages: []Message{
+			{Role: "system", Content: moderationPrompt},
+			{Role: "user", Content: text},
+		},
+	})
+	if err != nil {
+		log.Printf("Moderation with %s failed: %v", model, err)
+		return nil, nil
+	}
+
+	verdict := strings.TrimSpace(completion.Content)
+	if strings.HasPrefix(strings.ToUpper(verdict), "UNSAFE") {
+		reason := strings.TrimSpace(strings.TrimLeft(verdict[len("UNSAFE"):], ": "))
+		return completion.Usage, fmt.Errorf("%w: moderation flagged the reply: %s", ErrReplyBlocked, reason)
+	}
+	return completion.Usage, nil
+}
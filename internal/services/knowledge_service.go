@@ -0,0 +1,454 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"sparkle-concept-sync/internal/models"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// maxChunkLength is the target size of a knowledge chunk in characters
+	maxChunkLength = 800
+	// chunkOverlap carries the end of a chunk into the next one so facts cut
+	// at a boundary stay retrievable
+	chunkOverlap       = 120
+	defaultKnowledgeK  = 3
+	maxKnowledgeK      = 10
+	maxKnowledgeLength = 1 << 20
+	// rrfK dampens rank differences when fusing full-text and vector results
+	rrfK = 60
+)
+
+var (
+	ErrDocumentTooLarge = fmt.Errorf("document exceeds %d bytes", maxKnowledgeLength)
+	ErrEmptyDocument    = errors.New("document is empty")
+)
+
+// Embedder turns texts into embedding vectors for semantic search
+type Embedder interface {
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// KnowledgeService stores per-user knowledge base documents as chunks and
+// retrieves the most relevant ones with Postgres full-text search, fused with
+// pgvector similarity when an embedder is configured
+type KnowledgeService struct {
+	db       *sql.DB
+	embedder Embedder
+}
+
+func NewKnowledgeService(db *sql.DB) *KnowledgeService {
+	return &KnowledgeService{db: db}
+}
+
+// EnableVectorSearch adds an embedding column of the given dimensions to
+// knowledge chunks. It requires the pgvector extension to be installed.
+func (s *KnowledgeService) EnableVectorSearch(embedder Embedder, dimensions int) error {
+	statements := []string{
+		`CREATE EXTENSION IF NOT EXISTS vector`,
+		fmt.Sprintf(`ALTER TABLE knowledge_chunks ADD COLUMN IF NOT EXISTS embedding vector(%d)`, dimensions),
+		`CREATE INDEX IF NOT EXISTS idx_knowledge_chunks_embedding ON knowledge_chunks USING hnsw (embedding vector_cosine_ops)`,
+	}
+	for _, statement := range statements {
+		if _, err := s.db.Exec(statement); err != nil {
+			return fmt.Errorf("failed to enable vector search: %v", err)
+		}
+	}
+
+	s.embedder = embedder
+	return nil
+}
+
+// AddDocument chunks content and stores it in the user's knowledge base
+func (s *KnowledgeService) AddDocument(ctx context.Context, userID, title, source, content string) (*models.KnowledgeDocument, error) {
+	if len(content) > maxKnowledgeLength {
+		return nil, ErrDocumentTooLarge
+	}
+
+	chunks := chunkText(content, maxChunkLength, chunkOverlap)
+	if len(chunks) == 0 {
+		return nil, ErrEmptyDocument
+	}
+
+	var embeddings [][]float32
+	if s.embedder != nil {
+		var err error
+		embeddings, err = s.embedder.Embed(ctx, chunks)
+		if err != nil {
+			// Full-text search still finds the document
+			log.Printf("Failed to embed knowledge document %q: %v", title, err)
+			embeddings = nil
+		}
+	}
+
+	document := &models.KnowledgeDocument{
+		ID:         uuid.New().String(),
+		UserID:     userID,
+		Title:      title,
+		ChunkCount: len(chunks),
+		CreatedAt:  time.Now(),
+	}
+	if source != "" {
+		document.Source = &source
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO knowledge_documents (id, user_id, title, source, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		document.ID, userID, title, document.Source, document.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store document: %v", err)
+	}
+
+	for i, chunk := range chunks {
+		if embeddings != nil && i < len(embeddings) {
+			_, err = tx.Exec(`INSERT INTO knowledge_chunks (id, document_id, user_id, chunk_index, content, embedding) VALUES ($1, $2, $3, $4, $5, $6::vector)`,
+				uuid.New().String(), document.ID, userID, i, chunk, vectorLiteral(embeddings[i]))
+		} else {
+			_, err = tx.Exec(`INSERT INTO knowledge_chunks (id, document_id, user_id, chunk_index, content) VALUES ($1, $2, $3, $4, $5)`,
+				uuid.New().String(), document.ID, userID, i, chunk)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to store chunk %d: %v", i, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+// GetDocuments returns the documents of a user's knowledge base
+func (s *KnowledgeService) GetDocuments(userID string) ([]models.KnowledgeDocument, error) {
+	query := `SELECT d.id, d.user_id, d.title, d.source, d.created_at, COUNT(c.id)
+			  FROM knowledge_documents d
+			  LEFT JOIN knowledge_chunks c ON c.document_id = d.id
+			  WHERE d.user_id = $1
+			  GROUP BY d.id ORDER BY d.created_at DESC`
+
+	rows, err := s.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	documents := []models.KnowledgeDocument{}
+	for rows.Next() {
+		var document models.KnowledgeDocument
+		err := rows.Scan(&document.ID, &document.UserID, &document.Title, &document.Source, &document.CreatedAt, &document.ChunkCount)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, document)
+	}
+
+	return documents, rows.Err()
+}
+
+// DeleteDocument removes a document and its chunks, returning sql.ErrNoRows
+// when the user has no such document
+func (s *KnowledgeService) DeleteDocument(userID, documentID string) error {
+	result, err := s.db.Exec(`DELETE FROM knowledge_documents WHERE id = $1 AND user_id = $2`, documentID, userID)
+	if err != nil {
+		return err
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Search returns up to k chunks of the user's knowledge base relevant to query
+func (s *KnowledgeService) Search(ctx context.Context, userID, query string, k int) ([]models.KnowledgeChunk, error) {
+	if k <= 0 {
+		k = defaultKnowledgeK
+	}
+	if k > maxKnowledgeK {
+		k = maxKnowledgeK
+	}
+	if strings.TrimSpace(query) == "" {
+		return nil, nil
+	}
+
+	textResults, err := s.searchText(ctx, userID, query, k*2)
+	if err != nil {
+		return nil, err
+	}
+	if s.embedder == nil {
+		return truncateChunks(textResults, k), nil
+	}
+
+	vectorResults, err := s.searchVector(ctx, userID, query, k*2)
+	if err != nil {
+		log.Printf("Vector knowledge search failed, using full-text results: %v", err)
+		return truncateChunks(textResults, k), nil
+	}
+	return truncateChunks(fuseRankings(textResults, vectorResults), k), nil
+}
+
+// searchText ranks chunks matching any word of query. Prospect messages are
+// conversational, so requiring every word would miss most relevant chunks.
+func (s *KnowledgeService) searchText(ctx context.Context, userID, query string, limit int) ([]models.KnowledgeChunk, error) {
+	sqlQuery := `WITH q AS (
+				SELECT NULLIF(replace(plainto_tsquery('simple', $2)::text, '&', '|'), '')::tsquery AS query
+			  )
+			  SELECT c.id, c.document_id, d.title, c.content, ts_rank_cd(c.search_vector, q.query) AS score
+			  FROM knowledge_chunks c
+			  JOIN knowledge_documents d ON d.id = c.document_id, q
+			  WHERE c.user_id = $1 AND c.search_vector @@ q.query
+			  ORDER BY score DESC LIMIT $3`
+
+	return s.queryChunks(ctx, sqlQuery, userID, query, limit)
+}
+
+// searchVector ranks chunks by cosine similarity to the query embedding
+func (s *KnowledgeService) searchVector(ctx context.Context, userID, query string, limit int) ([]models.KnowledgeChunk, error) {
+	embeddings, err := s.embedder.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	if len(embeddings) == 0 {
+		return nil, fmt.Errorf("no embedding returned for query")
+	}
+
+	sqlQuery := `SELECT c.id, c.document_id, d.title, c.content, 1 - (c.embedding <=> $2::vector) AS score
+			  FROM knowledge_chunks c
+			  JOIN knowledge_documents d ON d.id = c.document_id
+			  WHERE c.user_id = $1 AND c.embedding IS NOT NULL
+			  ORDER BY c.embedding <=> $2::vector LIMIT $3`
+
+	return s.queryChunks(ctx, sqlQuery, userID, vectorLiteral(embeddings[0]), limit)
+}
+
+func (s *KnowledgeService) queryChunks(ctx context.Context, query string, args ...interface{}) ([]models.KnowledgeChunk, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chunks []models.KnowledgeChunk
+	for rows.Next() {
+		var chunk models.KnowledgeChunk
+		if err := rows.Scan(&chunk.ID, &chunk.DocumentID, &chunk.Title, &chunk.Content, &chunk.Score); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks, rows.Err()
+}
+
+// fuseRankings merges ranked result lists with reciprocal rank fusion, so
+// chunks found by both searches come first
+func fuseRankings(rankings ...[]models.KnowledgeChunk) []models.KnowledgeChunk {
+	scores := make(map[string]float64)
+	chunks := make(map[string]models.KnowledgeChunk)
+	var order []string
+
+	for _, ranking := range rankings {
+		for rank, chunk := range ranking {
+			if _, seen := chunks[chunk.ID]; !seen {
+				chunks[chunk.ID] = chunk
+				order = append(order, chunk.ID)
+			}
+			scores[chunk.ID] += 1 / float64(rrfK+rank+1)
+		}
+	}
+
+	fused := make([]models.KnowledgeChunk, 0, len(order))
+	for _, id := range order {
+		chunk := chunks[id]
+		chunk.Score = scores[id]
+		fused = append(fused, chunk)
+	}
+	sort.SliceStable(fused, func(i, j int) bool { return fused[i].Score > fused[j].Score })
+	return fused
+}
+
+func truncateChunks(chunks []models.KnowledgeChunk, k int) []models.KnowledgeChunk {
+	if len(chunks) > k {
+		return chunks[:k]
+	}
+	return chunks
+}
+
+// chunkText splits text into chunks of about maxLen characters at paragraph,
+// then sentence, then word boundaries, repeating the last overlap characters
+// of each chunk at the start of the next
+func chunkText(text string, maxLen, overlap int) []string {
+	var pieces []string
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		// Leave room for the overlap carried over from the previous chunk
+		pieces = append(pieces, splitLong(paragraph, maxLen-overlap-2)...)
+	}
+
+	var chunks []string
+	var current strings.Builder
+	// fresh is set once current holds text beyond the carried overlap
+	fresh := false
+	for _, piece := range pieces {
+		if fresh && current.Len()+len(piece)+2 > maxLen {
+			chunk := current.String()
+			chunks = append(chunks, chunk)
+
+			current.Reset()
+			current.WriteString(overlapTail(chunk, overlap))
+			fresh = false
+		}
+		if current.Len() > 0 {
+			current.WriteString("\n\n")
+		}
+		current.WriteString(piece)
+		fresh = true
+	}
+	if fresh {
+		chunks = append(chunks, current.String())
+	}
+	return chunks
+}
+
+// splitLong cuts a paragraph longer than maxLen at sentence or word boundaries
+func splitLong(paragraph string, maxLen int) []string {
+	var parts []string
+	for len(paragraph) > maxLen {
+		cut := lastSentenceEnd(paragraph[:maxLen])
+		if cut <= 0 {
+			cut = strings.LastIndexByte(paragraph[:maxLen], ' ')
+		}
+		if cut <= 0 {
+			cut = maxLen
+			// Don't split a multi-byte character
+			for cut > 0 && !isRuneStart(paragraph[cut]) {
+				cut--
+			}
+		}
+		parts = append(parts, strings.TrimSpace(paragraph[:cut]))
+		paragraph = strings.TrimSpace(paragraph[cut:])
+	}
+	if paragraph != "" {
+		parts = append(parts, paragraph)
+	}
+	return parts
+}
+
+// overlapTail returns about the last n characters of chunk, starting at a word
+func overlapTail(chunk string, n int) string {
+	if len(chunk) <= n {
+		return chunk
+	}
+	tail := chunk[len(chunk)-n:]
+	if i := strings.IndexByte(tail, ' '); i >= 0 {
+		tail = tail[i+1:]
+	}
+	return strings.TrimSpace(tail)
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// vectorLiteral formats an embedding as a pgvector literal
+func vectorLiteral(embedding []float32) string {
+	parts := make([]string, len(embedding))
+	for i, value := range embedding {
+		parts[i] = strconv.FormatFloat(float64(value), 'f', -1, 32)
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+// openAIEmbedder calls the embeddings endpoint of an OpenAI-compatible API
+type openAIEmbedder struct {
+	endpoint   string
+	apiKey     string
+	model      string
+	httpClient *http.Client
+}
+
+// NewOpenAIEmbedder returns an Embedder for an OpenAI-compatible API rooted at baseURL
+func NewOpenAIEmbedder(baseURL, apiKey, model string) Embedder {
+	return &openAIEmbedder{
+		endpoint:   strings.TrimRight(baseURL, "/") + "/embeddings",
+		apiKey:     apiKey,
+		model:      model,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (e *openAIEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	requestBody, err := json.Marshal(map[string]interface{}{
+		"model": e.model,
+		"input": texts,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.endpoint, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+e.apiKey)
+	}
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &llmStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var response struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+	if len(response.Data) != len(texts) {
+		return nil, fmt.Errorf("expected %d embeddings, got %d", len(texts), len(response.Data))
+	}
+
+	embeddings := make([][]float32, len(texts))
+	for _, item := range response.Data {
+		if item.Index < 0 || item.Index >= len(texts) {
+			return nil, fmt.Errorf("embedding index %d out of range", item.Index)
+		}
+		embeddings[item.Index] = item.Embedding
+	}
+	return embeddings, nil
+}
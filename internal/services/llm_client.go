@@ -0,0 +1,444 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"sparkle-concept-sync/internal/models"
+)
+
+// LLMClient is a chat completion backend
+type LLMClient interface {
+	// Complete returns the full reply to a chat request
+	Complete(ctx context.Context, request ChatRequest) (*ChatCompletion, error)
+	// Stream calls onDelta for every fragment of the reply as it is generated
+	// and returns the token usage once the reply is complete, when reported
+	Stream(ctx context.Context, request ChatRequest, onDelta func(string) error) (*models.AIUsage, error)
+}
+
+// ChatRequest is a backend independent chat completion request
+type ChatRequest struct {
+	Model    string
+	Messages []Message
+	// ResponseFormat requests schema constrained output from backends that support it
+	ResponseFormat *ResponseFormat
+	// Tools the model may call instead of answering
+	Tools []ToolDefinition
+}
+
+// ChatCompletion is the reply to a ChatRequest
+type ChatCompletion struct {
+	Content string
+	// ToolCalls are set when the model wants tools run before it answers
+	ToolCalls []ToolCall
+	Usage     *models.AIUsage
+}
+
+// LLMBackendConfig describes one backend in AI_BACKENDS
+type LLMBackendConfig struct {
+	// Type is "openrouter", "openai" (any OpenAI-compatible API) or "fake"
+	Type    string `json:"type"`
+	BaseURL string `json:"base_url"`
+	APIKey  string `json:"api_key"`
+}
+
+const (
+	openRouterBaseURL = "https://openrouter.ai/api/v1"
+	// OpenRouterBackend is the backend used when nothing else is configured
+	OpenRouterBackend = "openrouter"
+)
+
+type ChatCompletionRequest struct {
+	Model    string    `json:"model"`
+	Messages []Message `json:"messages"`
+	Stream   bool      `json:"stream,omitempty"`
+
+	ResponseFormat *ResponseFormat  `json:"response_format,omitempty"`
+	Tools          []ToolDefinition `json:"tools,omitempty"`
+	// Usage asks OpenRouter to report token usage at the end of a stream
+	Usage *UsageOption `json:"usage,omitempty"`
+	// StreamOptions is the OpenAI way of asking the same
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+}
+
+type UsageOption struct {
+	Include bool `json:"include"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// ToolCalls are the calls requested by an assistant message
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID links a tool message to the call it answers
+	ToolCallID string `json:"tool_call_id,omitempty"`
+}
+
+// ToolDefinition declares a function the model may call
+type ToolDefinition struct {
+	Type     string             `json:"type"`
+	Function FunctionDefinition `json:"function"`
+}
+
+type FunctionDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+// ToolCall is a function call requested by the model
+type ToolCall struct {
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name string `json:"name"`
+	// Arguments is a JSON object encoded as a string
+	Arguments string `json:"arguments"`
+}
+
+type ChatCompletionResponse struct {
+	Choices []Choice        `json:"choices"`
+	Usage   *models.AIUsage `json:"usage,omitempty"`
+	Error   *APIError       `json:"error,omitempty"`
+}
+
+type Choice struct {
+	Message Message `json:"message"`
+}
+
+type APIError struct {
+	Message string `json:"message"`
+	Code    string `json:"code"`
+}
+
+type chatCompletionChunk struct {
+	Choices []streamChoice  `json:"choices"`
+	Usage   *models.AIUsage `json:"usage,omitempty"`
+	Error   *APIError       `json:"error,omitempty"`
+}
+
+type streamChoice struct {
+	Delta Message `json:"delta"`
+}
+
+// llmStatusError is returned when a backend answers with a non-200 status
+type llmStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *llmStatusError) Error() string {
+	return fmt.Sprintf("API request failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+func (e *llmStatusError) HTTPStatus() int {
+	return e.StatusCode
+}
+
+// openAIClient talks to OpenRouter or any server implementing the OpenAI chat
+// completions API, such as vLLM or Ollama
+type openAIClient struct {
+	endpoint   string
+	apiKey     string
+	openRouter bool
+
+	httpClient   *http.Client
+	streamClient *http.Client
+}
+
+// NewOpenRouterClient returns a client for openrouter.ai
+func NewOpenRouterClient(apiKey string) LLMClient {
+	return newOpenAIClient(openRouterBaseURL, apiKey, true)
+}
+
+// NewOpenAICompatibleClient returns a client for an OpenAI-compatible API
+// rooted at baseURL, e.g. http://localhost:11434/v1 for Ollama
+func NewOpenAICompatibleClient(baseURL, apiKey string) LLMClient {
+	return newOpenAIClient(baseURL, apiKey, false)
+}
+
+func newOpenAIClient(baseURL, apiKey string, openRouter bool) *openAIClient {
+	return &openAIClient{
+		endpoint:   strings.TrimRight(baseURL, "/") + "/chat/completions",
+		apiKey:     apiKey,
+		openRouter: openRouter,
+		httpClient: &http.Client{
+			// Upper bound only; each attempt is bounded by its model's timeout
+			Timeout: 60 * time.Second,
+		},
+		// Streams can legitimately run long, they are bounded by an idle timeout instead
+		streamClient: &http.Client{},
+	}
+}
+
+func (c *openAIClient) Complete(ctx context.Context, request ChatRequest) (*ChatCompletion, error) {
+	req, err := c.newRequest(ctx, ChatCompletionRequest{
+		Model:          request.Model,
+		Messages:       request.Messages,
+		ResponseFormat: request.ResponseFormat,
+		Tools:          request.Tools,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &llmStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var response ChatCompletionResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %v", err)
+	}
+
+	if response.Error != nil {
+		return nil, fmt.Errorf("API error: %s", response.Error.Message)
+	}
+
+	if len(response.Choices) == 0 {
+		return nil, fmt.Errorf("no choices in response")
+	}
+
+	message := response.Choices[0].Message
+	return &ChatCompletion{Content: message.Content, ToolCalls: message.ToolCalls, Usage: response.Usage}, nil
+}
+
+func (c *openAIClient) Stream(ctx context.Context, request ChatRequest, onDelta func(string) error) (*models.AIUsage, error) {
+	body := ChatCompletionRequest{
+		Model:          request.Model,
+		Messages:       request.Messages,
+		ResponseFormat: request.ResponseFormat,
+		Stream:         true,
+	}
+	if c.openRouter {
+		body.Usage = &UsageOption{Include: true}
+	} else {
+		body.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
+
+	req, err := c.newRequest(ctx, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.streamClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &llmStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var usage *models.AIUsage
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		// Skip blank separators and keep-alive comments such as ": OPENROUTER PROCESSING"
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			return usage, nil
+		}
+
+		var chunk chatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			continue
+		}
+		if chunk.Error != nil {
+			return usage, fmt.Errorf("API error: %s", chunk.Error.Message)
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content == "" {
+				continue
+			}
+			if err := onDelta(choice.Delta.Content); err != nil {
+				return usage, err
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return usage, fmt.Errorf("failed to read stream: %w", err)
+	}
+
+	return usage, nil
+}
+
+func (c *openAIClient) newRequest(ctx context.Context, body ChatCompletionRequest) (*http.Request, error) {
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.endpoint, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	if c.openRouter {
+		req.Header.Set("HTTP-Referer", "https://sparkle-concept-sync.com")
+		req.Header.Set("X-Title", "Sparkle Concept Sync")
+	}
+
+	return req, nil
+}
+
+// FakeLLMClient is a deterministic backend for tests and demos. It echoes the
+// last user message, as a chatbot JSON reply from Complete and as plain text
+// from Stream, and counts one token per word.
+type FakeLLMClient struct {
+	// Reply overrides the generated reply when set
+	Reply func(request ChatRequest) string
+	// Completion overrides Complete when set, e.g. to call tools or fail
+	Completion func(request ChatRequest) (*ChatCompletion, error)
+}
+
+func NewFakeLLMClient() *FakeLLMClient {
+	return &FakeLLMClient{}
+}
+
+func (c *FakeLLMClient) Complete(ctx context.Context, request ChatRequest) (*ChatCompletion, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.Completion != nil {
+		return c.Completion(request)
+	}
+
+	content := c.reply(request, true)
+	return &ChatCompletion{Content: content, Usage: fakeUsage(request, content)}, nil
+}
+
+func (c *FakeLLMClient) Stream(ctx context.Context, request ChatRequest, onDelta func(string) error) (*models.AIUsage, error) {
+	content := c.reply(request, false)
+
+	for _, word := range strings.SplitAfter(content, " ") {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := onDelta(word); err != nil {
+			return nil, err
+		}
+	}
+	return fakeUsage(request, content), nil
+}
+
+func (c *FakeLLMClient) reply(request ChatRequest, structured bool) string {
+	if c.Reply != nil {
+		return c.Reply(request)
+	}
+
+	text := "Echo: " + lastUserMessage(request.Messages)
+	if !structured {
+		return text
+	}
+
+	reply, _ := json.Marshal(models.AIResponse{
+		Stage:    "General Response",
+		Response: []models.AIMessage{{Type: "text", Content: text}},
+	})
+	return string(reply)
+}
+
+// lastUserMessage returns the customer's words from the last user message,
+// without the flow context prepended by buildContextualPrompt
+func lastUserMessage(messages []Message) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role != "user" {
+			continue
+		}
+		content := messages[i].Content
+		if idx := strings.LastIndex(content, "User Message: "); idx >= 0 {
+			content = content[idx+len("User Message: "):]
+		}
+		return strings.TrimSpace(content)
+	}
+	return ""
+}
+
+func fakeUsage(request ChatRequest, content string) *models.AIUsage {
+	prompt := 0
+	for _, message := range request.Messages {
+		prompt += len(strings.Fields(message.Content))
+	}
+	completion := len(strings.Fields(content))
+
+	return &models.AIUsage{
+		PromptTokens:     prompt,
+		CompletionTokens: completion,
+		TotalTokens:      prompt + completion,
+	}
+}
+
+// ParseLLMBackends builds clients from a backend table such as
+// {"ollama":{"type":"openai","base_url":"http://localhost:11434/v1"}}
+func ParseLLMBackends(spec string) (map[string]LLMClient, error) {
+	var configs map[string]LLMBackendConfig
+	if err := json.Unmarshal([]byte(spec), &configs); err != nil {
+		return nil, fmt.Errorf("invalid LLM backends: %v", err)
+	}
+
+	clients := make(map[string]LLMClient, len(configs))
+	for name, config := range configs {
+		if name == "" || strings.Contains(name, ":") {
+			return nil, fmt.Errorf("invalid LLM backend name %q", name)
+		}
+
+		switch config.Type {
+		case "openrouter":
+			clients[name] = NewOpenRouterClient(config.APIKey)
+		case "openai":
+			if config.BaseURL == "" {
+				return nil, fmt.Errorf("LLM backend %s requires a base_url", name)
+			}
+			clients[name] = NewOpenAICompatibleClient(config.BaseURL, config.APIKey)
+		case "fake":
+			clients[name] = NewFakeLLMClient()
+		default:
+			return nil, fmt.Errorf("unknown type %q for LLM backend %s", config.Type, name)
+		}
+	}
+	return clients, nil
+}
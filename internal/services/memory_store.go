@@ -0,0 +1,603 @@
+package services
+
+import (
+	"container/list"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultMemoryEntries bounds the in-process fallback, least recently used
+// keys are evicted first. Locks and rate limits don't count, see pinned.
+const defaultMemoryEntries = 10000
+
+var errWrongType = fmt.Errorf("WRONGTYPE operation against a key holding the wrong kind of value")
+
+// memoryStore is an in-process stand-in for the Redis commands RedisService
+// uses, for when Redis is unreachable. It only serves this instance, so
+// limits and locks aren't shared while degraded.
+type memoryStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+	// pinned holds locks, rate limit logs and scheduled jobs, which are never
+	// evicted: dropping them would hand a held lock to someone else, reset a
+	// limit or lose a job. Expired ones are swept.
+	pinned *list.List
+}
+
+// memoryEntry holds a string, a list, a stream, a sorted set or the request
+// log of a rate limit
+type memoryEntry struct {
+	key       string
+	value     string
+	list      []string
+	stream    []redis.XMessage
+	scores    map[string]float64
+	hits      []time.Time
+	kind      string
+	expiresAt time.Time
+	pinned    bool
+}
+
+func newMemoryStore(maxEntries int) *memoryStore {
+	return &memoryStore{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		pinned:     list.New(),
+	}
+}
+
+// isPinned reports whether an entry must not be evicted
+func isPinned(key, kind string) bool {
+	return kind == "hits" || strings.HasPrefix(key, "lock:") || strings.HasPrefix(key, "scheduler:")
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+// get returns the live entry under key, marking it recently used
+func (m *memoryStore) get(key string) *memoryEntry {
+	element, ok := m.entries[key]
+	if !ok {
+		return nil
+	}
+
+	entry := element.Value.(*memoryEntry)
+	if entry.expired(time.Now()) {
+		m.remove(element)
+		return nil
+	}
+
+	m.listOf(entry).MoveToFront(element)
+	return entry
+}
+
+// put stores entry under its key, evicting the least recently used keys
+func (m *memoryStore) put(entry *memoryEntry) {
+	if element, ok := m.entries[entry.key]; ok {
+		m.remove(element)
+	}
+
+	entry.pinned = isPinned(entry.key, entry.kind)
+	m.entries[entry.key] = m.listOf(entry).PushFront(entry)
+	if entry.pinned {
+		m.sweepPinned()
+		return
+	}
+	for m.lru.Len() > m.maxEntries {
+		m.remove(m.lru.Back())
+	}
+}
+
+// sweepPinned drops expired pinned entries from the least recently used end,
+// up to the first live one
+func (m *memoryStore) sweepPinned() {
+	now := time.Now()
+	for element := m.pinned.Back(); element != nil && element.Value.(*memoryEntry).expired(now); element = m.pinned.Back() {
+		m.remove(element)
+	}
+}
+
+func (m *memoryStore) listOf(entry *memoryEntry) *list.List {
+	if entry.pinned {
+		return m.pinned
+	}
+	return m.lru
+}
+
+func (m *memoryStore) remove(element *list.Element) {
+	entry := element.Value.(*memoryEntry)
+	m.listOf(entry).Remove(element)
+	delete(m.entries, entry.key)
+}
+
+func expiry(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(ttl)
+}
+
+func (m *memoryStore) Set(key, value string, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.put(&memoryEntry{key: key, value: value, kind: "string", expiresAt: expiry(ttl)})
+}
+
+// SetNX stores value unless key exists and reports whether it did
+func (m *memoryStore) SetNX(key, value string, ttl time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.get(key) != nil {
+		return false
+	}
+	m.put(&memoryEntry{key: key, value: value, kind: "string", expiresAt: expiry(ttl)})
+	return true
+}
+
+// Get returns redis.Nil for missing keys, like the Redis client
+func (m *memoryStore) Get(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil {
+		return "", redis.Nil
+	}
+	if entry.kind != "string" {
+		return "", errWrongType
+	}
+	return entry.value, nil
+}
+
+func (m *memoryStore) Delete(keys ...string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted int64
+	for _, key := range keys {
+		if m.get(key) != nil {
+			m.remove(m.entries[key])
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// DeletePattern removes the keys matching a Redis glob pattern
+func (m *memoryStore) DeletePattern(pattern string) int64 {
+	matcher := globPattern(pattern)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted int64
+	for key, element := range m.entries {
+		if matcher.MatchString(key) {
+			m.remove(element)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (m *memoryStore) Exists(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.get(key) != nil
+}
+
+// Increment adds one to the integer under key, keeping its expiry
+func (m *memoryStore) Increment(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil {
+		m.put(&memoryEntry{key: key, value: "1", kind: "string"})
+		return 1, nil
+	}
+	if entry.kind != "string" {
+		return 0, errWrongType
+	}
+
+	n, err := strconv.ParseInt(entry.value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("value is not an integer")
+	}
+	n++
+	entry.value = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+// Expire sets the ttl of key and reports whether it exists
+func (m *memoryStore) Expire(key string, ttl time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil {
+		return false
+	}
+	entry.expiresAt = expiry(ttl)
+	return true
+}
+
+// TTL mirrors the Redis client: -2 for missing keys, -1 for keys without expiry
+func (m *memoryStore) TTL(key string) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil {
+		return -2
+	}
+	if entry.expiresAt.IsZero() {
+		return -1
+	}
+	return time.Until(entry.expiresAt).Truncate(time.Second)
+}
+
+func (m *memoryStore) LPush(key string, values ...interface{}) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil {
+		entry = &memoryEntry{key: key, kind: "list"}
+		m.put(entry)
+	}
+	if entry.kind != "list" {
+		return errWrongType
+	}
+
+	for _, value := range values {
+		entry.list = append([]string{fmt.Sprint(value)}, entry.list...)
+	}
+	return nil
+}
+
+func (m *memoryStore) RPop(key string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil {
+		return "", redis.Nil
+	}
+	if entry.kind != "list" {
+		return "", errWrongType
+	}
+	if len(entry.list) == 0 {
+		return "", redis.Nil
+	}
+
+	value := entry.list[len(entry.list)-1]
+	entry.list = entry.list[:len(entry.list)-1]
+	// Redis drops empty lists
+	if len(entry.list) == 0 {
+		m.remove(m.entries[key])
+	}
+	return value, nil
+}
+
+func (m *memoryStore) LLen(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil {
+		return 0, nil
+	}
+	if entry.kind != "list" {
+		return 0, errWrongType
+	}
+	return int64(len(entry.list)), nil
+}
+
+// ZAdd sets the score of member in the sorted set under key
+func (m *memoryStore) ZAdd(key, member string, score float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil {
+		entry = &memoryEntry{key: key, kind: "zset", scores: make(map[string]float64)}
+		m.put(entry)
+	}
+	if entry.kind != "zset" {
+		return errWrongType
+	}
+
+	entry.scores[member] = score
+	return nil
+}
+
+// ZRem removes member from the sorted set under key and reports whether it
+// was there
+func (m *memoryStore) ZRem(key, member string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil {
+		return false, nil
+	}
+	if entry.kind != "zset" {
+		return false, errWrongType
+	}
+
+	if _, ok := entry.scores[member]; !ok {
+		return false, nil
+	}
+	delete(entry.scores, member)
+	// Redis drops empty sets
+	if len(entry.scores) == 0 {
+		m.remove(m.entries[key])
+	}
+	return true, nil
+}
+
+// ZPopByScore removes and returns up to count members scored at most max,
+// lowest first, like popByScoreScript. A count of 0 returns them all.
+func (m *memoryStore) ZPopByScore(key string, max float64, count int64) ([]redis.Z, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil {
+		return nil, nil
+	}
+	if entry.kind != "zset" {
+		return nil, errWrongType
+	}
+
+	var due []redis.Z
+	for member, score := range entry.scores {
+		if score <= max {
+			due = append(due, redis.Z{Score: score, Member: member})
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].Score != due[j].Score {
+			return due[i].Score < due[j].Score
+		}
+		return due[i].Member.(string) < due[j].Member.(string)
+	})
+	if count > 0 && int64(len(due)) > count {
+		due = due[:count]
+	}
+
+	for _, z := range due {
+		delete(entry.scores, z.Member.(string))
+	}
+	if len(entry.scores) == 0 {
+		m.remove(m.entries[key])
+	}
+	return due, nil
+}
+
+// RateLimit is the sliding window log of rateLimitScript
+func (m *memoryStore) RateLimit(key string, limit int, window time.Duration) (*RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	entry := m.get(key)
+	if entry == nil {
+		entry = &memoryEntry{key: key, kind: "hits"}
+		m.put(entry)
+	}
+	if entry.kind != "hits" {
+		return nil, errWrongType
+	}
+
+	cutoff := now.Add(-window)
+	kept := entry.hits[:0]
+	for _, hit := range entry.hits {
+		if hit.After(cutoff) {
+			kept = append(kept, hit)
+		}
+	}
+	entry.hits = kept
+
+	allowed := len(entry.hits) < limit
+	if allowed {
+		entry.hits = append(entry.hits, now)
+	}
+	entry.expiresAt = now.Add(window)
+
+	resetAt := now.Add(window)
+	if len(entry.hits) > 0 {
+		resetAt = entry.hits[0].Add(window)
+	}
+
+	return &RateLimitResult{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: limit - len(entry.hits),
+		ResetAt:   resetAt,
+	}, nil
+}
+
+// XAdd appends values to the stream under key, keeping its newest maxLen
+// entries, and returns the entry ID. IDs are "<ms>-<seq>" like Redis'.
+func (m *memoryStore) XAdd(key string, values map[string]interface{}, maxLen int64) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil {
+		entry = &memoryEntry{key: key, kind: "stream"}
+		m.put(entry)
+	}
+	if entry.kind != "stream" {
+		return "", errWrongType
+	}
+
+	ms, seq := time.Now().UnixMilli(), int64(0)
+	if n := len(entry.stream); n > 0 {
+		lastMs, lastSeq, _ := parseStreamID(entry.stream[n-1].ID)
+		if ms <= lastMs {
+			ms, seq = lastMs, lastSeq+1
+		}
+	}
+
+	id := fmt.Sprintf("%d-%d", ms, seq)
+	entry.stream = append(entry.stream, redis.XMessage{ID: id, Values: values})
+	if maxLen > 0 && int64(len(entry.stream)) > maxLen {
+		entry.stream = entry.stream[int64(len(entry.stream))-maxLen:]
+	}
+	return id, nil
+}
+
+// XRangeAfter returns up to count entries of the stream under key with IDs
+// after afterID
+func (m *memoryStore) XRangeAfter(key, afterID string, count int64) ([]redis.XMessage, error) {
+	afterMs, afterSeq, ok := parseStreamID(afterID)
+	if !ok {
+		return nil, fmt.Errorf("invalid stream ID %q", afterID)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil {
+		return nil, nil
+	}
+	if entry.kind != "stream" {
+		return nil, errWrongType
+	}
+
+	var entries []redis.XMessage
+	for _, message := range entry.stream {
+		ms, seq, _ := parseStreamID(message.ID)
+		if ms < afterMs || (ms == afterMs && seq <= afterSeq) {
+			continue
+		}
+		entries = append(entries, message)
+		if count > 0 && int64(len(entries)) == count {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// parseStreamID splits a stream entry ID, a bare "<ms>" counts as "<ms>-0"
+func parseStreamID(id string) (ms, seq int64, ok bool) {
+	msPart, seqPart, hasSeq := strings.Cut(id, "-")
+	ms, err := strconv.ParseInt(msPart, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if hasSeq {
+		if seq, err = strconv.ParseInt(seqPart, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	return ms, seq, true
+}
+
+// streamIDAfter reports whether stream entry ID a comes after b
+func streamIDAfter(a, b string) bool {
+	aMs, aSeq, _ := parseStreamID(a)
+	bMs, bSeq, _ := parseStreamID(b)
+	return aMs > bMs || (aMs == bMs && aSeq > bSeq)
+}
+
+// CompareAndDelete deletes key if it holds value, like releaseLockScript
+func (m *memoryStore) CompareAndDelete(key, value string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil || entry.kind != "string" || entry.value != value {
+		return false
+	}
+	m.remove(m.entries[key])
+	return true
+}
+
+// CompareAndExpire sets the ttl of key if it holds value, like refreshLockScript
+func (m *memoryStore) CompareAndExpire(key, value string, ttl time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry := m.get(key)
+	if entry == nil || entry.kind != "string" || entry.value != value {
+		return false
+	}
+	entry.expiresAt = expiry(ttl)
+	return true
+}
+
+func (m *memoryStore) Flush() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries = make(map[string]*list.Element)
+	m.lru.Init()
+	m.pinned.Init()
+}
+
+// globPattern translates a Redis glob pattern (*, ?, [...] and \ escapes)
+// into an anchored regular expression
+func globPattern(pattern string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "^") {
+				class = "^" + regexp.QuoteMeta(class[1:])
+			} else {
+				class = regexp.QuoteMeta(class)
+			}
+			b.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+
+	matcher, err := regexp.Compile(b.String())
+	if err != nil {
+		// A malformed class matches nothing rather than everything
+		return regexp.MustCompile(`[^\s\S]`)
+	}
+	return matcher
+}
@@ -0,0 +1,274 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestMemoryStoreGetSetExpiry(t *testing.T) {
+	m := newMemoryStore(10)
+
+	if _, err := m.Get("missing"); !errors.Is(err, redis.Nil) {
+		t.Fatalf("Get(missing) error = %v, want redis.Nil", err)
+	}
+
+	m.Set("key", "value", 0)
+	if value, err := m.Get("key"); err != nil || value != "value" {
+		t.Fatalf("Get(key) = %q, %v", value, err)
+	}
+	if ttl := m.TTL("key"); ttl != -1 {
+		t.Fatalf("TTL without expiry = %v, want -1", ttl)
+	}
+
+	m.Set("short", "value", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if m.Exists("short") {
+		t.Fatal("expired key still exists")
+	}
+	if ttl := m.TTL("short"); ttl != -2 {
+		t.Fatalf("TTL of expired key = %v, want -2", ttl)
+	}
+}
+
+func TestMemoryStoreSetNX(t *testing.T) {
+	m := newMemoryStore(10)
+
+	if !m.SetNX("key", "a", time.Minute) {
+		t.Fatal("first SetNX failed")
+	}
+	if m.SetNX("key", "b", time.Minute) {
+		t.Fatal("second SetNX overwrote the key")
+	}
+	if value, _ := m.Get("key"); value != "a" {
+		t.Fatalf("Get(key) = %q, want a", value)
+	}
+}
+
+func TestMemoryStoreWrongType(t *testing.T) {
+	m := newMemoryStore(10)
+	m.Set("key", "value", 0)
+
+	if err := m.LPush("key", "x"); !errors.Is(err, errWrongType) {
+		t.Fatalf("LPush on string error = %v, want errWrongType", err)
+	}
+	if _, err := m.RateLimit("key", 1, time.Minute); !errors.Is(err, errWrongType) {
+		t.Fatalf("RateLimit on string error = %v, want errWrongType", err)
+	}
+}
+
+func TestMemoryStoreLists(t *testing.T) {
+	m := newMemoryStore(10)
+
+	if err := m.LPush("empty"); err != nil {
+		t.Fatalf("LPush without values: %v", err)
+	}
+	if m.Exists("empty") {
+		t.Fatal("LPush without values created the key")
+	}
+	if _, err := m.RPop("empty"); !errors.Is(err, redis.Nil) {
+		t.Fatalf("RPop(empty) error = %v, want redis.Nil", err)
+	}
+
+	if err := m.LPush("queue", "a", "b", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := m.LLen("queue"); n != 3 {
+		t.Fatalf("LLen = %d, want 3", n)
+	}
+	for _, want := range []string{"a", "b", "c"} {
+		value, err := m.RPop("queue")
+		if err != nil || value != want {
+			t.Fatalf("RPop = %q, %v, want %q", value, err, want)
+		}
+	}
+	if m.Exists("queue") {
+		t.Fatal("drained list still exists")
+	}
+}
+
+func TestMemoryStoreRPopGuardsEmptyList(t *testing.T) {
+	m := newMemoryStore(10)
+	m.put(&memoryEntry{key: "queue", kind: "list"})
+
+	if _, err := m.RPop("queue"); !errors.Is(err, redis.Nil) {
+		t.Fatalf("RPop of empty list error = %v, want redis.Nil", err)
+	}
+}
+
+func TestMemoryStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	m := newMemoryStore(2)
+
+	m.Set("a", "1", 0)
+	m.Set("b", "2", 0)
+	m.Get("a")
+	m.Set("c", "3", 0)
+
+	if m.Exists("b") {
+		t.Fatal("least recently used key b wasn't evicted")
+	}
+	if !m.Exists("a") || !m.Exists("c") {
+		t.Fatal("recently used keys were evicted")
+	}
+}
+
+func TestMemoryStoreNeverEvictsLocksOrRateLimits(t *testing.T) {
+	m := newMemoryStore(2)
+
+	if !m.SetNX("lock:flow:1", "token", time.Minute) {
+		t.Fatal("SetNX failed")
+	}
+	if _, err := m.RateLimit("ratelimit:ip:1", 1, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		m.Set(fmt.Sprintf("cache:%d", i), "x", 0)
+	}
+
+	if value, _ := m.Get("lock:flow:1"); value != "token" {
+		t.Fatal("lock was evicted by cache writes")
+	}
+	result, err := m.RateLimit("ratelimit:ip:1", 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed {
+		t.Fatal("rate limit was reset by cache writes")
+	}
+	if m.lru.Len() != 2 {
+		t.Fatalf("evictable entries = %d, want 2", m.lru.Len())
+	}
+}
+
+func TestMemoryStoreSweepsExpiredPinnedEntries(t *testing.T) {
+	m := newMemoryStore(10)
+
+	m.SetNX("lock:old", "token", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	m.SetNX("lock:new", "token", time.Minute)
+
+	if _, ok := m.entries["lock:old"]; ok {
+		t.Fatal("expired lock wasn't swept")
+	}
+	if m.pinned.Len() != 1 {
+		t.Fatalf("pinned entries = %d, want 1", m.pinned.Len())
+	}
+}
+
+func TestMemoryStoreRateLimit(t *testing.T) {
+	m := newMemoryStore(10)
+
+	for i := 0; i < 3; i++ {
+		result, err := m.RateLimit("key", 3, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed || result.Remaining != 2-i {
+			t.Fatalf("request %d: allowed=%v remaining=%d", i, result.Allowed, result.Remaining)
+		}
+	}
+
+	result, _ := m.RateLimit("key", 3, time.Minute)
+	if result.Allowed || result.Remaining != 0 {
+		t.Fatalf("over limit: allowed=%v remaining=%d", result.Allowed, result.Remaining)
+	}
+
+	window := 20 * time.Millisecond
+	m.RateLimit("slide", 1, window)
+	if result, _ := m.RateLimit("slide", 1, window); result.Allowed {
+		t.Fatal("second request in window allowed")
+	}
+	time.Sleep(2 * window)
+	if result, _ := m.RateLimit("slide", 1, window); !result.Allowed {
+		t.Fatal("request after window slid was rejected")
+	}
+}
+
+func TestMemoryStoreCompareAndDelete(t *testing.T) {
+	m := newMemoryStore(10)
+	m.SetNX("lock:key", "mine", time.Minute)
+
+	if m.CompareAndDelete("lock:key", "theirs") {
+		t.Fatal("deleted a lock held by another token")
+	}
+	if m.CompareAndExpire("lock:key", "theirs", time.Hour) {
+		t.Fatal("extended a lock held by another token")
+	}
+	if !m.CompareAndExpire("lock:key", "mine", time.Hour) {
+		t.Fatal("couldn't extend own lock")
+	}
+	if !m.CompareAndDelete("lock:key", "mine") {
+		t.Fatal("couldn't release own lock")
+	}
+	if m.Exists("lock:key") {
+		t.Fatal("released lock still exists")
+	}
+}
+
+func TestMemoryStoreStreams(t *testing.T) {
+	m := newMemoryStore(10)
+
+	var ids []string
+	for i := 0; i < 4; i++ {
+		id, err := m.XAdd("stream", map[string]interface{}{"n": i}, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) > 0 && !streamIDAfter(id, ids[len(ids)-1]) {
+			t.Fatalf("ID %s doesn't follow %s", id, ids[len(ids)-1])
+		}
+		ids = append(ids, id)
+	}
+
+	entries, err := m.XRangeAfter("stream", "0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].ID != ids[1] {
+		t.Fatalf("stream wasn't trimmed to its newest 3 entries: %v", entries)
+	}
+
+	entries, _ = m.XRangeAfter("stream", ids[2], 0)
+	if len(entries) != 1 || entries[0].ID != ids[3] {
+		t.Fatalf("XRangeAfter(%s) = %v", ids[2], entries)
+	}
+}
+
+func TestMemoryStoreDeletePattern(t *testing.T) {
+	m := newMemoryStore(10)
+	m.Set("session:a", "1", 0)
+	m.Set("session:b", "1", 0)
+	m.Set("flow_execution:a", "1", 0)
+
+	if n := m.DeletePattern("session:*"); n != 2 {
+		t.Fatalf("DeletePattern = %d, want 2", n)
+	}
+	if !m.Exists("flow_execution:a") {
+		t.Fatal("DeletePattern removed a key outside the pattern")
+	}
+}
+
+func TestGlobPattern(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"flow_execution*", "flow_execution:1", true},
+		{"session:?", "session:a", true},
+		{"session:?", "session:ab", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+		{"a.b", "axb", false},
+	}
+
+	for _, tt := range tests {
+		if got := globPattern(tt.pattern).MatchString(tt.key); got != tt.match {
+			t.Errorf("globPattern(%q) on %q = %v, want %v", tt.pattern, tt.key, got, tt.match)
+		}
+	}
+}
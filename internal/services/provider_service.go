@@ -1,24 +1,257 @@
 package services
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
 	"sparkle-concept-sync/internal/models"
 )
 
 type ProviderService struct {
-	// Add provider-specific configurations
+	deviceService    *DeviceSettingsService
+	breakers         *CircuitBreakerRegistry
+	scheduler        *SchedulerService
+	websocketService *WebSocketService
+	providers        map[string]whatsAppProvider
 }
 
-func NewProviderService() *ProviderService {
-	return &ProviderService{}
+// ResponseResult summarizes what ExecuteResponse did with an AI response
+type ResponseResult struct {
+	Sent []models.AIMessage `json:"sent"`
+	// RoutingHints holds the content of condition messages for the flow engine
+	RoutingHints []string `json:"routing_hints,omitempty"`
+}
+
+// StreamFunc produces a reply incrementally, calling onMessage for every
+// complete message and returning the full response once done
+type StreamFunc func(onMessage func(models.AIMessage) error) (*models.AIResponse, error)
+
+const (
+	sendTimeout = 15 * time.Second
+	// maxMessageDelay caps delays requested by the model
+	maxMessageDelay = time.Minute
+)
+
+func NewProviderService(deviceService *DeviceSettingsService, breakers *CircuitBreakerRegistry, scheduler *SchedulerService, websocketService *WebSocketService) *ProviderService {
+	httpClient := &http.Client{
+		Timeout: sendTimeout,
+	}
+
+	return &ProviderService{
+		deviceService:    deviceService,
+		breakers:         breakers,
+		scheduler:        scheduler,
+		websocketService: websocketService,
+		providers: map[string]whatsAppProvider{
+			"wablas":    &wablasProvider{httpClient: httpClient},
+			"whacenter": &whacenterProvider{httpClient: httpClient},
+			"waha":      &wahaProvider{httpClient: httpClient},
+		},
+	}
 }
 
 // SendMessage sends a message via the appropriate WhatsApp provider
 func (s *ProviderService) SendMessage(deviceID, to string, response *models.AIResponse) error {
-	// This would implement actual message sending logic
-	// for different providers (Wablas, Whacenter, WAHA)
+	_, err := s.ExecuteResponse(context.Background(), deviceID, to, response)
+	return err
+}
+
+// ExecuteResponse performs every message of an AI response in order: text and
+// media are sent, delay pauses before the next message and condition is
+// returned as a routing hint. Unknown types are logged and dropped.
+func (s *ProviderService) ExecuteResponse(ctx context.Context, deviceID, to string, response *models.AIResponse) (*ResponseResult, error) {
+	result := &ResponseResult{}
+
+	for _, message := range response.Response {
+		sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+		var err error
+		sent := false
+
+		switch message.Type {
+		case "text":
+			err = s.SendText(sendCtx, deviceID, to, message.Content)
+			sent = true
+		case "image", "audio", "video":
+			err = s.SendMedia(sendCtx, deviceID, to, message.Type, strings.TrimSpace(message.Content), "")
+			sent = true
+		case "delay":
+			err = s.scheduler.Wait(ctx, "reply:"+conversationKey(deviceID, to), parseMessageDelay(message.Content))
+		case "condition":
+			result.RoutingHints = append(result.RoutingHints, strings.TrimSpace(message.Content))
+		default:
+			log.Printf("Dropping AI message with unknown type %q for %s", message.Type, to)
+		}
+		cancel()
+
+		if err != nil {
+			return result, fmt.Errorf("failed to execute %s message: %w", message.Type, err)
+		}
+		if sent {
+			result.Sent = append(result.Sent, message)
+		}
+	}
+
+	return result, nil
+}
+
+// SendMedia sends an image, audio or video by URL through the device's provider
+func (s *ProviderService) SendMedia(ctx context.Context, deviceID, to, mediaType, mediaURL, caption string) error {
+	device, provider, err := s.resolve(deviceID)
+	if err != nil {
+		return err
+	}
+
+	return s.call(device, deviceID, func() error {
+		return provider.SendMedia(ctx, device, to, mediaType, mediaURL, caption)
+	})
+}
+
+// SendText sends a single text message through the device's provider
+func (s *ProviderService) SendText(ctx context.Context, deviceID, to, text string) error {
+	device, provider, err := s.resolve(deviceID)
+	if err != nil {
+		return err
+	}
+
+	// Each provider instance gets its own breaker so one dead device
+	// doesn't slow down delivery for the others
+	return s.call(device, deviceID, func() error {
+		return provider.SendText(ctx, device, to, text)
+	})
+}
+
+// SetTyping shows or hides the typing indicator on providers that support it.
+// It is a no-op for providers without typing support.
+func (s *ProviderService) SetTyping(ctx context.Context, deviceID, to string, typing bool) error {
+	device, provider, err := s.resolve(deviceID)
+	if err != nil {
+		return err
+	}
+
+	typer, ok := provider.(typingProvider)
+	if !ok {
+		return nil
+	}
+
+	if typing {
+		return typer.StartTyping(ctx, device, to)
+	}
+	return typer.StopTyping(ctx, device, to)
+}
+
+// DeliverStream sends each message produced by stream as soon as it is
+// complete, keeping the typing indicator on while more text is generated
+func (s *ProviderService) DeliverStream(ctx context.Context, deviceID, to string, stream StreamFunc) (*models.AIResponse, error) {
+	s.setTypingQuietly(ctx, deviceID, to, true)
+	defer s.setTypingQuietly(context.Background(), deviceID, to, false)
+
+	return stream(func(message models.AIMessage) error {
+		if message.Type != "text" {
+			return nil
+		}
+		if err := s.SendText(ctx, deviceID, to, message.Content); err != nil {
+			return err
+		}
+
+		// Sending a message clears the indicator, the model may still be writing
+		s.setTypingQuietly(ctx, deviceID, to, true)
+		return nil
+	})
+}
+
+// setTypingQuietly updates the typing indicator, logging instead of failing
+// since the indicator is purely cosmetic
+func (s *ProviderService) setTypingQuietly(ctx context.Context, deviceID, to string, typing bool) {
+	if err := s.SetTyping(ctx, deviceID, to, typing); err != nil {
+		log.Printf("Failed to update typing indicator for %s via device %s: %v", to, deviceID, err)
+	}
+}
+
+// conversationKey identifies a conversation for scheduled work
+func conversationKey(deviceID, prospectNum string) string {
+	return deviceID + ":" + prospectNum
+}
+
+// splitConversationKey reverses conversationKey, prospect numbers never
+// contain ":"
+func splitConversationKey(key string) (deviceID, prospectNum string) {
+	i := strings.LastIndex(key, ":")
+	if i < 0 {
+		return "", key
+	}
+	return key[:i], key[i+1:]
+}
+
+// parseMessageDelay reads a delay such as "3", "2.5" or "3s", in seconds by default
+func parseMessageDelay(content string) time.Duration {
+	content = strings.TrimSpace(content)
+
+	delay, err := time.ParseDuration(content)
+	if err != nil {
+		seconds, err := strconv.ParseFloat(content, 64)
+		if err != nil {
+			log.Printf("Invalid delay %q, skipping", content)
+			return 0
+		}
+		delay = time.Duration(seconds * float64(time.Second))
+	}
+
+	if delay < 0 {
+		return 0
+	}
+	if delay > maxMessageDelay {
+		return maxMessageDelay
+	}
+	return delay
+}
+
+// call runs a send through the device's circuit breaker and tells the
+// device's owner when the device goes offline or comes back
+func (s *ProviderService) call(device *models.DeviceSetting, deviceID string, send func() error) error {
+	breaker := s.breakers.Get("provider:" + deviceID)
+	before := deviceStatus(breaker.State())
+	err := breaker.Call(send)
+
+	if after := deviceStatus(breaker.State()); after != before && s.websocketService != nil && device.UserID != nil {
+		event := models.DeviceStatusChangedEvent{DeviceID: deviceID, Status: after}
+		if err != nil {
+			event.Error = err.Error()
+		}
+		s.websocketService.Broadcast(models.WebSocketMessage{
+			Type:     models.EventDeviceStatusChanged,
+			UserID:   *device.UserID,
+			DeviceID: deviceID,
+			Data:     event,
+		})
+	}
+	return err
+}
+
+// deviceStatus maps a provider breaker to a device status, a half-open
+// breaker is still offline until a send gets through
+func deviceStatus(state BreakerState) string {
+	if state == BreakerClosed {
+		return models.DeviceOnline
+	}
+	return models.DeviceOffline
+}
+
+// resolve loads the device and the provider client it is configured for
+func (s *ProviderService) resolve(deviceID string) (*models.DeviceSetting, whatsAppProvider, error) {
+	device, err := s.deviceService.GetDeviceByIDDevice(deviceID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("device %s not found: %v", deviceID, err)
+	}
 
-	// For now, just log the message
-	// log.Printf("Sending message to %s via device %s: %+v", to, deviceID, response)
+	provider, ok := s.providers[device.Provider]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported provider %q for device %s", device.Provider, deviceID)
+	}
 
-	return nil
+	return device, provider, nil
 }
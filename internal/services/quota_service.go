@@ -0,0 +1,290 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"sparkle-concept-sync/internal/models"
+)
+
+// PlanQuota is a monthly AI allowance. Zero means unlimited.
+type PlanQuota struct {
+	Messages int64 `json:"messages"`
+	Tokens   int64 `json:"tokens"`
+}
+
+// QuotaAction is what the flow engine does once a user's quota is exhausted
+type QuotaAction string
+
+const (
+	// QuotaActionFallback sends a canned message instead of an AI reply
+	QuotaActionFallback QuotaAction = "fallback"
+	// QuotaActionHandoff hands the conversation over to a human agent
+	QuotaActionHandoff QuotaAction = "handoff"
+	// QuotaActionSilence doesn't reply at all
+	QuotaActionSilence QuotaAction = "silence"
+)
+
+// QuotaStatus is a user's AI consumption against the plans bought this period
+type QuotaStatus struct {
+	Period       string    `json:"period"`
+	Allowance    PlanQuota `json:"allowance"`
+	UsedMessages int64     `json:"used_messages"`
+	UsedTokens   int64     `json:"used_tokens"`
+	// Usage is the highest of the message and token usage ratios
+	Usage float64 `json:"usage"`
+	// SoftLimited is set past the allowance, replies keep going up to the hard limit
+	SoftLimited bool `json:"soft_limited"`
+	Exhausted   bool `json:"exhausted"`
+}
+
+const (
+	// planDuration is how long a successful order grants its allowance
+	planDuration = 30 * 24 * time.Hour
+	// quotaWarningRatio triggers the quota_warning event
+	quotaWarningRatio = 0.8
+	// defaultHardLimitRatio lets usage overshoot the allowance by 10% before
+	// replies stop, so a conversation isn't cut off mid-way
+	defaultHardLimitRatio = 1.1
+	quotaEventTTL         = 32 * 24 * time.Hour
+	freePlan              = "free"
+	defaultQuotaFallback  = "Thank you for your message, our team will get back to you shortly."
+)
+
+// DefaultFreeQuota applies to users without an active plan
+var DefaultFreeQuota = PlanQuota{Messages: 100, Tokens: 100000}
+
+type QuotaService struct {
+	db               *sql.DB
+	redisService     *RedisService
+	websocketService *WebSocketService
+
+	mu              sync.RWMutex
+	plans           map[string]PlanQuota
+	freeQuota       PlanQuota
+	hardLimitRatio  float64
+	action          QuotaAction
+	fallbackMessage string
+}
+
+func NewQuotaService(db *sql.DB, redisService *RedisService, websocketService *WebSocketService) *QuotaService {
+	return &QuotaService{
+		db:               db,
+		redisService:     redisService,
+		websocketService: websocketService,
+		plans:            make(map[string]PlanQuota),
+		freeQuota:        DefaultFreeQuota,
+		hardLimitRatio:   defaultHardLimitRatio,
+		action:           QuotaActionFallback,
+		fallbackMessage:  defaultQuotaFallback,
+	}
+}
+
+// SetPlans sets the allowance granted by each order product. The "free"
+// entry, when present, replaces the allowance of users without a plan.
+func (s *QuotaService) SetPlans(plans map[string]PlanQuota) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.plans = plans
+	if free, ok := plans[freePlan]; ok {
+		s.freeQuota = free
+	}
+}
+
+// SetHardLimitRatio sets how far past the allowance replies are still
+// generated, e.g. 1.1 for 10%. Ratios below 1 are ignored.
+func (s *QuotaService) SetHardLimitRatio(ratio float64) {
+	if ratio < 1 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hardLimitRatio = ratio
+}
+
+// SetExhaustedAction sets the behavior once the hard limit is reached and the
+// canned message used by QuotaActionFallback
+func (s *QuotaService) SetExhaustedAction(action QuotaAction, fallbackMessage string) error {
+	switch action {
+	case QuotaActionFallback, QuotaActionHandoff, QuotaActionSilence:
+	default:
+		return fmt.Errorf("unknown quota action %q", action)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.action = action
+	if fallbackMessage != "" {
+		s.fallbackMessage = fallbackMessage
+	}
+	return nil
+}
+
+// ExhaustedAction returns the configured behavior and fallback message
+func (s *QuotaService) ExhaustedAction() (QuotaAction, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.action, s.fallbackMessage
+}
+
+// ParsePlanQuotas reads a product allowance table such as
+// {"Pro":{"messages":5000,"tokens":5000000}}
+func ParsePlanQuotas(spec string) (map[string]PlanQuota, error) {
+	var plans map[string]PlanQuota
+	if err := json.Unmarshal([]byte(spec), &plans); err != nil {
+		return nil, fmt.Errorf("invalid plan quotas: %v", err)
+	}
+	return plans, nil
+}
+
+// GetQuotaStatus compares the user's usage this month with the allowance of
+// their active plans. Plans bought together add up.
+func (s *QuotaService) GetQuotaStatus(userID string) (*QuotaStatus, error) {
+	now := time.Now().UTC()
+	periodStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	allowance, err := s.allowance(userID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &QuotaStatus{
+		Period:    periodStart.Format("2006-01"),
+		Allowance: allowance,
+	}
+
+	query := `SELECT COUNT(*), COALESCE(SUM(total_tokens), 0) FROM ai_usage WHERE user_id = $1 AND created_at >= $2`
+	if err := s.db.QueryRow(query, userID, periodStart).Scan(&status.UsedMessages, &status.UsedTokens); err != nil {
+		return nil, fmt.Errorf("failed to load AI usage: %v", err)
+	}
+
+	status.Usage = usageRatio(status.UsedMessages, allowance.Messages)
+	if ratio := usageRatio(status.UsedTokens, allowance.Tokens); ratio > status.Usage {
+		status.Usage = ratio
+	}
+
+	s.mu.RLock()
+	hardLimitRatio := s.hardLimitRatio
+	s.mu.RUnlock()
+
+	status.SoftLimited = status.Usage >= 1
+	status.Exhausted = status.Usage >= hardLimitRatio
+	return status, nil
+}
+
+// CheckQuota returns the user's quota status before an AI reply and notifies
+// the dashboard the first time a threshold is crossed in the period
+func (s *QuotaService) CheckQuota(ctx context.Context, userID string) (*QuotaStatus, error) {
+	status, err := s.GetQuotaStatus(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case status.Exhausted:
+		s.notify(ctx, userID, models.EventQuotaExhausted, status)
+	case status.SoftLimited:
+		s.notify(ctx, userID, models.EventQuotaSoftLimit, status)
+	case status.Usage >= quotaWarningRatio:
+		s.notify(ctx, userID, models.EventQuotaWarning, status)
+	}
+
+	return status, nil
+}
+
+// allowance sums the quotas of the plans bought within planDuration, falling
+// back to the free quota without one. Orders the create_order tool wrote here
+// before prospect_orders existed are the tenant's customers', not plans.
+func (s *QuotaService) allowance(userID string, now time.Time) (PlanQuota, error) {
+	query := `SELECT product FROM orders WHERE user_id = $1 AND status = 'Success' AND created_at >= $2 AND method IS DISTINCT FROM 'whatsapp'`
+
+	rows, err := s.db.Query(query, userID, now.Add(-planDuration))
+	if err != nil {
+		return PlanQuota{}, fmt.Errorf("failed to load orders: %v", err)
+	}
+	defer rows.Close()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var total PlanQuota
+	active := false
+	for rows.Next() {
+		var product string
+		if err := rows.Scan(&product); err != nil {
+			return PlanQuota{}, err
+		}
+
+		plan, ok := s.plans[product]
+		if !ok {
+			if _, seen := unknownPlans.LoadOrStore(product, true); !seen {
+				log.Printf("No AI quota configured for product %q, ignoring its orders", product)
+			}
+			continue
+		}
+
+		// An unlimited plan stays unlimited whatever else was bought
+		if active && (total.Messages == 0 || plan.Messages == 0) {
+			total.Messages = 0
+		} else {
+			total.Messages += plan.Messages
+		}
+		if active && (total.Tokens == 0 || plan.Tokens == 0) {
+			total.Tokens = 0
+		} else {
+			total.Tokens += plan.Tokens
+		}
+		active = true
+	}
+	if err := rows.Err(); err != nil {
+		return PlanQuota{}, err
+	}
+
+	if !active {
+		return s.freeQuota, nil
+	}
+	return total, nil
+}
+
+var unknownPlans sync.Map
+
+// notify broadcasts a quota event once per user, period and event type
+func (s *QuotaService) notify(ctx context.Context, userID, eventType string, status *QuotaStatus) {
+	key := fmt.Sprintf("quota_event:%s:%s:%s", userID, status.Period, eventType)
+	first, err := s.redisService.SetNX(ctx, key, "1", quotaEventTTL)
+	if err != nil || !first {
+		return
+	}
+
+	if s.websocketService == nil {
+		return
+	}
+	s.websocketService.Broadcast(models.WebSocketMessage{
+		Type:   eventType,
+		UserID: userID,
+		Data: models.QuotaEvent{
+			Period:       status.Period,
+			Usage:        status.Usage,
+			UsedMessages: status.UsedMessages,
+			UsedTokens:   status.UsedTokens,
+			Allowance:    models.QuotaAllowance(status.Allowance),
+		},
+	})
+}
+
+func usageRatio(used, allowed int64) float64 {
+	if allowed <= 0 {
+		return 0
+	}
+	return float64(used) / float64(allowed)
+}
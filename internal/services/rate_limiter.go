@@ -0,0 +1,169 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned when a request exceeds its rate limit
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// RateLimitTier names what a limit is counted against
+type RateLimitTier string
+
+const (
+	RateLimitUser     RateLimitTier = "user"
+	RateLimitDevice   RateLimitTier = "device"
+	RateLimitProspect RateLimitTier = "prospect"
+	RateLimitIP       RateLimitTier = "ip"
+	// RateLimitAI counts AI completions per user
+	RateLimitAI RateLimitTier = "ai"
+	// RateLimitAuth counts login and registration attempts per IP
+	RateLimitAuth RateLimitTier = "auth"
+)
+
+// RateLimit allows Limit requests in any Window
+type RateLimit struct {
+	Limit  int
+	Window time.Duration
+}
+
+// DefaultRateLimits are the limits of tiers that aren't configured
+var DefaultRateLimits = map[RateLimitTier]RateLimit{
+	RateLimitUser:     {Limit: 300, Window: time.Minute},
+	RateLimitDevice:   {Limit: 600, Window: time.Minute},
+	RateLimitProspect: {Limit: 20, Window: time.Minute},
+	RateLimitIP:       {Limit: 120, Window: time.Minute},
+	RateLimitAI:       {Limit: 100, Window: time.Minute},
+	RateLimitAuth:     {Limit: 10, Window: time.Minute},
+}
+
+// RateLimitFailureMode decides what happens to requests when the limit can't
+// be checked
+type RateLimitFailureMode string
+
+const (
+	// RateLimitFailOpen lets requests through
+	RateLimitFailOpen RateLimitFailureMode = "open"
+	// RateLimitFailClosed rejects requests
+	RateLimitFailClosed RateLimitFailureMode = "closed"
+)
+
+// RateLimiter applies named sliding window limits backed by Redis
+type RateLimiter struct {
+	redisService *RedisService
+
+	mu          sync.RWMutex
+	limits      map[RateLimitTier]RateLimit
+	failureMode RateLimitFailureMode
+}
+
+func NewRateLimiter(redisService *RedisService) *RateLimiter {
+	limits := make(map[RateLimitTier]RateLimit, len(DefaultRateLimits))
+	for tier, limit := range DefaultRateLimits {
+		limits[tier] = limit
+	}
+
+	return &RateLimiter{
+		redisService: redisService,
+		limits:       limits,
+		failureMode:  RateLimitFailOpen,
+	}
+}
+
+// SetLimits overrides the limits of the given tiers
+func (l *RateLimiter) SetLimits(limits map[RateLimitTier]RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for tier, limit := range limits {
+		l.limits[tier] = limit
+	}
+}
+
+// SetFailureMode selects whether requests pass when Redis can't be reached
+func (l *RateLimiter) SetFailureMode(mode RateLimitFailureMode) error {
+	switch mode {
+	case RateLimitFailOpen, RateLimitFailClosed:
+	default:
+		return fmt.Errorf("unknown rate limit failure mode %q", mode)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.failureMode = mode
+	return nil
+}
+
+// Limit returns the limit of a tier
+func (l *RateLimiter) Limit(tier RateLimitTier) (RateLimit, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	limit, ok := l.limits[tier]
+	return limit, ok
+}
+
+// Allow counts a request by subject, such as a user ID or IP address, against
+// the limit of tier. When the check fails the result follows the failure
+// mode and the error is returned alongside it.
+func (l *RateLimiter) Allow(ctx context.Context, tier RateLimitTier, subject string) (*RateLimitResult, error) {
+	limit, ok := l.Limit(tier)
+	if !ok {
+		return nil, fmt.Errorf("unknown rate limit tier %q", tier)
+	}
+
+	key := fmt.Sprintf("rate_limit:%s:%s", tier, subject)
+	result, err := l.redisService.RateLimit(ctx, key, limit.Limit, limit.Window)
+	if err == nil {
+		return result, nil
+	}
+
+	l.mu.RLock()
+	failOpen := l.failureMode == RateLimitFailOpen
+	l.mu.RUnlock()
+
+	log.Printf("Rate limit check for %s failed, failing %s: %v", key, l.failureMode, err)
+	return &RateLimitResult{
+		Allowed:   failOpen,
+		Limit:     limit.Limit,
+		Remaining: 0,
+		ResetAt:   time.Now().Add(limit.Window),
+	}, err
+}
+
+// ParseRateLimits parses a spec such as "user=300/1m,prospect=20/1m,ip=120/30s"
+func ParseRateLimits(spec string) (map[RateLimitTier]RateLimit, error) {
+	limits := make(map[RateLimitTier]RateLimit)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		tier, value, ok := strings.Cut(entry, "=")
+		count, window, ok2 := strings.Cut(value, "/")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid rate limit %q, expected tier=limit/window", entry)
+		}
+
+		limit, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid limit in %q", entry)
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(window))
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid window in %q", entry)
+		}
+
+		limits[RateLimitTier(strings.TrimSpace(tier))] = RateLimit{Limit: limit, Window: duration}
+	}
+	return limits, nil
+}
@@ -0,0 +1,199 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// ErrLockNotAcquired is returned when a lock is held by someone else
+	ErrLockNotAcquired = errors.New("lock not acquired")
+	// ErrLockLost is returned when a lock expired and may be held by someone else
+	ErrLockLost = errors.New("lock lost")
+)
+
+const (
+	lockRetryMinDelay = 50 * time.Millisecond
+	lockRetryMaxDelay = 500 * time.Millisecond
+)
+
+// releaseLockScript deletes the lock only while it still holds our token
+var releaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// refreshLockScript extends the lock only while it still holds our token
+var refreshLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// DistributedLock is a Redis lock owned through a random token, so only its
+// holder can renew or release it. While Redis is degraded it only excludes
+// holders within this instance.
+type DistributedLock struct {
+	redisService *RedisService
+	key          string
+	token        string
+	ttl          time.Duration
+
+	once sync.Once
+	stop chan struct{}
+	done chan struct{}
+	lost chan struct{}
+}
+
+// Lock takes the lock named key for ttl, returning ErrLockNotAcquired when it
+// is held by someone else
+func (r *RedisService) Lock(ctx context.Context, key string, ttl time.Duration) (*DistributedLock, error) {
+	lock := &DistributedLock{
+		redisService: r,
+		key:          fmt.Sprintf("lock:%s", key),
+		token:        uuid.New().String(),
+		ttl:          ttl,
+		stop:         make(chan struct{}),
+		lost:         make(chan struct{}),
+	}
+
+	acquired, err := r.SetNX(ctx, lock.key, lock.token, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if !acquired {
+		return nil, ErrLockNotAcquired
+	}
+	return lock, nil
+}
+
+// AcquireLock waits up to timeout for the lock named key, retrying with
+// jittered backoff
+func (r *RedisService) AcquireLock(ctx context.Context, key string, ttl, timeout time.Duration) (*DistributedLock, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	delay := lockRetryMinDelay
+	for {
+		lock, err := r.Lock(ctx, key, ttl)
+		if !errors.Is(err, ErrLockNotAcquired) {
+			return lock, err
+		}
+
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay)))
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ErrLockNotAcquired
+		}
+
+		if delay *= 2; delay > lockRetryMaxDelay {
+			delay = lockRetryMaxDelay
+		}
+	}
+}
+
+// Refresh extends the lock to a full ttl again, returning ErrLockLost when it
+// already expired
+func (l *DistributedLock) Refresh(ctx context.Context) error {
+	client := l.redisService.active(ctx)
+	if client == nil {
+		if !l.redisService.memory.CompareAndExpire(l.key, l.token, l.ttl) {
+			return ErrLockLost
+		}
+		return nil
+	}
+
+	extended, err := refreshLockScript.Run(ctx, client, []string{l.key}, l.token, l.ttl.Milliseconds()).Int64()
+	if err != nil {
+		return err
+	}
+	if extended == 0 {
+		return ErrLockLost
+	}
+	return nil
+}
+
+// KeepAlive refreshes the lock in the background until it is released, for
+// operations that may outlast the ttl. Lost is closed if the lock can't be
+// kept.
+func (l *DistributedLock) KeepAlive() {
+	l.done = make(chan struct{})
+
+	go func() {
+		defer close(l.done)
+
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+
+		renewed := time.Now()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ticker.C:
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), l.ttl/3)
+			err := l.Refresh(ctx)
+			cancel()
+
+			if err == nil {
+				renewed = time.Now()
+				continue
+			}
+			// Redis errors are retried while the lease lasts
+			if errors.Is(err, ErrLockLost) || time.Since(renewed) >= l.ttl {
+				log.Printf("Lost lock %s: %v", l.key, err)
+				close(l.lost)
+				return
+			}
+		}
+	}()
+}
+
+// Lost is closed when KeepAlive could no longer hold the lock
+func (l *DistributedLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Release stops renewing the lock and deletes it if we still hold it.
+// Releasing a nil lock does nothing.
+func (l *DistributedLock) Release(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	l.once.Do(func() { close(l.stop) })
+	if l.done != nil {
+		<-l.done
+	}
+
+	client := l.redisService.active(ctx)
+	if client == nil {
+		if !l.redisService.memory.CompareAndDelete(l.key, l.token) {
+			return ErrLockLost
+		}
+		return nil
+	}
+
+	released, err := releaseLockScript.Run(ctx, client, []string{l.key}, l.token).Int64()
+	if err != nil {
+		return err
+	}
+	if released == 0 {
+		return ErrLockLost
+	}
+	return nil
+}
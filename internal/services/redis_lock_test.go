@@ -0,0 +1,156 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// lockBackends runs a test against Redis and against the in-memory fallback
+func lockBackends(t *testing.T, test func(t *testing.T, r *RedisService)) {
+	t.Run("redis", func(t *testing.T) {
+		r, _ := newTestRedisService(t)
+		test(t, r)
+	})
+	t.Run("memory", func(t *testing.T) {
+		r := NewRedisService("redis://127.0.0.1:1")
+		defer r.Close()
+		test(t, r)
+	})
+}
+
+func TestLockExcludesOtherHolders(t *testing.T) {
+	lockBackends(t, func(t *testing.T, r *RedisService) {
+		ctx := context.Background()
+
+		lock, err := r.Lock(ctx, "flow:a", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Lock(ctx, "flow:a", time.Minute); !errors.Is(err, ErrLockNotAcquired) {
+			t.Fatalf("second Lock error = %v, want ErrLockNotAcquired", err)
+		}
+
+		if err := lock.Release(ctx); err != nil {
+			t.Fatal(err)
+		}
+		again, err := r.Lock(ctx, "flow:a", time.Minute)
+		if err != nil {
+			t.Fatalf("Lock after release: %v", err)
+		}
+		again.Release(ctx)
+	})
+}
+
+func TestLockOnlyOwnerReleases(t *testing.T) {
+	lockBackends(t, func(t *testing.T, r *RedisService) {
+		ctx := context.Background()
+
+		stale, err := r.Lock(ctx, "flow:b", 50*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The lock expires and someone else takes it
+		r.Delete(ctx, stale.key)
+		owner, err := r.Lock(ctx, "flow:b", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := stale.Refresh(ctx); !errors.Is(err, ErrLockLost) {
+			t.Fatalf("stale Refresh error = %v, want ErrLockLost", err)
+		}
+		if err := stale.Release(ctx); !errors.Is(err, ErrLockLost) {
+			t.Fatalf("stale Release error = %v, want ErrLockLost", err)
+		}
+		if _, err := r.Lock(ctx, "flow:b", time.Minute); !errors.Is(err, ErrLockNotAcquired) {
+			t.Fatal("a stale holder released the owner's lock")
+		}
+
+		if err := owner.Refresh(ctx); err != nil {
+			t.Fatalf("owner Refresh: %v", err)
+		}
+		if err := owner.Release(ctx); err != nil {
+			t.Fatalf("owner Release: %v", err)
+		}
+	})
+}
+
+func TestAcquireLockWaitsForRelease(t *testing.T) {
+	lockBackends(t, func(t *testing.T, r *RedisService) {
+		ctx := context.Background()
+
+		held, err := r.Lock(ctx, "flow:c", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.AcquireLock(ctx, "flow:c", time.Minute, 100*time.Millisecond); !errors.Is(err, ErrLockNotAcquired) {
+			t.Fatalf("AcquireLock on a held lock error = %v, want ErrLockNotAcquired", err)
+		}
+
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			held.Release(ctx)
+		}()
+		lock, err := r.AcquireLock(ctx, "flow:c", time.Minute, time.Second)
+		if err != nil {
+			t.Fatalf("AcquireLock after release: %v", err)
+		}
+		lock.Release(ctx)
+	})
+}
+
+func TestLockKeepAliveOutlastsTTL(t *testing.T) {
+	lockBackends(t, func(t *testing.T, r *RedisService) {
+		ctx := context.Background()
+		ttl := 150 * time.Millisecond
+
+		lock, err := r.Lock(ctx, "flow:d", ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lock.KeepAlive()
+
+		time.Sleep(3 * ttl)
+		select {
+		case <-lock.Lost():
+			t.Fatal("KeepAlive lost the lock")
+		default:
+		}
+		if _, err := r.Lock(ctx, "flow:d", ttl); !errors.Is(err, ErrLockNotAcquired) {
+			t.Fatal("lock expired despite KeepAlive")
+		}
+		if err := lock.Release(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestLockKeepAliveReportsLoss(t *testing.T) {
+	lockBackends(t, func(t *testing.T, r *RedisService) {
+		ctx := context.Background()
+		ttl := 90 * time.Millisecond
+
+		lock, err := r.Lock(ctx, "flow:e", ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lock.KeepAlive()
+		defer lock.Release(ctx)
+
+		r.Delete(ctx, lock.key)
+		select {
+		case <-lock.Lost():
+		case <-time.After(time.Second):
+			t.Fatal("Lost wasn't closed after the lock was taken away")
+		}
+	})
+}
+
+func TestReleaseNilLock(t *testing.T) {
+	var lock *DistributedLock
+	if err := lock.Release(context.Background()); err != nil {
+		t.Fatalf("Release of nil lock: %v", err)
+	}
+}
@@ -2,15 +2,37 @@ package services
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"sparkle-concept-sync/internal/models"
+
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 )
 
+// redisHealthInterval is how often the connection is checked, to fall back to
+// memory when Redis goes away and to switch back once it returns
+const redisHealthInterval = 5 * time.Second
+
+// RedisService wraps Redis. While Redis is unreachable it runs degraded on an
+// in-process store behind the same API, so caching, rate limits and locks
+// keep working for this instance.
 type RedisService struct {
-	client *redis.Client
+	client  *redis.Client
+	memory  *memoryStore
+	healthy atomic.Bool
+
+	mu        sync.Mutex
+	onRecover []func(ctx context.Context)
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 func NewRedisService(redisURL string) *RedisService {
@@ -31,234 +53,538 @@ func NewRedisService(redisURL string) *RedisService {
 	opts.ConnMaxIdleTime = 5 * time.Minute
 	opts.ConnMaxLifetime = 10 * time.Minute
 
-	client := redis.NewClient(opts)
+	r := &RedisService{
+		client: redis.NewClient(opts),
+		memory: newMemoryStore(defaultMemoryEntries),
+		stop:   make(chan struct{}),
+	}
 
 	// Test connection
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if err := client.Ping(ctx).Err(); err != nil {
+	if err := r.client.Ping(ctx).Err(); err != nil {
 		log.Printf("⚠️  Redis connection failed: %v", err)
-		log.Println("📝 Redis caching will be disabled")
-		return &RedisService{client: nil}
+		log.Println("📝 Running on in-memory storage until Redis is reachable")
+	} else {
+		r.healthy.Store(true)
+		log.Println("✅ Redis connected successfully")
+	}
+
+	// Sessions revoked during an outage were only dropped from memory, so
+	// Redis may still vouch for them
+	r.OnRecover(func(ctx context.Context) {
+		if _, err := r.DeletePattern(ctx, "session:*"); err != nil {
+			log.Printf("Failed to drop cached sessions after Redis outage: %v", err)
+		}
+	})
+
+	go r.monitor()
+	return r
+}
+
+// Degraded reports whether Redis is unreachable and the in-memory store is in use
+func (r *RedisService) Degraded() bool {
+	return !r.healthy.Load()
+}
+
+// OnRecover registers fn to run when Redis is reachable again, e.g. to drop
+// entries that went stale while writes went to memory
+func (r *RedisService) OnRecover(fn func(ctx context.Context)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.onRecover = append(r.onRecover, fn)
+}
+
+// recoveringKey marks the context of OnRecover hooks, which talk to Redis
+// before everything else switches back to it
+type recoveringKey struct{}
+
+// active returns the Redis client, or nil while degraded
+func (r *RedisService) active(ctx context.Context) *redis.Client {
+	if r.healthy.Load() || ctx.Value(recoveringKey{}) != nil {
+		return r.client
 	}
+	return nil
+}
+
+// monitor pings Redis to switch between Redis and the in-memory store
+func (r *RedisService) monitor() {
+	ticker := time.NewTicker(redisHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
 
-	log.Println("✅ Redis connected successfully")
-	return &RedisService{client: client}
+		ctx, cancel := context.WithTimeout(context.Background(), redisHealthInterval/2)
+		err := r.client.Ping(ctx).Err()
+		cancel()
+
+		switch {
+		case err != nil && r.healthy.Load():
+			// Whatever memory held from an earlier outage is stale by now
+			r.memory.Flush()
+			r.healthy.Store(false)
+			log.Printf("⚠️  Redis unreachable, running on in-memory storage: %v", err)
+
+		case err == nil && !r.healthy.Load():
+			r.recover()
+		}
+	}
+}
+
+func (r *RedisService) recover() {
+	r.mu.Lock()
+	hooks := append([]func(ctx context.Context){}, r.onRecover...)
+	r.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), recoveringKey{}, true), time.Minute)
+	defer cancel()
+	for _, hook := range hooks {
+		hook(ctx)
+	}
+
+	r.healthy.Store(true)
+	log.Println("✅ Redis reachable again, leaving in-memory storage")
 }
 
 // Set stores a key-value pair with expiration
 func (r *RedisService) Set(ctx context.Context, key, value string, expiration time.Duration) error {
-	if r.client == nil {
-		return fmt.Errorf("redis client not available")
+	client := r.active(ctx)
+	if client == nil {
+		r.memory.Set(key, value, expiration)
+		return nil
 	}
 
-	return r.client.Set(ctx, key, value, expiration).Err()
+	return client.Set(ctx, key, value, expiration).Err()
 }
 
 // Get retrieves a value by key
 func (r *RedisService) Get(ctx context.Context, key string) (string, error) {
-	if r.client == nil {
-		return "", fmt.Errorf("redis client not available")
+	client := r.active(ctx)
+	if client == nil {
+		return r.memory.Get(key)
 	}
 
-	return r.client.Get(ctx, key).Result()
+	return client.Get(ctx, key).Result()
 }
 
 // Delete removes a key
 func (r *RedisService) Delete(ctx context.Context, key string) error {
-	if r.client == nil {
-		return fmt.Errorf("redis client not available")
+	client := r.active(ctx)
+	if client == nil {
+		r.memory.Delete(key)
+		return nil
 	}
 
-	return r.client.Del(ctx, key).Err()
+	return client.Del(ctx, key).Err()
 }
 
-// Exists checks if a key exists
-func (r *RedisService) Exists(ctx context.Context, key string) (bool, error) {
-	if r.client == nil {
-		return false, fmt.Errorf("redis client not available")
+// DeletePattern removes every key matching a glob pattern and returns how many
+// were removed. It uses SCAN so large keyspaces don't block Redis.
+func (r *RedisService) DeletePattern(ctx context.Context, pattern string) (int64, error) {
+	client := r.active(ctx)
+	if client == nil {
+		return r.memory.DeletePattern(pattern), nil
 	}
 
-	result, err := r.client.Exists(ctx, key).Result()
-	return result > 0, err
-}
+	var deleted int64
+	iter := client.Scan(ctx, 0, pattern, 500).Iterator()
+	batch := make([]string, 0, 500)
+	for iter.Next(ctx) {
+		batch = append(batch, iter.Val())
+		if len(batch) == cap(batch) {
+			n, err := client.Del(ctx, batch...).Result()
+			if err != nil {
+				return deleted, err
+			}
+			deleted += n
+			batch = batch[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return deleted, err
+	}
 
-// CheckRateLimit implements rate limiting using sliding window
-func (r *RedisService) CheckRateLimit(ctx context.Context, key string, limit int, window time.Duration) bool {
-	if r.client == nil {
-		return true // Allow if Redis unavailable
+	if len(batch) > 0 {
+		n, err := client.Del(ctx, batch...).Result()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
 	}
+	return deleted, nil
+}
 
-	now := time.Now().Unix()
-	windowStart := now - int64(window.Seconds())
+// Exists checks if a key exists
+func (r *RedisService) Exists(ctx context.Context, key string) (bool, error) {
+	client := r.active(ctx)
+	if client == nil {
+		return r.memory.Exists(key), nil
+	}
 
-	// Use pipeline for atomic operations
-	pipe := r.client.Pipeline()
+	result, err := client.Exists(ctx, key).Result()
+	return result > 0, err
+}
 
-	// Remove expired entries
-	pipe.ZRemRangeByScore(ctx, key, "0", fmt.Sprintf("%d", windowStart))
+// rateLimitScript is a sliding window log. Every admitted request is a
+// unique member scored by its time in milliseconds, so requests in the same
+// second are counted separately. Rejected requests aren't recorded, so a
+// client hammering a full window is admitted again as soon as it slides.
+// The caller passes the time, as TIME in scripts needs Redis 5 or later, so
+// instances sharing a limit need synced clocks. Returns {allowed, remaining,
+// reset_at_ms}.
+var rateLimitScript = redis.NewScript(`
+local now = tonumber(ARGV[4])
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[3])
+	count = count + 1
+	allowed = 1
+end
+redis.call('PEXPIRE', KEYS[1], window)
+
+local reset = now + window
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window
+end
+
+return {allowed, limit - count, reset}
+`)
+
+// RateLimitResult is the outcome of a rate limit check
+type RateLimitResult struct {
+	Allowed   bool `json:"allowed"`
+	Limit     int  `json:"limit"`
+	Remaining int  `json:"remaining"`
+	// ResetAt is when the oldest request leaves the window, freeing a slot
+	ResetAt time.Time `json:"reset_at"`
+}
 
-	// Count current requests in window
-	countCmd := pipe.ZCard(ctx, key)
+// RateLimit counts a request against a sliding window of limit requests per
+// window under key
+func (r *RedisService) RateLimit(ctx context.Context, key string, limit int, window time.Duration) (*RateLimitResult, error) {
+	client := r.active(ctx)
+	if client == nil {
+		return r.memory.RateLimit(key, limit, window)
+	}
 
-	// Add current request
-	pipe.ZAdd(ctx, key, redis.Z{Score: float64(now), Member: now})
+	values, err := rateLimitScript.Run(ctx, client, []string{key}, window.Milliseconds(), limit, uuid.New().String(), time.Now().UnixMilli()).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != 3 {
+		return nil, fmt.Errorf("unexpected rate limit reply %v", values)
+	}
 
-	// Set expiration
-	pipe.Expire(ctx, key, window)
+	return &RateLimitResult{
+		Allowed:   values[0] == 1,
+		Limit:     limit,
+		Remaining: int(values[1]),
+		ResetAt:   time.UnixMilli(values[2]),
+	}, nil
+}
 
-	// Execute pipeline
-	_, err := pipe.Exec(ctx)
+// CheckRateLimit reports whether a request fits the sliding window. Requests
+// are allowed when the check fails, use RateLimiter for a choice.
+func (r *RedisService) CheckRateLimit(ctx context.Context, key string, limit int, window time.Duration) bool {
+	result, err := r.RateLimit(ctx, key, limit, window)
 	if err != nil {
-		log.Printf("Rate limit check failed: %v", err)
-		return true // Allow on error
+		log.Printf("Rate limit check failed for %s, allowing: %v", key, err)
+		return true
 	}
-
-	// Check if limit exceeded
-	count := countCmd.Val()
-	return count < int64(limit)
+	return result.Allowed
 }
 
-// SetJSON stores a JSON object
+// SetJSON stores value encoded as JSON
 func (r *RedisService) SetJSON(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
-	if r.client == nil {
-		return fmt.Errorf("redis client not available")
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %v", key, err)
 	}
-
-	return r.client.Set(ctx, key, value, expiration).Err()
+	return r.Set(ctx, key, string(data), expiration)
 }
 
-// GetJSON retrieves a JSON object
+// GetJSON decodes the JSON value stored under key into dest. A missing key
+// returns redis.Nil.
 func (r *RedisService) GetJSON(ctx context.Context, key string, dest interface{}) error {
-	if r.client == nil {
-		return fmt.Errorf("redis client not available")
+	data, err := r.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(data), dest); err != nil {
+		return fmt.Errorf("failed to decode %s: %v", key, err)
 	}
+	return nil
+}
+
+// SetTyped stores value as JSON under key
+func SetTyped[T any](ctx context.Context, r *RedisService, key string, value T, expiration time.Duration) error {
+	return r.SetJSON(ctx, key, value, expiration)
+}
 
-	return r.client.Get(ctx, key).Scan(dest)
+// GetTyped returns the JSON value stored under key. found is false when the
+// key doesn't exist.
+func GetTyped[T any](ctx context.Context, r *RedisService, key string) (value T, found bool, err error) {
+	err = r.GetJSON(ctx, key, &value)
+	if errors.Is(err, redis.Nil) {
+		return value, false, nil
+	}
+	if err != nil {
+		return value, false, err
+	}
+	return value, true, nil
 }
 
 // Increment atomically increments a counter
 func (r *RedisService) Increment(ctx context.Context, key string) (int64, error) {
-	if r.client == nil {
-		return 0, fmt.Errorf("redis client not available")
+	client := r.active(ctx)
+	if client == nil {
+		return r.memory.Increment(key)
 	}
 
-	return r.client.Incr(ctx, key).Result()
+	return client.Incr(ctx, key).Result()
 }
 
 // SetExpiration sets expiration on existing key
 func (r *RedisService) SetExpiration(ctx context.Context, key string, expiration time.Duration) error {
-	if r.client == nil {
-		return fmt.Errorf("redis client not available")
+	client := r.active(ctx)
+	if client == nil {
+		r.memory.Expire(key, expiration)
+		return nil
 	}
 
-	return r.client.Expire(ctx, key, expiration).Err()
+	return client.Expire(ctx, key, expiration).Err()
 }
 
 // GetTTL gets time to live for a key
 func (r *RedisService) GetTTL(ctx context.Context, key string) (time.Duration, error) {
-	if r.client == nil {
-		return 0, fmt.Errorf("redis client not available")
+	client := r.active(ctx)
+	if client == nil {
+		return r.memory.TTL(key), nil
 	}
 
-	return r.client.TTL(ctx, key).Result()
+	return client.TTL(ctx, key).Result()
 }
 
 // LPush pushes to the left of a list
 func (r *RedisService) LPush(ctx context.Context, key string, values ...interface{}) error {
-	if r.client == nil {
-		return fmt.Errorf("redis client not available")
+	client := r.active(ctx)
+	if client == nil {
+		return r.memory.LPush(key, values...)
 	}
 
-	return r.client.LPush(ctx, key, values...).Err()
+	return client.LPush(ctx, key, values...).Err()
 }
 
 // RPop pops from the right of a list
 func (r *RedisService) RPop(ctx context.Context, key string) (string, error) {
-	if r.client == nil {
-		return "", fmt.Errorf("redis client not available")
+	client := r.active(ctx)
+	if client == nil {
+		return r.memory.RPop(key)
 	}
 
-	return r.client.RPop(ctx, key).Result()
+	return client.RPop(ctx, key).Result()
 }
 
 // LLen gets list length
 func (r *RedisService) LLen(ctx context.Context, key string) (int64, error) {
-	if r.client == nil {
-		return 0, fmt.Errorf("redis client not available")
+	client := r.active(ctx)
+	if client == nil {
+		return r.memory.LLen(key)
 	}
 
-	return r.client.LLen(ctx, key).Result()
+	return client.LLen(ctx, key).Result()
 }
 
-// SetNX sets a key only if it doesn't exist (for locks)
-func (r *RedisService) SetNX(ctx context.Context, key, value string, expiration time.Duration) (bool, error) {
-	if r.client == nil {
-		return false, fmt.Errorf("redis client not available")
+// ZAdd sets the score of member in a sorted set
+func (r *RedisService) ZAdd(ctx context.Context, key, member string, score float64) error {
+	client := r.active(ctx)
+	if client == nil {
+		return r.memory.ZAdd(key, member, score)
 	}
 
-	return r.client.SetNX(ctx, key, value, expiration).Result()
+	return client.ZAdd(ctx, key, redis.Z{Score: score, Member: member}).Err()
 }
 
-// Lock creates a distributed lock
-func (r *RedisService) Lock(ctx context.Context, key string, expiration time.Duration) (bool, error) {
-	lockKey := fmt.Sprintf("lock:%s", key)
-	return r.SetNX(ctx, lockKey, "locked", expiration)
+// ZRem removes member from a sorted set and reports whether it was there
+func (r *RedisService) ZRem(ctx context.Context, key, member string) (bool, error) {
+	client := r.active(ctx)
+	if client == nil {
+		return r.memory.ZRem(key, member)
+	}
+
+	removed, err := client.ZRem(ctx, key, member).Result()
+	return removed > 0, err
 }
 
-// Unlock releases a distributed lock
-func (r *RedisService) Unlock(ctx context.Context, key string) error {
-	lockKey := fmt.Sprintf("lock:%s", key)
-	return r.Delete(ctx, lockKey)
+// popByScoreScript removes and returns up to ARGV[2] members scored at most
+// ARGV[1] in one step, so concurrent callers never get the same member
+var popByScoreScript = redis.NewScript(`
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'WITHSCORES', 'LIMIT', 0, ARGV[2])
+for i = 1, #members, 2 do
+	redis.call('ZREM', KEYS[1], members[i])
+end
+return members
+`)
+
+// PopByScore removes and returns up to count members of a sorted set scored
+// at most max, lowest first
+func (r *RedisService) PopByScore(ctx context.Context, key string, max float64, count int64) ([]redis.Z, error) {
+	client := r.active(ctx)
+	if client == nil {
+		return r.memory.ZPopByScore(key, max, count)
+	}
+
+	reply, err := popByScoreScript.Run(ctx, client, []string{key}, max, count).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]redis.Z, 0, len(reply)/2)
+	for i := 0; i+1 < len(reply); i += 2 {
+		score, err := strconv.ParseFloat(reply[i+1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected score %q in sorted set %s", reply[i+1], key)
+		}
+		members = append(members, redis.Z{Score: score, Member: reply[i]})
+	}
+	return members, nil
+}
+
+// DeleteIfEquals deletes key if it holds value and reports whether it did
+func (r *RedisService) DeleteIfEquals(ctx context.Context, key, value string) (bool, error) {
+	client := r.active(ctx)
+	if client == nil {
+		return r.memory.CompareAndDelete(key, value), nil
+	}
+
+	deleted, err := releaseLockScript.Run(ctx, client, []string{key}, value).Int64()
+	return deleted == 1, err
+}
+
+// SetNX sets a key only if it doesn't exist
+func (r *RedisService) SetNX(ctx context.Context, key, value string, expiration time.Duration) (bool, error) {
+	client := r.active(ctx)
+	if client == nil {
+		return r.memory.SetNX(key, value, expiration), nil
+	}
+
+	return client.SetNX(ctx, key, value, expiration).Result()
 }
 
 // FlushAll clears all Redis data (use with caution)
 func (r *RedisService) FlushAll(ctx context.Context) error {
-	if r.client == nil {
-		return fmt.Errorf("redis client not available")
+	r.memory.Flush()
+
+	client := r.active(ctx)
+	if client == nil {
+		return nil
 	}
 
-	return r.client.FlushAll(ctx).Err()
+	return client.FlushAll(ctx).Err()
 }
 
-// GetStats returns Redis connection stats
-func (r *RedisService) GetStats() *redis.PoolStats {
-	if r.client == nil {
+// AppendStream adds an entry to a stream capped at about maxLen entries,
+// refreshes its ttl and returns the entry ID
+func (r *RedisService) AppendStream(ctx context.Context, stream string, values map[string]interface{}, maxLen int64, ttl time.Duration) (string, error) {
+	client := r.active(ctx)
+	if client == nil {
+		id, err := r.memory.XAdd(stream, values, maxLen)
+		if err == nil {
+			r.memory.Expire(stream, ttl)
+		}
+		return id, err
+	}
+
+	id, err := client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: maxLen,
+		Approx: true,
+		Values: values,
+	}).Result()
+	if err != nil {
+		return "", err
+	}
+	return id, client.Expire(ctx, stream, ttl).Err()
+}
+
+// ReadStream returns up to count entries of a stream with IDs after afterID
+func (r *RedisService) ReadStream(ctx context.Context, stream, afterID string, count int64) ([]redis.XMessage, error) {
+	client := r.active(ctx)
+	if client == nil {
+		return r.memory.XRangeAfter(stream, afterID, count)
+	}
+
+	return client.XRangeN(ctx, stream, "("+afterID, "+", count).Result()
+}
+
+// Publish sends message to a pub/sub channel. While degraded nothing is
+// published, other instances can't be reached anyway.
+func (r *RedisService) Publish(ctx context.Context, channel string, message interface{}) error {
+	client := r.active(ctx)
+	if client == nil {
 		return nil
 	}
 
+	return client.Publish(ctx, channel, message).Err()
+}
+
+// Subscribe listens on pub/sub channels. The subscription reconnects by itself
+// when Redis goes away and comes back.
+func (r *RedisService) Subscribe(ctx context.Context, channels ...string) *redis.PubSub {
+	return r.client.Subscribe(ctx, channels...)
+}
+
+// GetStats returns Redis connection stats
+func (r *RedisService) GetStats() *redis.PoolStats {
 	return r.client.PoolStats()
 }
 
 // Ping tests Redis connectivity
 func (r *RedisService) Ping(ctx context.Context) error {
-	if r.client == nil {
-		return fmt.Errorf("redis client not available")
-	}
-
 	return r.client.Ping(ctx).Err()
 }
 
 // Close closes the Redis connection
 func (r *RedisService) Close() error {
-	if r.client == nil {
-		return nil
-	}
-
+	r.closeOnce.Do(func() { close(r.stop) })
 	return r.client.Close()
 }
 
-// CacheFlowExecution caches flow execution state
-func (r *RedisService) CacheFlowExecution(ctx context.Context, executionID string, data interface{}, expiration time.Duration) error {
+// CacheFlowExecution caches flow execution state under its execution ID
+func (r *RedisService) CacheFlowExecution(ctx context.Context, execution *models.ExecutionProcess, expiration time.Duration) error {
+	key := fmt.Sprintf("flow_execution:%s", execution.ExecutionID)
+	return SetTyped(ctx, r, key, execution, expiration)
+}
+
+// GetCachedFlowExecution retrieves cached flow execution state, or nil when
+// the execution isn't cached
+func (r *RedisService) GetCachedFlowExecution(ctx context.Context, executionID string) (*models.ExecutionProcess, error) {
 	key := fmt.Sprintf("flow_execution:%s", executionID)
-	return r.SetJSON(ctx, key, data, expiration)
+	execution, found, err := GetTyped[*models.ExecutionProcess](ctx, r, key)
+	if !found {
+		return nil, err
+	}
+	return execution, nil
 }
 
-// GetCachedFlowExecution retrieves cached flow execution state
-func (r *RedisService) GetCachedFlowExecution(ctx context.Context, executionID string, dest interface{}) error {
+// DeleteCachedFlowExecution removes cached flow execution state
+func (r *RedisService) DeleteCachedFlowExecution(ctx context.Context, executionID string) error {
 	key := fmt.Sprintf("flow_execution:%s", executionID)
-	return r.GetJSON(ctx, key, dest)
+	return r.Delete(ctx, key)
 }
 
 // CacheUserSession caches user session data
@@ -273,6 +599,12 @@ func (r *RedisService) GetCachedUserSession(ctx context.Context, sessionID strin
 	return r.Get(ctx, key)
 }
 
+// InvalidateUserSession removes a cached user session
+func (r *RedisService) InvalidateUserSession(ctx context.Context, sessionID string) error {
+	key := fmt.Sprintf("session:%s", sessionID)
+	return r.Delete(ctx, key)
+}
+
 // IncrementMessageCount increments message count for analytics
 func (r *RedisService) IncrementMessageCount(ctx context.Context, deviceID string) error {
 	key := fmt.Sprintf("message_count:%s", deviceID)
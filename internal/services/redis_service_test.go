@@ -0,0 +1,99 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestRedisService returns a RedisService backed by an in-process Redis
+func newTestRedisService(t *testing.T) (*RedisService, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	r := NewRedisService("redis://" + server.Addr())
+	t.Cleanup(func() { r.Close() })
+
+	if r.Degraded() {
+		t.Fatal("RedisService didn't connect to miniredis")
+	}
+	return r, server
+}
+
+func TestRateLimitScriptSlidingWindow(t *testing.T) {
+	r, _ := newTestRedisService(t)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		result, err := r.RateLimit(ctx, "ratelimit:test", 3, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed || result.Remaining != 2-i {
+			t.Fatalf("request %d: allowed=%v remaining=%d", i, result.Allowed, result.Remaining)
+		}
+	}
+
+	result, err := r.RateLimit(ctx, "ratelimit:test", 3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || result.Remaining != 0 {
+		t.Fatalf("over limit: allowed=%v remaining=%d", result.Allowed, result.Remaining)
+	}
+	if until := time.Until(result.ResetAt); until <= 0 || until > time.Minute {
+		t.Fatalf("ResetAt is %v away, want within the window", until)
+	}
+}
+
+func TestRateLimitScriptWindowSlides(t *testing.T) {
+	r, _ := newTestRedisService(t)
+	ctx := context.Background()
+	window := 50 * time.Millisecond
+
+	if result, _ := r.RateLimit(ctx, "ratelimit:slide", 1, window); !result.Allowed {
+		t.Fatal("first request rejected")
+	}
+	if result, _ := r.RateLimit(ctx, "ratelimit:slide", 1, window); result.Allowed {
+		t.Fatal("second request in window allowed")
+	}
+
+	time.Sleep(2 * window)
+	if result, _ := r.RateLimit(ctx, "ratelimit:slide", 1, window); !result.Allowed {
+		t.Fatal("request after window slid was rejected")
+	}
+}
+
+func TestRateLimitScriptSetsExpiry(t *testing.T) {
+	r, server := newTestRedisService(t)
+
+	if _, err := r.RateLimit(context.Background(), "ratelimit:ttl", 5, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("ratelimit:ttl"); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("TTL = %v, want up to the window", ttl)
+	}
+}
+
+func TestRedisServiceFallsBackToMemory(t *testing.T) {
+	r := NewRedisService("redis://127.0.0.1:1")
+	defer r.Close()
+	ctx := context.Background()
+
+	if !r.Degraded() {
+		t.Fatal("RedisService isn't degraded without Redis")
+	}
+	if err := r.Set(ctx, "key", "value", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := r.Get(ctx, "key"); err != nil || value != "value" {
+		t.Fatalf("Get = %q, %v", value, err)
+	}
+
+	result, err := r.RateLimit(ctx, "ratelimit:degraded", 1, time.Minute)
+	if err != nil || !result.Allowed {
+		t.Fatalf("RateLimit = %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,260 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// schedulerPollInterval is how often due jobs are claimed
+	schedulerPollInterval = time.Second
+	schedulerBatchSize    = 100
+	// waitPollInterval is how often Wait checks whether another instance
+	// cancelled it
+	waitPollInterval = 250 * time.Millisecond
+	// waitMarkerGrace keeps the marker of a Wait a while past its delay
+	waitMarkerGrace = time.Minute
+)
+
+// SchedulerService runs delayed work keyed by conversation so a pending delay
+// can be replaced or cancelled, e.g. when a human takes over the chat. Jobs
+// are kept in Redis, scored by when they are due: whichever instance polls
+// first runs a due job, and Cancel works from any instance. A job is claimed
+// before it runs, so one whose instance dies while running it is lost.
+type SchedulerService struct {
+	redisService *RedisService
+
+	mu       sync.Mutex
+	handlers map[string]func(id string)
+	waits    map[string]*scheduledWait
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// scheduledWait is a Wait in progress on this instance
+type scheduledWait struct {
+	token     string
+	due       time.Time
+	cancelled chan struct{}
+}
+
+func NewSchedulerService(redisService *RedisService) *SchedulerService {
+	s := &SchedulerService{
+		redisService: redisService,
+		handlers:     make(map[string]func(id string)),
+		waits:        make(map[string]*scheduledWait),
+		stop:         make(chan struct{}),
+	}
+
+	// Jobs scheduled during an outage only reached memory
+	redisService.OnRecover(s.moveJobsToRedis)
+
+	go s.poll()
+	return s
+}
+
+// Close stops claiming due jobs
+func (s *SchedulerService) Close() {
+	s.closeOnce.Do(func() { close(s.stop) })
+}
+
+// Handle runs fn for due jobs of a kind, the part of their key before the
+// first ":". fn gets the rest of the key.
+func (s *SchedulerService) Handle(kind string, fn func(id string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.handlers[kind] = fn
+}
+
+// Schedule has the handler of key's kind run after delay, replacing any job
+// pending under the same key
+func (s *SchedulerService) Schedule(key string, delay time.Duration) error {
+	kind, id := splitJobKey(key)
+	due := time.Now().Add(delay).UnixMilli()
+	return s.redisService.ZAdd(context.Background(), jobsKey(kind), id, float64(due))
+}
+
+// Wait blocks for delay unless ctx is done or the key is cancelled meanwhile,
+// by Cancel on any instance or by another Wait on the same key
+func (s *SchedulerService) Wait(ctx context.Context, key string, delay time.Duration) error {
+	wait := &scheduledWait{
+		token:     uuid.New().String(),
+		due:       time.Now().Add(delay),
+		cancelled: make(chan struct{}),
+	}
+
+	// The marker tells other instances this wait is pending, deleting or
+	// replacing it cancels the wait
+	degraded := s.redisService.Degraded()
+	if err := s.redisService.Set(ctx, waitKey(key), wait.token, delay+waitMarkerGrace); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if previous, ok := s.waits[key]; ok {
+		close(previous.cancelled)
+	}
+	s.waits[key] = wait
+	s.mu.Unlock()
+	defer s.forgetWait(key, wait)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			// Whoever removes the marker first decides between us and Cancel
+			finished, err := s.redisService.DeleteIfEquals(context.Background(), waitKey(key), wait.token)
+			if err != nil {
+				log.Printf("Failed to finish wait %s, continuing: %v", key, err)
+				return nil
+			}
+			if !finished {
+				return context.Canceled
+			}
+			return nil
+
+		case <-wait.cancelled:
+			return context.Canceled
+
+		case <-ctx.Done():
+			s.redisService.DeleteIfEquals(context.Background(), waitKey(key), wait.token)
+			return ctx.Err()
+
+		case <-ticker.C:
+			// The marker went to the store that was active when it was set,
+			// write it again after switching between Redis and memory
+			if now := s.redisService.Degraded(); now != degraded {
+				degraded = now
+				s.redisService.Set(ctx, waitKey(key), wait.token, time.Until(wait.due)+waitMarkerGrace)
+				continue
+			}
+
+			token, err := s.redisService.Get(ctx, waitKey(key))
+			if errors.Is(err, redis.Nil) || (err == nil && token != wait.token) {
+				return context.Canceled
+			}
+		}
+	}
+}
+
+// Cancel drops the job and stops the wait pending under key, on any instance
+func (s *SchedulerService) Cancel(key string) {
+	ctx := context.Background()
+
+	kind, id := splitJobKey(key)
+	if _, err := s.redisService.ZRem(ctx, jobsKey(kind), id); err != nil {
+		log.Printf("Failed to cancel job %s: %v", key, err)
+	}
+	if err := s.redisService.Delete(ctx, waitKey(key)); err != nil {
+		log.Printf("Failed to cancel wait %s: %v", key, err)
+	}
+
+	// Waits on this instance stop right away, others notice the marker is gone
+	s.mu.Lock()
+	if wait, ok := s.waits[key]; ok {
+		close(wait.cancelled)
+		delete(s.waits, key)
+	}
+	s.mu.Unlock()
+}
+
+func (s *SchedulerService) forgetWait(key string, wait *scheduledWait) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.waits[key] == wait {
+		delete(s.waits, key)
+	}
+}
+
+// poll claims due jobs and runs them until the scheduler is closed
+func (s *SchedulerService) poll() {
+	ticker := time.NewTicker(schedulerPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		handlers := make(map[string]func(id string), len(s.handlers))
+		for kind, fn := range s.handlers {
+			handlers[kind] = fn
+		}
+		s.mu.Unlock()
+
+		for kind, fn := range handlers {
+			s.runDue(kind, fn)
+		}
+	}
+}
+
+// runDue claims the due jobs of a kind and runs each in its own goroutine
+func (s *SchedulerService) runDue(kind string, fn func(id string)) {
+	ctx, cancel := context.WithTimeout(context.Background(), schedulerPollInterval)
+	defer cancel()
+
+	jobs, err := s.redisService.PopByScore(ctx, jobsKey(kind), float64(time.Now().UnixMilli()), schedulerBatchSize)
+	if err != nil {
+		log.Printf("Failed to claim due %s jobs: %v", kind, err)
+		return
+	}
+
+	for _, job := range jobs {
+		go fn(job.Member.(string))
+	}
+}
+
+// moveJobsToRedis hands jobs scheduled in memory during an outage to Redis
+func (s *SchedulerService) moveJobsToRedis(ctx context.Context) {
+	s.mu.Lock()
+	kinds := make([]string, 0, len(s.handlers))
+	for kind := range s.handlers {
+		kinds = append(kinds, kind)
+	}
+	s.mu.Unlock()
+
+	for _, kind := range kinds {
+		jobs, _ := s.redisService.memory.ZPopByScore(jobsKey(kind), math.Inf(1), 0)
+		for _, job := range jobs {
+			if err := s.redisService.ZAdd(ctx, jobsKey(kind), job.Member.(string), job.Score); err != nil {
+				log.Printf("Failed to move %s job %v to Redis: %v", kind, job.Member, err)
+			}
+		}
+	}
+}
+
+// splitJobKey splits a job key such as "flow:<device>:<prospect>" into its
+// kind and ID
+func splitJobKey(key string) (kind, id string) {
+	kind, id, _ = strings.Cut(key, ":")
+	return kind, id
+}
+
+// jobsKey is the sorted set holding the jobs of a kind, scored by when they
+// are due in Unix milliseconds
+func jobsKey(kind string) string {
+	return "scheduler:jobs:" + kind
+}
+
+// waitKey marks a pending Wait
+func waitKey(key string) string {
+	return "scheduler:wait:" + key
+}
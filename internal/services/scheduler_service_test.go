@@ -0,0 +1,212 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// schedulerBackends runs a test against schedulers sharing a Redis and
+// against a single scheduler on the in-memory fallback
+func schedulerBackends(t *testing.T, test func(t *testing.T, a, b *SchedulerService)) {
+	t.Run("redis", func(t *testing.T) {
+		t.Parallel()
+		r, _ := newTestRedisService(t)
+		a, b := NewSchedulerService(r), NewSchedulerService(r)
+		defer a.Close()
+		defer b.Close()
+		test(t, a, b)
+	})
+	t.Run("memory", func(t *testing.T) {
+		t.Parallel()
+		r := NewRedisService("redis://127.0.0.1:1")
+		defer r.Close()
+		s := NewSchedulerService(r)
+		defer s.Close()
+		test(t, s, s)
+	})
+}
+
+// jobRecorder collects the IDs of jobs run by any scheduler
+type jobRecorder struct {
+	mu  sync.Mutex
+	ids []string
+	ran chan string
+}
+
+func newJobRecorder(schedulers ...*SchedulerService) *jobRecorder {
+	recorder := &jobRecorder{ran: make(chan string, 10)}
+	for _, s := range schedulers {
+		s.Handle("test", func(id string) {
+			recorder.mu.Lock()
+			recorder.ids = append(recorder.ids, id)
+			recorder.mu.Unlock()
+			recorder.ran <- id
+		})
+	}
+	return recorder
+}
+
+func (r *jobRecorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.ids)
+}
+
+func TestSchedulerRunsDueJobOnce(t *testing.T) {
+	schedulerBackends(t, func(t *testing.T, a, b *SchedulerService) {
+		recorder := newJobRecorder(a, b)
+
+		if err := a.Schedule("test:device:62812", 100*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case id := <-recorder.ran:
+			if id != "device:62812" {
+				t.Fatalf("handler got %q, want device:62812", id)
+			}
+		case <-time.After(3 * schedulerPollInterval):
+			t.Fatal("due job didn't run")
+		}
+
+		time.Sleep(2 * schedulerPollInterval)
+		if n := recorder.count(); n != 1 {
+			t.Fatalf("job ran %d times, want once", n)
+		}
+	})
+}
+
+func TestSchedulerCancelFromAnotherInstance(t *testing.T) {
+	schedulerBackends(t, func(t *testing.T, a, b *SchedulerService) {
+		recorder := newJobRecorder(a, b)
+
+		if err := a.Schedule("test:cancelled", 500*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		b.Cancel("test:cancelled")
+
+		time.Sleep(2 * schedulerPollInterval)
+		if n := recorder.count(); n != 0 {
+			t.Fatalf("cancelled job ran %d times", n)
+		}
+	})
+}
+
+func TestSchedulerScheduleReplacesPendingJob(t *testing.T) {
+	schedulerBackends(t, func(t *testing.T, a, b *SchedulerService) {
+		recorder := newJobRecorder(a, b)
+
+		a.Schedule("test:replaced", 100*time.Millisecond)
+		b.Schedule("test:replaced", time.Hour)
+
+		time.Sleep(2 * schedulerPollInterval)
+		if n := recorder.count(); n != 0 {
+			t.Fatalf("replaced job ran %d times", n)
+		}
+	})
+}
+
+func TestSchedulerWaitCompletes(t *testing.T) {
+	schedulerBackends(t, func(t *testing.T, a, b *SchedulerService) {
+		start := time.Now()
+		if err := a.Wait(context.Background(), "reply:done", 100*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Fatalf("Wait returned after %v", elapsed)
+		}
+	})
+}
+
+func TestSchedulerWaitCancelledFromAnotherInstance(t *testing.T) {
+	schedulerBackends(t, func(t *testing.T, a, b *SchedulerService) {
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			b.Cancel("reply:cancelled")
+		}()
+
+		start := time.Now()
+		err := a.Wait(context.Background(), "reply:cancelled", time.Minute)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Wait error = %v, want context.Canceled", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("cancellation took %v", elapsed)
+		}
+	})
+}
+
+func TestSchedulerWaitReplacedByAnotherWait(t *testing.T) {
+	schedulerBackends(t, func(t *testing.T, a, b *SchedulerService) {
+		first := make(chan error, 1)
+		go func() { first <- a.Wait(context.Background(), "reply:replaced", time.Minute) }()
+
+		time.Sleep(50 * time.Millisecond)
+		second := make(chan error, 1)
+		go func() { second <- b.Wait(context.Background(), "reply:replaced", 100*time.Millisecond) }()
+
+		select {
+		case err := <-first:
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("replaced Wait error = %v, want context.Canceled", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("replaced Wait kept waiting")
+		}
+		if err := <-second; err != nil {
+			t.Fatalf("replacing Wait: %v", err)
+		}
+	})
+}
+
+func TestSchedulerWaitStopsWithContext(t *testing.T) {
+	schedulerBackends(t, func(t *testing.T, a, b *SchedulerService) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		if err := a.Wait(ctx, "reply:ctx", time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Wait error = %v, want context.DeadlineExceeded", err)
+		}
+	})
+}
+
+func TestPopByScore(t *testing.T) {
+	lockBackends(t, func(t *testing.T, r *RedisService) {
+		ctx := context.Background()
+		r.ZAdd(ctx, "scheduler:jobs:pop", "late", 30)
+		r.ZAdd(ctx, "scheduler:jobs:pop", "b", 20)
+		r.ZAdd(ctx, "scheduler:jobs:pop", "a", 10)
+		r.ZAdd(ctx, "scheduler:jobs:pop", "c", 20)
+
+		due, err := r.PopByScore(ctx, "scheduler:jobs:pop", 20, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(due) != 2 || due[0].Member != "a" || due[0].Score != 10 || due[1].Member != "b" {
+			t.Fatalf("PopByScore = %v, want a and b", due)
+		}
+
+		due, _ = r.PopByScore(ctx, "scheduler:jobs:pop", 20, 10)
+		if len(due) != 1 || due[0].Member != "c" {
+			t.Fatalf("second PopByScore = %v, want c", due)
+		}
+
+		if removed, _ := r.ZRem(ctx, "scheduler:jobs:pop", "late"); !removed {
+			t.Fatal("ZRem didn't find a pending member")
+		}
+		if removed, _ := r.ZRem(ctx, "scheduler:jobs:pop", "late"); removed {
+			t.Fatal("ZRem removed a member twice")
+		}
+	})
+}
+
+func TestSplitConversationKey(t *testing.T) {
+	deviceID, prospectNum := splitConversationKey(conversationKey("dev:1", "62812"))
+	if deviceID != "dev:1" || prospectNum != "62812" {
+		t.Fatalf("splitConversationKey = %q, %q", deviceID, prospectNum)
+	}
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"sparkle-concept-sync/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// ModelPrice is the price of a model in USD per million tokens
+type ModelPrice struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// UsageContext links an AI call to what triggered it
+type UsageContext struct {
+	UserID      string
+	DeviceID    string
+	FlowID      string
+	ExecutionID string
+}
+
+// DefaultModelPricing covers the models offered in device settings
+var DefaultModelPricing = map[string]ModelPrice{
+	"openai/gpt-5-chat":        {Prompt: 1.25, Completion: 10},
+	"openai/gpt-5-mini":        {Prompt: 0.25, Completion: 2},
+	"openai/chatgpt-4o-latest": {Prompt: 5, Completion: 15},
+	"openai/gpt-4.1":           {Prompt: 2, Completion: 8},
+	"openai/gpt-4":             {Prompt: 30, Completion: 60},
+	"google/gemini-2.5-pro":    {Prompt: 1.25, Completion: 10},
+	"google/gemini-pro-1.5":    {Prompt: 1.25, Completion: 5},
+}
+
+// usagePeriods maps summary periods to their date_trunc unit
+var usagePeriods = map[string]string{
+	"daily":   "day",
+	"monthly": "month",
+}
+
+type UsageService struct {
+	db *sql.DB
+
+	mu      sync.RWMutex
+	pricing map[string]ModelPrice
+}
+
+func NewUsageService(db *sql.DB) *UsageService {
+	pricing := make(map[string]ModelPrice, len(DefaultModelPricing))
+	for model, price := range DefaultModelPricing {
+		pricing[model] = price
+	}
+
+	return &UsageService{
+		db:      db,
+		pricing: pricing,
+	}
+}
+
+// SetPricing overrides the price of the given models, keeping the others
+func (s *UsageService) SetPricing(pricing map[string]ModelPrice) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for model, price := range pricing {
+		s.pricing[model] = price
+	}
+}
+
+// ParseModelPricing reads a pricing table such as
+// {"openai/gpt-4.1":{"prompt":2,"completion":8}}
+func ParseModelPricing(spec string) (map[string]ModelPrice, error) {
+	var pricing map[string]ModelPrice
+	if err := json.Unmarshal([]byte(spec), &pricing); err != nil {
+		return nil, fmt.Errorf("invalid model pricing: %v", err)
+	}
+	return pricing, nil
+}
+
+// Cost returns the price in USD of the given usage and whether the model
+// has a price configured
+func (s *UsageService) Cost(model string, usage *models.AIUsage) (float64, bool) {
+	s.mu.RLock()
+	price, ok := s.pricing[model]
+	s.mu.RUnlock()
+
+	if !ok || usage == nil {
+		return 0, ok
+	}
+
+	cost := float64(usage.PromptTokens)*price.Prompt + float64(usage.CompletionTokens)*price.Completion
+	return cost / 1_000_000, true
+}
+
+// RecordUsage stores the usage and cost of one AI reply. Replies without
+// usage, such as cache hits, are skipped.
+func (s *UsageService) RecordUsage(usageCtx UsageContext, model string, usage *models.AIUsage) error {
+	if usage == nil {
+		return nil
+	}
+
+	cost, priced := s.Cost(model, usage)
+	if !priced {
+		logUnpricedModel(model)
+	}
+
+	totalTokens := usage.TotalTokens
+	if totalTokens == 0 {
+		totalTokens = usage.PromptTokens + usage.CompletionTokens
+	}
+
+	query := `INSERT INTO ai_usage (id, user_id, device_id, flow_id, execution_id, model, prompt_tokens, completion_tokens, total_tokens, cost)
+			  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+
+	_, err := s.db.Exec(query,
+		uuid.New().String(), usageCtx.UserID, nullString(usageCtx.DeviceID), nullString(usageCtx.FlowID),
+		nullString(usageCtx.ExecutionID), model, usage.PromptTokens, usage.CompletionTokens, totalTokens, cost,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to record AI usage: %v", err)
+	}
+	return nil
+}
+
+// GetUsageSummary aggregates a user's usage per day or month between from
+// (inclusive) and to (exclusive), optionally for a single device
+func (s *UsageService) GetUsageSummary(userID, period string, from, to time.Time, deviceID string) ([]models.UsageSummary, error) {
+	unit, ok := usagePeriods[period]
+	if !ok {
+		return nil, fmt.Errorf("unsupported period %q", period)
+	}
+
+	query := `SELECT date_trunc('` + unit + `', created_at) AS period, COUNT(*), COALESCE(SUM(prompt_tokens), 0),
+			  COALESCE(SUM(completion_tokens), 0), COALESCE(SUM(total_tokens), 0), COALESCE(SUM(cost), 0)
+			  FROM ai_usage
+			  WHERE user_id = $1 AND created_at >= $2 AND created_at < $3 AND ($4 = '' OR device_id = $4)
+			  GROUP BY period ORDER BY period`
+
+	rows, err := s.db.Query(query, userID, from, to, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	summaries := []models.UsageSummary{}
+	for rows.Next() {
+		var summary models.UsageSummary
+		err := rows.Scan(
+			&summary.Period, &summary.Requests, &summary.PromptTokens,
+			&summary.CompletionTokens, &summary.TotalTokens, &summary.Cost,
+		)
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, rows.Err()
+}
+
+var unpricedModels sync.Map
+
+// logUnpricedModel warns once per model missing from the pricing table
+func logUnpricedModel(model string) {
+	if _, seen := unpricedModels.LoadOrStore(model, true); !seen {
+		log.Printf("No price configured for AI model %s, recording usage at zero cost", model)
+	}
+}
@@ -1,42 +1,318 @@
 package services
 
 import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
 	"log"
 	"sparkle-concept-sync/internal/models"
+	"strings"
 	"time"
 
 	"github.com/gofiber/websocket/v2"
+	"github.com/google/uuid"
 )
 
+// websocketChannel carries broadcasts between server instances
+const websocketChannel = "websocket:events"
+
+// websocketAuthTimeout is how long a connection without a token query
+// parameter has to send its auth message
+const websocketAuthTimeout = 10 * time.Second
+
+const (
+	// websocketSendBuffer is how many messages may queue for a client, a
+	// client falling further behind is dropped
+	websocketSendBuffer = 256
+	websocketWriteWait  = 10 * time.Second
+	// websocketPongWait is how long a client may stay silent, pongs included
+	websocketPongWait   = 60 * time.Second
+	websocketPingPeriod = websocketPongWait * 9 / 10
+	websocketMaxMessage = 8 * 1024
+)
+
+const (
+	// websocketEventLog is how many events are kept per user for replay
+	websocketEventLog = 1000
+	// websocketEventTTL drops the event log of users without events for a day
+	websocketEventTTL = 24 * time.Hour
+	// websocketReplayLimit is how many missed events a client gets on
+	// reconnect, the newest ones, so the replay fits its send buffer
+	websocketReplayLimit = 200
+)
+
+// WebSocketSession is the login a connection authenticated with
+type WebSocketSession struct {
+	UserID string
+	// SessionID names the session in RevokeSessions
+	SessionID string
+	// ExpiresAt is when the connection is closed, zero for never
+	ExpiresAt time.Time
+}
+
+// WebSocketAuthenticator returns the session a token belongs to
+type WebSocketAuthenticator func(token string) (WebSocketSession, error)
+
+// websocketEnvelope tags a broadcast with the instance that sent it, which has
+// already delivered it to its own clients. Envelopes with Revoked sessions
+// carry no message.
+type websocketEnvelope struct {
+	Instance string                  `json:"instance"`
+	Message  models.WebSocketMessage `json:"message"`
+	Revoked  []string                `json:"revoked,omitempty"`
+}
+
+// websocketClient is an authenticated connection. Until it subscribes to a
+// topic it receives every event of its user. Only the hub touches topics,
+// held, closeReason and send, only the write pump writes to conn.
+type websocketClient struct {
+	conn      *websocket.Conn
+	userID    string
+	sessionID string
+	expiresAt time.Time
+	topics    map[string]bool
+	send      chan models.WebSocketMessage
+	done      chan struct{}
+
+	// closeReason is sent in the close frame when the hub drops the client
+	closeReason string
+
+	// replaying holds live events in held until the missed ones are queued
+	replaying bool
+	held      []models.WebSocketMessage
+}
+
+// websocketReplay are the events a client missed since lastEventID,
+// truncated when older ones were left out
+type websocketReplay struct {
+	client      *websocketClient
+	lastEventID string
+	events      []models.WebSocketMessage
+	truncated   bool
+}
+
+// websocketSubscription adds or removes a topic of a client
+type websocketSubscription struct {
+	client     *websocketClient
+	topic      string
+	subscribed bool
+}
+
+// websocketDirect is a message for a single client
+type websocketDirect struct {
+	client  *websocketClient
+	message models.WebSocketMessage
+}
+
+// WebSocketService is a hub: one goroutine owns the client set and queues
+// messages to each client's write pump, so a slow client can't hold up the
+// others
 type WebSocketService struct {
-	clients map[*websocket.Conn]bool
+	db            *sql.DB
+	redisService  *RedisService
+	instanceID    string
+	authenticator WebSocketAuthenticator
+
+	register      chan *websocketClient
+	unregister    chan *websocketClient
+	subscriptions chan websocketSubscription
+	broadcast     chan models.WebSocketMessage
+	direct        chan websocketDirect
+	replays       chan websocketReplay
+	revocations   chan []string
+}
+
+func NewWebSocketService(db *sql.DB, redisService *RedisService) *WebSocketService {
+	s := &WebSocketService{
+		db:            db,
+		redisService:  redisService,
+		instanceID:    uuid.New().String(),
+		register:      make(chan *websocketClient),
+		unregister:    make(chan *websocketClient),
+		subscriptions: make(chan websocketSubscription),
+		broadcast:     make(chan models.WebSocketMessage, websocketSendBuffer),
+		direct:        make(chan websocketDirect, websocketSendBuffer),
+		replays:       make(chan websocketReplay),
+		revocations:   make(chan []string, websocketSendBuffer),
+	}
+
+	go s.run()
+	go s.subscribe()
+	return s
+}
+
+// SetAuthenticator sets how connections are authenticated. Connections are
+// refused until one is set.
+func (s *WebSocketService) SetAuthenticator(authenticator WebSocketAuthenticator) {
+	s.authenticator = authenticator
 }
 
-func NewWebSocketService() *WebSocketService {
-	return &WebSocketService{
-		clients: make(map[*websocket.Conn]bool),
+// run is the hub loop, the only place clients are added, removed or queued to
+func (s *WebSocketService) run() {
+	clients := make(map[*websocketClient]bool)
+
+	drop := func(client *websocketClient) {
+		if clients[client] {
+			delete(clients, client)
+			close(client.send)
+		}
+	}
+	queue := func(client *websocketClient, message models.WebSocketMessage) {
+		if !clients[client] {
+			return
+		}
+		select {
+		case client.send <- message:
+		default:
+			log.Printf("WebSocket client of user %s fell behind, dropping it", client.userID)
+			drop(client)
+		}
+	}
+
+	for {
+		select {
+		case client := <-s.register:
+			clients[client] = true
+			log.Printf("WebSocket client connected. Total clients: %d", len(clients))
+
+		case client := <-s.unregister:
+			drop(client)
+
+		case sub := <-s.subscriptions:
+			if !clients[sub.client] {
+				continue
+			}
+			if sub.subscribed {
+				sub.client.topics[sub.topic] = true
+			} else {
+				delete(sub.client.topics, sub.topic)
+			}
+
+		case d := <-s.direct:
+			queue(d.client, d.message)
+
+		case r := <-s.replays:
+			client := r.client
+			if !clients[client] {
+				continue
+			}
+
+			lastEventID := r.lastEventID
+			for _, message := range r.events {
+				if client.wants(messageTopics(message)) {
+					queue(client, message)
+				}
+				lastEventID = message.ID
+			}
+			queue(client, models.WebSocketMessage{
+				Type:      "replayed",
+				UserID:    client.userID,
+				Data:      map[string]interface{}{"count": len(r.events), "last_event_id": lastEventID, "truncated": r.truncated},
+				Timestamp: time.Now(),
+			})
+
+			// Live events that came in meanwhile, minus those just replayed
+			for _, message := range client.held {
+				if message.ID == "" || streamIDAfter(message.ID, lastEventID) {
+					queue(client, message)
+				}
+			}
+			client.held = nil
+			client.replaying = false
+
+		case sessionIDs := <-s.revocations:
+			revoked := make(map[string]bool, len(sessionIDs))
+			for _, sessionID := range sessionIDs {
+				revoked[sessionID] = true
+			}
+			for client := range clients {
+				if revoked[client.sessionID] {
+					client.closeReason = "session revoked"
+					drop(client)
+				}
+			}
+
+		case message := <-s.broadcast:
+			topics := messageTopics(message)
+			for client := range clients {
+				if client.userID != message.UserID || !client.wants(topics) {
+					continue
+				}
+				if !client.replaying {
+					queue(client, message)
+				} else if len(client.held) < websocketSendBuffer {
+					client.held = append(client.held, message)
+				} else {
+					log.Printf("WebSocket client of user %s fell behind while replaying, dropping it", client.userID)
+					drop(client)
+				}
+			}
+		}
 	}
 }
 
-// HandleWebSocket handles WebSocket connections
+// HandleWebSocket handles WebSocket connections. Clients authenticate with a
+// token query parameter or an {"type": "auth", "token": "..."} first message
+// and only receive events of their own user. A last_event_id, in the query or
+// the auth message, replays the events missed since before live ones. The
+// connection is closed when its session expires or is revoked.
 func (s *WebSocketService) HandleWebSocket(c *websocket.Conn) {
-	defer func() {
-		delete(s.clients, c)
-		c.Close()
-	}()
+	defer c.Close()
 
-	// Add client to active connections
-	s.clients[c] = true
+	session, lastEventID, err := s.authenticate(c)
+	if err != nil {
+		log.Printf("WebSocket authentication failed: %v", err)
+		c.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+		c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "authentication failed"))
+		return
+	}
 
-	log.Printf("WebSocket client connected. Total clients: %d", len(s.clients))
+	userID := session.UserID
+	client := &websocketClient{
+		conn:      c,
+		userID:    userID,
+		sessionID: session.SessionID,
+		expiresAt: session.ExpiresAt,
+		topics:    make(map[string]bool),
+		send:      make(chan models.WebSocketMessage, websocketSendBuffer),
+		done:      make(chan struct{}),
+		// Registered before reading the log so no event falls in between
+		replaying: lastEventID != "",
+	}
+	s.register <- client
+	go s.writePump(client)
+
+	// The connection is released when the handler returns, so wait for the
+	// write pump to let go of it
+	defer func() {
+		s.unregister <- client
+		<-client.done
+	}()
 
 	// Send welcome message
-	welcome := models.WebSocketMessage{
+	s.send(client, models.WebSocketMessage{
 		Type:      "connected",
+		UserID:    userID,
 		Data:      map[string]interface{}{"message": "WebSocket connected"},
 		Timestamp: time.Now(),
+	})
+
+	if client.replaying {
+		events, truncated := s.missedEvents(userID, lastEventID)
+		s.replays <- websocketReplay{
+			client:      client,
+			lastEventID: lastEventID,
+			events:      events,
+			truncated:   truncated,
+		}
 	}
-	c.WriteJSON(welcome)
+
+	c.SetReadLimit(websocketMaxMessage)
+	c.SetReadDeadline(time.Now().Add(websocketPongWait))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(websocketPongWait))
+	})
 
 	// Keep connection alive and handle incoming messages
 	for {
@@ -45,26 +321,312 @@ func (s *WebSocketService) HandleWebSocket(c *websocket.Conn) {
 			log.Printf("WebSocket read error: %v", err)
 			break
 		}
+		c.SetReadDeadline(time.Now().Add(websocketPongWait))
 
 		// Handle incoming messages (ping, subscribe, etc.)
-		s.handleIncomingMessage(c, msg)
+		s.handleIncomingMessage(client, msg)
 	}
 }
 
-// Broadcast sends a message to all connected clients
+// writePump writes the queued messages of a client and pings it. It closes
+// the connection once the hub drops the client, its session expires or a
+// write fails.
+func (s *WebSocketService) writePump(client *websocketClient) {
+	ticker := time.NewTicker(websocketPingPeriod)
+	defer func() {
+		ticker.Stop()
+		client.conn.Close()
+		close(client.done)
+	}()
+
+	var expired <-chan time.Time
+	if !client.expiresAt.IsZero() {
+		expiry := time.NewTimer(time.Until(client.expiresAt))
+		defer expiry.Stop()
+		expired = expiry.C
+	}
+
+	for {
+		select {
+		case message, ok := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+			if !ok {
+				closeMessage := []byte{}
+				if client.closeReason != "" {
+					closeMessage = websocket.FormatCloseMessage(websocket.ClosePolicyViolation, client.closeReason)
+				}
+				client.conn.WriteMessage(websocket.CloseMessage, closeMessage)
+				return
+			}
+			if err := client.conn.WriteJSON(message); err != nil {
+				log.Printf("WebSocket write error: %v", err)
+				return
+			}
+
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+
+		case <-expired:
+			client.conn.SetWriteDeadline(time.Now().Add(websocketWriteWait))
+			client.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session expired"))
+			return
+		}
+	}
+}
+
+// authenticate returns the session of a new connection and the last event it
+// saw, from the query parameters or else the first message
+func (s *WebSocketService) authenticate(c *websocket.Conn) (WebSocketSession, string, error) {
+	if s.authenticator == nil {
+		return WebSocketSession{}, "", fmt.Errorf("no authenticator configured")
+	}
+
+	token, lastEventID := c.Query("token"), c.Query("last_event_id")
+	if token == "" {
+		c.SetReadDeadline(time.Now().Add(websocketAuthTimeout))
+		var msg struct {
+			Type        string `json:"type"`
+			Token       string `json:"token"`
+			LastEventID string `json:"last_event_id"`
+		}
+		if err := c.ReadJSON(&msg); err != nil {
+			return WebSocketSession{}, "", fmt.Errorf("no auth message: %v", err)
+		}
+		if msg.Type != "auth" || msg.Token == "" {
+			return WebSocketSession{}, "", fmt.Errorf("expected an auth message, got %q", msg.Type)
+		}
+		c.SetReadDeadline(time.Time{})
+		token, lastEventID = msg.Token, msg.LastEventID
+	}
+
+	session, err := s.authenticator(token)
+	return session, lastEventID, err
+}
+
+// eventLogKey is the stream of a user's events
+func eventLogKey(userID string) string {
+	return "websocket_events:" + userID
+}
+
+// record appends an event to its user's log and returns the event ID, or ""
+// when it couldn't be stored and won't be replayed
+func (s *WebSocketService) record(message models.WebSocketMessage) string {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Failed to encode WebSocket message %s: %v", message.Type, err)
+		return ""
+	}
+
+	id, err := s.redisService.AppendStream(context.Background(), eventLogKey(message.UserID), map[string]interface{}{"event": string(payload)}, websocketEventLog, websocketEventTTL)
+	if err != nil {
+		log.Printf("Failed to log WebSocket message %s: %v", message.Type, err)
+		return ""
+	}
+	return id
+}
+
+// missedEvents reads the newest websocketReplayLimit events of a user after
+// lastEventID and reports whether older ones were left out. Events trimmed
+// from the log are gone without notice.
+func (s *WebSocketService) missedEvents(userID, lastEventID string) ([]models.WebSocketMessage, bool) {
+	entries, err := s.redisService.ReadStream(context.Background(), eventLogKey(userID), lastEventID, websocketEventLog)
+	if err != nil {
+		log.Printf("Failed to replay WebSocket events of user %s: %v", userID, err)
+		return nil, false
+	}
+
+	truncated := len(entries) > websocketReplayLimit
+	if truncated {
+		entries = entries[len(entries)-websocketReplayLimit:]
+	}
+
+	events := make([]models.WebSocketMessage, 0, len(entries))
+	for _, entry := range entries {
+		payload, _ := entry.Values["event"].(string)
+
+		var event models.WebSocketMessage
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			log.Printf("Skipping malformed logged event %s: %v", entry.ID, err)
+			continue
+		}
+		event.ID = entry.ID
+		events = append(events, event)
+	}
+	return events, truncated
+}
+
+// Broadcast sends a message to the connected clients of message.UserID, on
+// this and every other instance, and logs it for replay
 func (s *WebSocketService) Broadcast(message models.WebSocketMessage) {
+	if message.UserID == "" {
+		return
+	}
 	message.Timestamp = time.Now()
+	message.ID = s.record(message)
+
+	s.deliver(message)
+
+	payload, err := json.Marshal(websocketEnvelope{Instance: s.instanceID, Message: message})
+	if err != nil {
+		log.Printf("Failed to encode WebSocket message %s: %v", message.Type, err)
+		return
+	}
+	if err := s.redisService.Publish(context.Background(), websocketChannel, payload); err != nil {
+		log.Printf("Failed to publish WebSocket message %s: %v", message.Type, err)
+	}
+}
 
-	for client := range s.clients {
-		if err := client.WriteJSON(message); err != nil {
-			log.Printf("WebSocket write error: %v", err)
-			delete(s.clients, client)
-			client.Close()
+// RevokeSessions closes the connections of the sessions, on this and every
+// other instance
+func (s *WebSocketService) RevokeSessions(sessionIDs []string) {
+	if len(sessionIDs) == 0 {
+		return
+	}
+	s.revocations <- sessionIDs
+
+	payload, err := json.Marshal(websocketEnvelope{Instance: s.instanceID, Revoked: sessionIDs})
+	if err != nil {
+		log.Printf("Failed to encode WebSocket revocation: %v", err)
+		return
+	}
+	if err := s.redisService.Publish(context.Background(), websocketChannel, payload); err != nil {
+		log.Printf("Failed to publish WebSocket revocation: %v", err)
+	}
+}
+
+// deliver hands a message to the hub for the clients of its user connected
+// to this instance that subscribed to one of its topics. Messages without a
+// user reach no one, messages without topics reach all clients of the user.
+func (s *WebSocketService) deliver(message models.WebSocketMessage) {
+	if message.UserID == "" {
+		return
+	}
+	s.broadcast <- message
+}
+
+// send queues a message for one client
+func (s *WebSocketService) send(client *websocketClient, message models.WebSocketMessage) {
+	s.direct <- websocketDirect{client: client, message: message}
+}
+
+// subscribe delivers broadcasts of other instances to the clients of this one
+func (s *WebSocketService) subscribe() {
+	pubsub := s.redisService.Subscribe(context.Background(), websocketChannel)
+	defer pubsub.Close()
+
+	for msg := range pubsub.Channel() {
+		var envelope websocketEnvelope
+		if err := json.Unmarshal([]byte(msg.Payload), &envelope); err != nil {
+			log.Printf("Ignoring malformed WebSocket broadcast: %v", err)
+			continue
+		}
+		if envelope.Instance == s.instanceID {
+			continue
+		}
+		if len(envelope.Revoked) > 0 {
+			s.revocations <- envelope.Revoked
+			continue
+		}
+		s.deliver(envelope.Message)
+	}
+}
+
+// wants reports whether the client is subscribed to one of topics
+func (c *websocketClient) wants(topics []string) bool {
+	if len(c.topics) == 0 || len(topics) == 0 {
+		return true
+	}
+	for _, topic := range topics {
+		if c.topics[topic] {
+			return true
+		}
+	}
+	return false
+}
+
+// messageTopics lists the topics a message is published on
+func messageTopics(message models.WebSocketMessage) []string {
+	var topics []string
+	if message.DeviceID != "" {
+		topics = append(topics, "device:"+message.DeviceID)
+		if message.ProspectNum != "" {
+			topics = append(topics, "conversation:"+message.DeviceID+":"+message.ProspectNum)
+		}
+	}
+	if message.FlowID != "" {
+		topics = append(topics, "flow:"+message.FlowID)
+	}
+	return topics
+}
+
+// authorizeTopic checks that userID owns what topic refers to, one of
+// device:{id_device}, conversation:{id_device}:{prospect_num} or flow:{id}
+func (s *WebSocketService) authorizeTopic(userID, topic string) error {
+	kind, id, _ := strings.Cut(topic, ":")
+	if id == "" {
+		return fmt.Errorf("invalid topic %q", topic)
+	}
+
+	var query string
+	switch kind {
+	case "device":
+		query = `SELECT EXISTS(SELECT 1 FROM device_setting WHERE id_device = $1 AND user_id = $2)`
+	case "conversation":
+		deviceID, prospectNum, _ := strings.Cut(id, ":")
+		if deviceID == "" || prospectNum == "" {
+			return fmt.Errorf("invalid topic %q", topic)
+		}
+		id = deviceID
+		query = `SELECT EXISTS(SELECT 1 FROM device_setting WHERE id_device = $1 AND user_id = $2)`
+	case "flow":
+		query = `SELECT EXISTS(SELECT 1 FROM chatbot_flows WHERE id = $1 AND user_id = $2)`
+	default:
+		return fmt.Errorf("unknown topic %q", topic)
+	}
+
+	var owned bool
+	if err := s.db.QueryRow(query, id, userID).Scan(&owned); err != nil {
+		log.Printf("Failed to authorize WebSocket topic %s: %v", topic, err)
+		return fmt.Errorf("failed to check topic %q", topic)
+	}
+	if !owned {
+		return fmt.Errorf("topic %q not found", topic)
+	}
+	return nil
+}
+
+// setSubscription adds or, with subscribed false, removes a topic of a client
+func (s *WebSocketService) setSubscription(client *websocketClient, topic string, subscribed bool) {
+	if subscribed {
+		if err := s.authorizeTopic(client.userID, topic); err != nil {
+			s.send(client, models.WebSocketMessage{
+				Type:      "error",
+				UserID:    client.userID,
+				Data:      map[string]interface{}{"error": err.Error(), "topic": topic},
+				Timestamp: time.Now(),
+			})
+			return
 		}
 	}
+
+	s.subscriptions <- websocketSubscription{client: client, topic: topic, subscribed: subscribed}
+
+	msgType := "unsubscribed"
+	if subscribed {
+		msgType = "subscribed"
+	}
+	s.send(client, models.WebSocketMessage{
+		Type:      msgType,
+		UserID:    client.userID,
+		Data:      map[string]interface{}{"topic": topic},
+		Timestamp: time.Now(),
+	})
 }
 
-func (s *WebSocketService) handleIncomingMessage(c *websocket.Conn, msg map[string]interface{}) {
+func (s *WebSocketService) handleIncomingMessage(client *websocketClient, msg map[string]interface{}) {
 	msgType, ok := msg["type"].(string)
 	if !ok {
 		return
@@ -77,11 +639,11 @@ func (s *WebSocketService) handleIncomingMessage(c *websocket.Conn, msg map[stri
 			Data:      map[string]interface{}{"timestamp": time.Now()},
 			Timestamp: time.Now(),
 		}
-		c.WriteJSON(response)
+		s.send(client, response)
 
-	case "subscribe":
-		// Handle subscription to specific channels/devices
-		// This would be implemented for more granular real-time updates
+	case "subscribe", "unsubscribe":
+		topic, _ := msg["topic"].(string)
+		s.setSubscription(client, topic, msgType == "subscribe")
 
 	default:
 		log.Printf("Unknown WebSocket message type: %s", msgType)
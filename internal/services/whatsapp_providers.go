@@ -0,0 +1,238 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"sparkle-concept-sync/internal/models"
+)
+
+// whatsAppProvider sends messages through a single WhatsApp gateway
+type whatsAppProvider interface {
+	SendText(ctx context.Context, device *models.DeviceSetting, to, text string) error
+	SendMedia(ctx context.Context, device *models.DeviceSetting, to, mediaType, mediaURL, caption string) error
+}
+
+// typingProvider is implemented by gateways that can show a typing indicator
+type typingProvider interface {
+	StartTyping(ctx context.Context, device *models.DeviceSetting, to string) error
+	StopTyping(ctx context.Context, device *models.DeviceSetting, to string) error
+}
+
+const (
+	defaultWablasBaseURL = "https://my.wablas.com"
+	whacenterSendURL     = "https://app.whacenter.com/api/send"
+	defaultWAHASession   = "default"
+)
+
+// wablasProvider talks to the Wablas REST API. The device instance holds the
+// account's regional base URL when it differs from the default.
+type wablasProvider struct {
+	httpClient *http.Client
+}
+
+func (p *wablasProvider) SendText(ctx context.Context, device *models.DeviceSetting, to, text string) error {
+	payload := map[string]string{
+		"phone":   to,
+		"message": text,
+	}
+	return postJSON(ctx, p.httpClient, wablasBaseURL(device)+"/api/send-message", payload, map[string]string{
+		"Authorization": stringValue(device.APIKey),
+	})
+}
+
+func (p *wablasProvider) SendMedia(ctx context.Context, device *models.DeviceSetting, to, mediaType, mediaURL, caption string) error {
+	payload := map[string]string{
+		"phone":   to,
+		mediaType: mediaURL,
+	}
+	if caption != "" && mediaType != "audio" {
+		payload["caption"] = caption
+	}
+	return postJSON(ctx, p.httpClient, wablasBaseURL(device)+"/api/send-"+mediaType, payload, map[string]string{
+		"Authorization": stringValue(device.APIKey),
+	})
+}
+
+func wablasBaseURL(device *models.DeviceSetting) string {
+	if base := strings.TrimRight(stringValue(device.Instance), "/"); strings.HasPrefix(base, "http") {
+		return base
+	}
+	return defaultWablasBaseURL
+}
+
+// whacenterProvider talks to the Whacenter API, which identifies the sender by device_id
+type whacenterProvider struct {
+	httpClient *http.Client
+}
+
+func (p *whacenterProvider) SendText(ctx context.Context, device *models.DeviceSetting, to, text string) error {
+	form := url.Values{}
+	form.Set("device_id", stringValue(device.DeviceID))
+	form.Set("number", to)
+	form.Set("message", text)
+	return postForm(ctx, p.httpClient, whacenterSendURL, form)
+}
+
+func (p *whacenterProvider) SendMedia(ctx context.Context, device *models.DeviceSetting, to, mediaType, mediaURL, caption string) error {
+	form := url.Values{}
+	form.Set("device_id", stringValue(device.DeviceID))
+	form.Set("number", to)
+	form.Set("message", caption)
+	form.Set("file", mediaURL)
+	return postForm(ctx, p.httpClient, whacenterSendURL, form)
+}
+
+// wahaProvider talks to a self-hosted WAHA instance. The device instance holds
+// the WAHA base URL and device_id the session name.
+type wahaProvider struct {
+	httpClient *http.Client
+}
+
+func (p *wahaProvider) SendText(ctx context.Context, device *models.DeviceSetting, to, text string) error {
+	payload := map[string]string{
+		"session": wahaSession(device),
+		"chatId":  wahaChatID(to),
+		"text":    text,
+	}
+	return p.post(ctx, device, "/api/sendText", payload)
+}
+
+// wahaMediaEndpoints maps message types to WAHA send endpoints
+var wahaMediaEndpoints = map[string]string{
+	"image": "/api/sendImage",
+	"audio": "/api/sendVoice",
+	"video": "/api/sendVideo",
+}
+
+func (p *wahaProvider) SendMedia(ctx context.Context, device *models.DeviceSetting, to, mediaType, mediaURL, caption string) error {
+	endpoint, ok := wahaMediaEndpoints[mediaType]
+	if !ok {
+		return fmt.Errorf("unsupported WAHA media type %q", mediaType)
+	}
+
+	payload := map[string]interface{}{
+		"session": wahaSession(device),
+		"chatId":  wahaChatID(to),
+		"file":    map[string]string{"url": mediaURL},
+	}
+	if caption != "" && mediaType != "audio" {
+		payload["caption"] = caption
+	}
+	return p.post(ctx, device, endpoint, payload)
+}
+
+func (p *wahaProvider) StartTyping(ctx context.Context, device *models.DeviceSetting, to string) error {
+	payload := map[string]string{
+		"session": wahaSession(device),
+		"chatId":  wahaChatID(to),
+	}
+	return p.post(ctx, device, "/api/startTyping", payload)
+}
+
+func (p *wahaProvider) StopTyping(ctx context.Context, device *models.DeviceSetting, to string) error {
+	payload := map[string]string{
+		"session": wahaSession(device),
+		"chatId":  wahaChatID(to),
+	}
+	return p.post(ctx, device, "/api/stopTyping", payload)
+}
+
+func (p *wahaProvider) post(ctx context.Context, device *models.DeviceSetting, path string, payload interface{}) error {
+	baseURL := strings.TrimRight(stringValue(device.Instance), "/")
+	if baseURL == "" {
+		return fmt.Errorf("WAHA instance URL not configured for device %s", device.ID)
+	}
+
+	headers := map[string]string{}
+	if apiKey := stringValue(device.APIKey); apiKey != "" {
+		headers["X-Api-Key"] = apiKey
+	}
+	return postJSON(ctx, p.httpClient, baseURL+path, payload, headers)
+}
+
+func wahaSession(device *models.DeviceSetting) string {
+	if session := stringValue(device.DeviceID); session != "" {
+		return session
+	}
+	return defaultWAHASession
+}
+
+// wahaChatID converts a phone number into a WAHA chat ID
+func wahaChatID(to string) string {
+	if strings.Contains(to, "@") {
+		return to
+	}
+	return to + "@c.us"
+}
+
+func postJSON(ctx context.Context, client *http.Client, endpoint string, payload interface{}, headers map[string]string) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	return doProviderRequest(client, req)
+}
+
+func postForm(ctx context.Context, client *http.Client, endpoint string, form url.Values) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return doProviderRequest(client, req)
+}
+
+func doProviderRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &providerStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// providerStatusError is returned when a provider answers with a non-2xx status
+type providerStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *providerStatusError) Error() string {
+	return fmt.Sprintf("provider request failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+func (e *providerStatusError) HTTPStatus() int {
+	return e.StatusCode
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}